@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxMessageLength is the longest text Telegram accepts in one message
+const maxMessageLength = 4096
+
+// weekdayNames are the Russian names of the days of the week
+var weekdayNames = [...]string{"воскресенье", "понедельник", "вторник", "среда", "четверг", "пятница", "суббота"}
+
+// AgendaBooking is a booking of the day with the visitor's contacts
+type AgendaBooking struct {
+	StartTime time.Time
+	Status    string
+	Confirmed bool
+	FirstName string
+	LastName  string
+	Username  string
+	Phone     string
+	Service   string // Reason for the visit chosen when booking, or the service tagged at the counter
+}
+
+// GetAgendaBookings returns the bookings of the date by start time
+func GetAgendaBookings(db *sql.DB, date time.Time) ([]AgendaBooking, error) {
+	dayStart := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	query := `
+		SELECT s.start_time, COALESCE(s.status, 'booked'), s.confirmed_at IS NOT NULL,
+			COALESCE(u.first_name, s.username, ''), COALESCE(u.last_name, ''), COALESCE(u.username, ''), COALESCE(u.phone_number, ''),
+			COALESCE(s.service, (SELECT t.service FROM tickets t WHERE t.slot_id = s.id AND t.service IS NOT NULL ORDER BY t.id DESC LIMIT 1), '')
+		FROM slots s
+		LEFT JOIN users u ON u.telegram_id = s.user_id
+		WHERE s.user_id IS NOT NULL AND s.start_time >= ? AND s.start_time < ?
+		ORDER BY s.start_time
+	`
+
+	rows, err := db.Query(query, dayStart, dayStart.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookings []AgendaBooking
+	for rows.Next() {
+		var b AgendaBooking
+		if err := rows.Scan(&b.StartTime, &b.Status, &b.Confirmed, &b.FirstName, &b.LastName, &b.Username, &b.Phone, &b.Service); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, b)
+	}
+
+	return bookings, rows.Err()
+}
+
+// agendaStatus describes the state of a booking for staff
+func agendaStatus(b AgendaBooking) string {
+	switch b.Status {
+	case SlotStatusAwaitingPayment:
+		return "⏳ ждёт оплаты"
+	case SlotStatusArrived:
+		return "📍 пришёл"
+	case SlotStatusNoShow:
+		return "🚫 не пришёл"
+	}
+	if b.Confirmed {
+		return "✅ подтвердил визит"
+	}
+	return ""
+}
+
+// formatAgenda lists the day's bookings with contacts and merges free slots into gaps
+func formatAgenda(date time.Time, bookings []AgendaBooking, config *Config) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "📋 Расписание на %s, %s\n", date.Format("02.01.2006"), weekdayNames[date.Weekday()])
+
+	byTime := make(map[string]AgendaBooking, len(bookings))
+	for _, booking := range bookings {
+		byTime[booking.StartTime.Format("15:04")] = booking
+	}
+
+	slotDuration := time.Duration(config.SlotDuration) * time.Minute
+	slots := GenerateSlotsForDate(date, config)
+	var gapStart time.Time
+	gapSlots, free := 0, 0
+
+	flushGap := func(end time.Time) {
+		if gapSlots > 0 {
+			fmt.Fprintf(&b, "\n%s–%s ⬜ свободно", gapStart.Format("15:04"), end.Format("15:04"))
+		}
+		gapSlots = 0
+	}
+
+	for _, slot := range slots {
+		booking, ok := byTime[slot.Format("15:04")]
+		if !ok {
+			if gapSlots == 0 {
+				gapStart = slot
+			}
+			gapSlots++
+			free++
+			continue
+		}
+		flushGap(slot)
+		delete(byTime, slot.Format("15:04"))
+		b.WriteString("\n" + formatAgendaBooking(booking))
+	}
+	if len(slots) > 0 {
+		flushGap(slots[len(slots)-1].Add(slotDuration))
+	}
+
+	// Bookings outside the current working hours, e.g. made before the schedule changed
+	for _, booking := range bookings {
+		if _, ok := byTime[booking.StartTime.Format("15:04")]; ok {
+			b.WriteString("\n" + formatAgendaBooking(booking))
+		}
+	}
+
+	fmt.Fprintf(&b, "\n\nЗаписей: %d, свободных слотов: %d", len(bookings), free)
+	return b.String()
+}
+
+// formatAgendaBooking formats one line of the agenda
+func formatAgendaBooking(booking AgendaBooking) string {
+	line := fmt.Sprintf("%s 👤 %s", booking.StartTime.Format("15:04"), html.EscapeString(strings.TrimSpace(booking.FirstName+" "+booking.LastName)))
+	if booking.Username != "" {
+		line += " @" + html.EscapeString(booking.Username)
+	}
+	if booking.Phone != "" {
+		line += " 📱 " + html.EscapeString(booking.Phone)
+	}
+	if status := agendaStatus(booking); status != "" {
+		line += " — " + status
+	}
+	if booking.Service != "" {
+		line += "\n      Цель визита: " + html.EscapeString(booking.Service)
+	}
+	return line
+}
+
+// SetVisitReason records the reason for the visit the user chose for their booking
+func SetVisitReason(db *sql.DB, slotID int, userID int64, reason string) error {
+	result, err := db.Exec("UPDATE slots SET service = ? WHERE id = ? AND user_id = ? AND start_time > ?", reason, slotID, userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrBookingNotFound
+	}
+	return nil
+}
+
+// askVisitReason asks the visitor to pick the reason for the visit from SERVICES, so staff see it in the agenda
+func (app *App) askVisitReason(chatID int64, slot *Slot) {
+	if len(app.config.Services) == 0 {
+		return
+	}
+
+	slotID := strconv.Itoa(slot.ID)
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, service := range app.config.Services {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(service, app.callbacks.Encode(cbVisitReason, slotID, strconv.Itoa(i))),
+		))
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "📝 С какой целью вы придёте? Это поможет подготовиться к приёму.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if err := app.queueMessage(msg); err != nil {
+		log.Printf("Error asking visit reason: %v", err)
+	}
+}
+
+// splitMessage splits a long text on line breaks into parts Telegram accepts.
+// A line longer than the limit is cut between characters.
+func splitMessage(text string, limit int) []string {
+	var parts []string
+	for len(text) > limit {
+		cut := strings.LastIndex(text[:limit], "\n")
+		if cut <= 0 {
+			cut = limit
+			for cut > 1 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+		}
+		parts = append(parts, strings.TrimRight(text[:cut], "\n"))
+		text = strings.TrimLeft(text[cut:], "\n")
+	}
+	return append(parts, text)
+}
+
+// nextAgendaTime returns the first digest time after the given moment, skipping days off
+func nextAgendaTime(after time.Time, config *Config) (time.Time, error) {
+	at, err := time.Parse("15:04", config.AgendaTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	next := time.Date(after.Year(), after.Month(), after.Day(), at.Hour(), at.Minute(), 0, 0, after.Location())
+	for !next.After(after) || (config.SkipWeekend && IsWeekend(next)) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
+
+// ScheduleAgenda schedules the next daily digest after the given moment unless one is already pending
+func ScheduleAgenda(db *sql.DB, config *Config, after time.Time) error {
+	if config.AgendaTime == "" {
+		return nil
+	}
+
+	var pending bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM jobs WHERE kind = ? AND status = ? AND run_at > ?)",
+		JobAgenda, JobStatusPending, after).Scan(&pending)
+	if err != nil || pending {
+		return err
+	}
+
+	runAt, err := nextAgendaTime(after, config)
+	if err != nil {
+		return err
+	}
+	return ScheduleJob(db, &Job{Kind: JobAgenda, RunAt: runAt})
+}
+
+// agendaRecipients returns the admins and operators, each once
+func agendaRecipients(config *Config) []int64 {
+	seen := make(map[int64]bool)
+	var recipients []int64
+	for _, id := range append(append([]int64{}, config.AdminIDs...), config.OperatorIDs...) {
+		if !seen[id] {
+			seen[id] = true
+			recipients = append(recipients, id)
+		}
+	}
+	return recipients
+}
+
+// sendAgenda sends the agenda of the date to the chat
+func (app *App) sendAgenda(chatID int64, date time.Time) error {
+	bookings, err := GetAgendaBookings(app.db, date)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range splitMessage(formatAgenda(date, bookings, app.config), maxMessageLength) {
+		if err := app.sendMessage(chatID, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendAgendaDigest sends the day's agenda to the staff and schedules the next digest.
+// A digest that missed its day while the bot was down is dropped.
+func (app *App) sendAgendaDigest(job *Job) error {
+	if app.config.AgendaTime == "" {
+		return nil
+	}
+
+	now := time.Now()
+	if job.RunAt.Format(queueDateLayout) == now.Format(queueDateLayout) {
+		// Errors are logged per recipient: failing the job would resend the digest to everyone on retry
+		for _, staffID := range agendaRecipients(app.config) {
+			if err := app.sendAgenda(staffID, now); err != nil {
+				log.Printf("Error sending the agenda digest to %d: %v", staffID, err)
+			}
+		}
+		log.Printf("Sent the agenda digest for %s", now.Format("02.01.2006"))
+	}
+
+	return ScheduleAgenda(app.db, app.config, job.RunAt)
+}
+
+// Handlers
+
+func handleToday(app *App, update *tgbotapi.Update) error {
+	return app.handleAgendaCommand(update, time.Now())
+}
+
+func handleTomorrow(app *App, update *tgbotapi.Update) error {
+	return app.handleAgendaCommand(update, time.Now().AddDate(0, 0, 1))
+}
+
+// handleVisitReasonCallback records the reason for the visit picked by the visitor
+func (app *App) handleVisitReasonCallback(callback *tgbotapi.CallbackQuery, slotID int, service int) error {
+	chatID := callback.Message.Chat.ID
+
+	if service < 0 || service >= len(app.config.Services) {
+		return app.sendMessage(chatID, "Этот вариант больше недоступен")
+	}
+	reason := app.config.Services[service]
+
+	if err := SetVisitReason(app.db, slotID, callback.From.ID, reason); err != nil {
+		if err != ErrBookingNotFound {
+			log.Printf("Error setting visit reason of slot %d: %v", slotID, err)
+		}
+		return app.sendMessage(chatID, "❌ Запись не найдена или уже отменена.")
+	}
+
+	app.removeKeyboard(chatID, callback.Message.MessageID)
+	return app.sendMessage(chatID, "Спасибо! Цель визита: "+html.EscapeString(reason))
+}
+
+// handleAgendaCommand shows the agenda of the date to staff on demand
+func (app *App) handleAgendaCommand(update *tgbotapi.Update, date time.Time) error {
+	chatID := update.Message.Chat.ID
+
+	if !IsOperator(app.config, update.Message.From.ID) {
+		return app.sendMessage(chatID, "Расписание доступно администраторам и операторам")
+	}
+
+	if err := app.sendAgenda(chatID, date); err != nil {
+		log.Printf("Error sending agenda: %v", err)
+		return app.sendMessage(chatID, "Ошибка при получении расписания")
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestFormatAgenda(t *testing.T) {
+	config := newTestConfig()
+	day := time.Date(2026, 10, 19, 0, 0, 0, 0, time.Local)
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, 10, 19, hour, minute, 0, 0, time.Local)
+	}
+
+	bookings := []AgendaBooking{
+		{StartTime: at(9, 0), Status: SlotStatusBooked, Confirmed: true, FirstName: "Анна", LastName: "Петрова", Username: "anna", Phone: "+79123456789"},
+		{StartTime: at(9, 30), Status: SlotStatusBooked, FirstName: "Борис"},
+		{StartTime: at(11, 0), Status: SlotStatusBooked, FirstName: "<Вера>", Service: "Справка"},
+		{StartTime: at(20, 0), Status: SlotStatusNoShow, FirstName: "Глеб"},
+	}
+
+	want := `📋 Расписание на 19.10.2026, понедельник
+
+09:00 👤 Анна Петрова @anna 📱 +79123456789 — ✅ подтвердил визит
+09:30 👤 Борис
+10:00–11:00 ⬜ свободно
+11:00 👤 &lt;Вера&gt;
+      Цель визита: Справка
+11:30–18:00 ⬜ свободно
+20:00 👤 Глеб — 🚫 не пришёл
+
+Записей: 4, свободных слотов: 15`
+	if got := formatAgenda(day, bookings, config); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// A day without bookings is one gap
+	want = "📋 Расписание на 19.10.2026, понедельник\n\n09:00–18:00 ⬜ свободно\n\nЗаписей: 0, свободных слотов: 18"
+	if got := formatAgenda(day, nil, config); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestNextAgendaTime(t *testing.T) {
+	config := newTestConfig()
+	config.AgendaTime = "08:00"
+	config.SkipWeekend = true
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name        string
+		after       time.Time
+		skipWeekend bool
+		want        time.Time
+	}{
+		{"before the time on a weekday", at(20, 7, 59), true, at(20, 8, 0)},
+		{"at the time", at(20, 8, 0), true, at(21, 8, 0)},
+		{"after the time on a weekday", at(20, 12, 0), true, at(21, 8, 0)},
+		{"Friday evening skips the weekend", at(23, 18, 0), true, at(26, 8, 0)},
+		{"Saturday skips Sunday", at(24, 7, 0), true, at(26, 8, 0)},
+		{"weekend kept", at(23, 18, 0), false, at(24, 8, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.SkipWeekend = tt.skipWeekend
+			got, err := nextAgendaTime(tt.after, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("got %s, want %s", got.Format("Mon 02.01 15:04"), tt.want.Format("Mon 02.01 15:04"))
+			}
+		})
+	}
+
+	config.AgendaTime = "8am"
+	if _, err := nextAgendaTime(at(20, 7, 0), config); err == nil {
+		t.Fatal("got no error for a malformed AGENDA_TIME")
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{"short text", "one\ntwo", 10, []string{"one\ntwo"}},
+		{"split on line breaks", "aaa\nbbb\nccc", 8, []string{"aaa\nbbb", "ccc"}},
+		{"blank lines at a cut are dropped", "aaa\n\n\nbbb", 5, []string{"aaa", "bbb"}},
+		{"long line cut at the limit", "abcdefgh", 3, []string{"abc", "def", "gh"}},
+		{"long line cut between characters", "ааааа", 5, []string{"аа", "аа", "а"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitMessage(tt.text, tt.limit); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMessageKeepsRunesWhole(t *testing.T) {
+	text := strings.Repeat("Запись без переносов строк 📋 ", 400)
+
+	parts := splitMessage(text, maxMessageLength)
+	if len(parts) < 2 {
+		t.Fatalf("got %d parts, want the text split", len(parts))
+	}
+	for i, part := range parts {
+		if len(part) > maxMessageLength || !utf8.ValidString(part) {
+			t.Fatalf("part %d has %d bytes, valid UTF-8: %v", i, len(part), utf8.ValidString(part))
+		}
+	}
+	if strings.Join(parts, "") != text {
+		t.Fatal("parts don't add up to the text")
+	}
+}
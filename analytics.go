@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Visit duration report settings
+const (
+	analyticsDefaultDays = 30
+	analyticsBucket      = 5 * time.Minute // Histogram bucket and slot length step
+	analyticsBarWidth    = 16              // Characters of the longest histogram bar
+	analyticsMaxBuckets  = 24              // Histogram rows, longer visits go to the last one
+	slotCoverage         = 80              // Percent of visits a recommended slot should fit
+)
+
+// Visit is a served ticket with its measured duration
+type Visit struct {
+	Stage    int
+	Service  string
+	Operator int64
+	Duration time.Duration // From start (or call, if not started) to finish
+}
+
+// DurationStats summarizes visit durations
+type DurationStats struct {
+	Count  int
+	Mean   time.Duration
+	Median time.Duration
+	P90    time.Duration
+}
+
+// GetVisits returns visits served since the given time, one per route stage the visitor went through
+func GetVisits(db *sql.DB, since time.Time) ([]Visit, error) {
+	// Finished stages of a route are kept in ticket_stages, the ticket row holds the last one
+	query := `
+		SELECT stage, COALESCE(service, ''), operator_id, started_at, finished_at
+		FROM ticket_stages
+		WHERE finished_at >= ? AND operator_id IS NOT NULL
+		UNION ALL
+		SELECT COALESCE(stage, 0), COALESCE(service, ''), operator_id, COALESCE(started_at, called_at), served_at
+		FROM tickets
+		WHERE status = ? AND served_at >= ? AND called_at IS NOT NULL AND operator_id IS NOT NULL
+	`
+
+	rows, err := db.Query(query, since, TicketStatusServed, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var visits []Visit
+	for rows.Next() {
+		var visit Visit
+		var startedAt, finishedAt time.Time
+		if err := rows.Scan(&visit.Stage, &visit.Service, &visit.Operator, &startedAt, &finishedAt); err != nil {
+			return nil, err
+		}
+
+		visit.Duration = finishedAt.Sub(startedAt)
+		if visit.Duration < 0 {
+			continue
+		}
+		visits = append(visits, visit)
+	}
+
+	return visits, rows.Err()
+}
+
+// SummarizeDurations computes count, mean and percentiles
+func SummarizeDurations(durations []time.Duration) DurationStats {
+	stats := DurationStats{Count: len(durations)}
+	if len(durations) == 0 {
+		return stats
+	}
+
+	sorted := sortedDurations(durations)
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	stats.Mean = total / time.Duration(len(sorted))
+	stats.Median = percentile(sorted, 50)
+	stats.P90 = percentile(sorted, 90)
+	return stats
+}
+
+// RecommendSlotLength returns the slot length fitting slotCoverage percent of visits,
+// rounded up to the histogram step
+func RecommendSlotLength(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	p := percentile(sortedDurations(durations), slotCoverage)
+	slot := (p + analyticsBucket - 1) / analyticsBucket * analyticsBucket
+	if slot < analyticsBucket {
+		slot = analyticsBucket
+	}
+	return slot
+}
+
+// sortedDurations returns a sorted copy
+func sortedDurations(durations []time.Duration) []time.Duration {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// percentile returns the nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// formatMinutes formats a duration as minutes for reports
+func formatMinutes(d time.Duration) string {
+	return strconv.FormatFloat(d.Minutes(), 'f', 1, 64)
+}
+
+// durationHistogram draws a text histogram in analyticsBucket steps. A forgotten ticket
+// shouldn't stretch the report past the message limit, so the last row is open-ended.
+func durationHistogram(durations []time.Duration) string {
+	counts := make(map[int]int)
+	maxBucket, maxCount := 0, 0
+	for _, d := range durations {
+		bucket := min(int(d/analyticsBucket), analyticsMaxBuckets-1)
+		counts[bucket]++
+		if bucket > maxBucket {
+			maxBucket = bucket
+		}
+		if counts[bucket] > maxCount {
+			maxCount = counts[bucket]
+		}
+	}
+
+	step := int(analyticsBucket.Minutes())
+	var b strings.Builder
+	for bucket := 0; bucket <= maxBucket; bucket++ {
+		bar := strings.Repeat("█", (counts[bucket]*analyticsBarWidth+maxCount-1)/maxCount)
+		if bucket == analyticsMaxBuckets-1 {
+			fmt.Fprintf(&b, "%3d+    %s %d\n", bucket*step, bar, counts[bucket])
+			continue
+		}
+		fmt.Fprintf(&b, "%3d–%-3d %s %d\n", bucket*step, (bucket+1)*step, bar, counts[bucket])
+	}
+	return b.String()
+}
+
+// Handlers
+
+func handleVisits(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+
+	if !IsAdmin(app.config, update.Message.From.ID) {
+		return app.sendMessage(chatID, "У вас нет прав администратора")
+	}
+
+	days := analyticsDefaultDays
+	if arg := update.Message.CommandArguments(); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return app.sendMessage(chatID, "Укажите период в днях: /visits 30")
+		}
+		days = n
+	}
+
+	visits, err := GetVisits(app.db, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Printf("Error getting visits: %v", err)
+		return app.sendMessage(chatID, "Ошибка при получении статистики")
+	}
+	if len(visits) == 0 {
+		return app.sendMessage(chatID, fmt.Sprintf("За последние %d дн. нет обслуженных визитов", days))
+	}
+
+	var all []time.Duration
+	byService := make(map[string][]time.Duration)
+	byOperator := make(map[int64][]time.Duration)
+	byStage := make(map[int][]time.Duration)
+	for _, visit := range visits {
+		all = append(all, visit.Duration)
+		byStage[visit.Stage] = append(byStage[visit.Stage], visit.Duration)
+		byService[visit.Service] = append(byService[visit.Service], visit.Duration)
+		byOperator[visit.Operator] = append(byOperator[visit.Operator], visit.Duration)
+	}
+
+	overall := SummarizeDurations(all)
+	message := fmt.Sprintf(`⏱ Длительность визитов за %d дн. (мин.)
+
+Визитов: %d
+Среднее: %s, медиана: %s, 90%%: %s
+
+<pre>%s</pre>`, days, overall.Count, formatMinutes(overall.Mean), formatMinutes(overall.Median), formatMinutes(overall.P90), durationHistogram(all))
+
+	if len(app.config.Services) > 0 {
+		message += "\n\n<b>По услугам</b> (визитов, медиана, 90%):"
+		services := make([]string, 0, len(byService))
+		for service := range byService {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+		for _, service := range services {
+			name := service
+			if name == "" {
+				name = "без услуги"
+			}
+			message += "\n" + statsLine(html.EscapeString(name), byService[service])
+		}
+	}
+
+	if len(app.config.Route) > 1 {
+		message += "\n\n<b>По этапам</b> (визитов, медиана, 90%):"
+		for stage := range app.config.Route {
+			if durations := byStage[stage]; len(durations) > 0 {
+				message += "\n" + statsLine(html.EscapeString(stageName(app.config, stage)), durations)
+			}
+		}
+	}
+
+	message += "\n\n<b>По специалистам</b> (визитов, медиана, 90%):"
+	operators := make([]int64, 0, len(byOperator))
+	for operator := range byOperator {
+		operators = append(operators, operator)
+	}
+	sort.Slice(operators, func(i, j int) bool { return operators[i] < operators[j] })
+	for _, operator := range operators {
+		name := strconv.FormatInt(operator, 10)
+		if user, err := GetUserByTelegramID(app.db, operator); err == nil && user != nil {
+			name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		}
+		message += "\n" + statsLine(html.EscapeString(name), byOperator[operator])
+	}
+
+	recommended := RecommendSlotLength(all)
+	message += fmt.Sprintf("\n\n💡 Рекомендуемая длительность слота: <b>%d мин.</b> (укладываются %d%% визитов), сейчас SLOT_DURATION=%d",
+		int(recommended.Minutes()), slotCoverage, app.config.SlotDuration)
+
+	return app.sendMessage(chatID, message)
+}
+
+// statsLine formats one breakdown row of the report
+func statsLine(name string, durations []time.Duration) string {
+	stats := SummarizeDurations(durations)
+	return fmt.Sprintf("• %s: %d, %s, %s", name, stats.Count, formatMinutes(stats.Median), formatMinutes(stats.P90))
+}
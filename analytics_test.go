@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// minutes builds durations from whole minutes
+func minutes(values ...int) []time.Duration {
+	durations := make([]time.Duration, len(values))
+	for i, v := range values {
+		durations[i] = time.Duration(v) * time.Minute
+	}
+	return durations
+}
+
+func TestSummarizeDurations(t *testing.T) {
+	tests := []struct {
+		name      string
+		durations []time.Duration
+		want      DurationStats
+	}{
+		{"empty", nil, DurationStats{}},
+		{"single", minutes(7), DurationStats{Count: 1, Mean: 7 * time.Minute, Median: 7 * time.Minute, P90: 7 * time.Minute}},
+		{"nearest rank", minutes(10, 1, 9, 2, 8, 3, 7, 4, 6, 5), DurationStats{Count: 10, Mean: 330 * time.Second, Median: 5 * time.Minute, P90: 9 * time.Minute}},
+		{"outlier", minutes(10, 10, 10, 10, 10, 10, 10, 10, 10, 300), DurationStats{Count: 10, Mean: 39 * time.Minute, Median: 10 * time.Minute, P90: 10 * time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SummarizeDurations(tt.durations); got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecommendSlotLength(t *testing.T) {
+	tests := []struct {
+		name      string
+		durations []time.Duration
+		want      time.Duration
+	}{
+		{"empty", nil, 0},
+		{"rounds up to the step", minutes(1, 2, 3, 4, 5, 6, 7, 8, 9, 10), 10 * time.Minute}, // 80% fit in 8 min
+		{"step boundary", minutes(15, 15, 15, 15, 15), 15 * time.Minute},
+		{"at least one step", minutes(1, 1, 2), 5 * time.Minute},
+		{"long tail beyond coverage", minutes(12, 12, 12, 12, 60), 15 * time.Minute},
+		{"long tail within coverage", minutes(12, 12, 12, 60, 60), 60 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RecommendSlotLength(tt.durations); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationHistogram(t *testing.T) {
+	rows := strings.Split(strings.TrimSuffix(durationHistogram(minutes(1, 3, 12)), "\n"), "\n")
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows, want 3:\n%s", len(rows), strings.Join(rows, "\n"))
+	}
+	if !strings.HasPrefix(rows[0], "  0–5  ") || !strings.HasSuffix(rows[0], " 2") {
+		t.Fatalf("first row %q, want 0–5 with 2 visits", rows[0])
+	}
+	if !strings.HasSuffix(rows[1], " 0") {
+		t.Fatalf("empty bucket row %q, want 0 visits", rows[1])
+	}
+
+	// A ticket left open for a day doesn't add hundreds of rows
+	rows = strings.Split(strings.TrimSuffix(durationHistogram(minutes(4, 200, 24*60)), "\n"), "\n")
+	if len(rows) != analyticsMaxBuckets {
+		t.Fatalf("got %d rows, want %d", len(rows), analyticsMaxBuckets)
+	}
+	if last := rows[len(rows)-1]; !strings.HasPrefix(last, "115+") || !strings.HasSuffix(last, " 2") {
+		t.Fatalf("last row %q, want open-ended 115+ with 2 visits", last)
+	}
+}
+
+func TestGetVisitsCountsEveryRouteStage(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	route, err := ParseRoute("Регистрация:1;Специалист:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Route = route
+
+	// Registration took 5 minutes with operator 7
+	now := time.Now()
+	result, err := db.Exec(`
+		INSERT INTO tickets (queue_date, prefix, number, status, issued_at, called_at, started_at, counter, operator_id, stage)
+		VALUES (?, 'A', 1, ?, ?, ?, ?, 1, 7, 0)
+	`, now.Format(queueDateLayout), TicketStatusCalled, now.Add(-30*time.Minute), now.Add(-20*time.Minute), now.Add(-5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticketID, _ := result.LastInsertId()
+	if _, err := FinishTicket(db, ticketID, 7, TicketStatusServed, config); err != nil {
+		t.Fatal(err)
+	}
+
+	// Operator 8 calls the visitor to the specialist and serves them
+	ticket, _, err := CallNextTicket(db, 8, 2, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.ID != ticketID {
+		t.Fatalf("got ticket %d at the second stage, want %d", ticket.ID, ticketID)
+	}
+	if _, err := FinishTicket(db, ticketID, 8, TicketStatusServed, config); err != nil {
+		t.Fatal(err)
+	}
+
+	visits, err := GetVisits(db, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visits) != 2 {
+		t.Fatalf("got %d visits, want one per stage: %+v", len(visits), visits)
+	}
+	operators := make(map[int]int64)
+	for _, visit := range visits {
+		operators[visit.Stage] = visit.Operator
+	}
+	if operators[0] != 7 || operators[1] != 8 {
+		t.Fatalf("got operators by stage %v, want 7 at registration and 8 at the specialist", operators)
+	}
+
+	// Stages finished before the period are left out
+	if visits, err := GetVisits(db, now.Add(time.Minute)); err != nil || len(visits) != 0 {
+		t.Fatalf("got %d visits, %v for a later period, want none", len(visits), err)
+	}
+}
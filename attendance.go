@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ConfirmSlot records that the visitor will come to their booking
+func ConfirmSlot(db *sql.DB, slotID int, userID int64) error {
+	result, err := db.Exec(
+		"UPDATE slots SET confirmed_at = COALESCE(confirmed_at, ?) WHERE id = ? AND user_id = ? AND COALESCE(status, 'booked') = ? AND start_time > ?",
+		time.Now(), slotID, userID, SlotStatusBooked, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrBookingNotFound
+	}
+
+	return nil
+}
+
+// ReleaseUnconfirmedSlot frees the user's booking if it is still unconfirmed.
+// Bookings with a paid deposit are kept, the deposit already commits the visitor.
+func ReleaseUnconfirmedSlot(db *sql.DB, slotID int, userID int64) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	where := `id = ? AND user_id = ? AND COALESCE(status, 'booked') = ? AND confirmed_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM payments WHERE payments.slot_id = slots.id AND payments.code = slots.code AND payments.status = ?)`
+
+	result, err := releaseSlots(tx, where, slotID, userID, SlotStatusBooked, PaymentStatusPaid)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	if err := cancelSlotJobs(tx, slotID); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// scheduleConfirmDeadline schedules the release of the booking unless it is confirmed in time.
+// Bookings that get no reminder before the deadline have nothing to confirm and are kept.
+func scheduleConfirmDeadline(ex execer, slot *Slot, config *Config, reminders []time.Time) error {
+	if config.ConfirmDeadline <= 0 {
+		return nil
+	}
+
+	deadline := slot.StartTime.Add(-config.ConfirmDeadline)
+	reminded := false
+	for _, runAt := range reminders {
+		if runAt.After(time.Now()) && runAt.Before(deadline) {
+			reminded = true
+		}
+	}
+	if !reminded {
+		return nil
+	}
+
+	return ScheduleJob(ex, &Job{
+		Kind:   JobConfirmDeadline,
+		SlotID: sql.NullInt64{Int64: int64(slot.ID), Valid: true},
+		UserID: slot.UserID,
+		RunAt:  deadline,
+	})
+}
+
+// dropUnremindedDeadline cancels the booking's confirmation deadline once no reminder, sent or pending,
+// comes before it: the visitor would lose the booking without being asked to confirm it
+func dropUnremindedDeadline(ex execer, slotID int) error {
+	_, err := ex.Exec(`
+		UPDATE jobs SET status = ?, finished_at = ?
+		WHERE slot_id = ? AND kind = ? AND status = ?
+			AND NOT EXISTS (
+				SELECT 1 FROM jobs AS reminders
+				WHERE reminders.slot_id = jobs.slot_id AND reminders.user_id = jobs.user_id AND reminders.kind = ?
+					AND reminders.status IN (?, ?) AND reminders.run_at < jobs.run_at
+			)
+	`, JobStatusCancelled, time.Now(), slotID, JobConfirmDeadline, JobStatusPending, JobReminder, JobStatusPending, JobStatusDone)
+	return err
+}
+
+// releaseUnconfirmed releases a booking whose confirmation deadline has passed and offers the time to the waitlist
+func (app *App) releaseUnconfirmed(job *Job) error {
+	slot, err := GetSlotByID(app.db, int(job.SlotID.Int64))
+	if err != nil {
+		return err
+	}
+	if slot == nil || slot.UserID != job.UserID {
+		return nil
+	}
+
+	released, err := ReleaseUnconfirmedSlot(app.db, slot.ID, job.UserID.Int64)
+	if err != nil || !released {
+		return err
+	}
+	log.Printf("Released unconfirmed slot %d of user %d", slot.ID, job.UserID.Int64)
+
+	message := fmt.Sprintf(`❌ Запись на %s отменена, так как вы не подтвердили визит.
+
+Записаться снова: /book`, slot.StartTime.Format("02.01.2006 15:04"))
+	if err := app.sendMessage(job.UserID.Int64, message); err != nil {
+		log.Printf("Error notifying user %d about the released slot: %v", job.UserID.Int64, err)
+	}
+
+	app.offerReleasedSlot(slot.StartTime)
+	app.syncBookingCard(slot, OpsStateReleased, "")
+	return nil
+}
+
+// reminderKeyboard offers to confirm an unconfirmed booking or cancel it
+func (app *App) reminderKeyboard(slot *Slot, language string) tgbotapi.InlineKeyboardMarkup {
+	texts := reminderTextsFor(language)
+	slotID := strconv.Itoa(slot.ID)
+	var row []tgbotapi.InlineKeyboardButton
+	if !slot.ConfirmedAt.Valid {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(texts.Confirm, app.callbacks.Encode(cbConfirm, slotID)))
+	}
+	row = append(row, tgbotapi.NewInlineKeyboardButtonData(texts.Cancel, app.callbacks.Encode(cbCancel, slotID)))
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+// Handlers
+
+// handleConfirmCallback confirms the visit from a reminder
+func (app *App) handleConfirmCallback(callback *tgbotapi.CallbackQuery, slotID int) error {
+	chatID := callback.Message.Chat.ID
+
+	if err := ConfirmSlot(app.db, slotID, callback.From.ID); err != nil {
+		if err != ErrBookingNotFound {
+			log.Printf("Error confirming slot %d: %v", slotID, err)
+		}
+		return app.sendMessage(chatID, "❌ Запись не найдена или уже отменена.")
+	}
+
+	slot, err := GetSlotByID(app.db, slotID)
+	if err != nil || slot == nil {
+		return app.sendMessage(chatID, "✅ Визит подтверждён.")
+	}
+
+	app.syncBookingCard(slot, OpsStateConfirmed, "Подтверждён посетителем")
+	language := LangRussian
+	if settings, err := GetUserSettings(app.db, callback.From.ID); err == nil {
+		language = settings.Language
+	}
+	app.editKeyboard(chatID, callback.Message.MessageID, app.reminderKeyboard(slot, language))
+	return app.sendMessage(chatID, fmt.Sprintf("✅ Спасибо! Ждём вас %s.", slot.StartTime.Format("02.01.2006 в 15:04")))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConfirmLegacyBooking(t *testing.T) {
+	db := newTestDB(t)
+	addTestUsers(t, db, 1)
+	slotID := addLegacyBooking(t, db, testSlotTime(10, 0), 1)
+
+	if err := ConfirmSlot(db, slotID, 1); err != nil {
+		t.Fatalf("ConfirmSlot of a booking without status: %v", err)
+	}
+	slot, err := GetSlotByID(db, slotID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slot.ConfirmedAt.Valid {
+		t.Fatal("booking not confirmed")
+	}
+
+	// A confirmed booking is kept at the deadline
+	released, err := ReleaseUnconfirmedSlot(db, slotID, 1)
+	if err != nil || released {
+		t.Fatalf("confirmed booking released: %v", err)
+	}
+}
+
+func TestReleaseUnconfirmedLegacyBooking(t *testing.T) {
+	db := newTestDB(t)
+	addTestUsers(t, db, 1)
+	slotID := addLegacyBooking(t, db, testSlotTime(10, 0), 1)
+
+	released, err := ReleaseUnconfirmedSlot(db, slotID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !released {
+		t.Fatal("unconfirmed booking without status kept")
+	}
+	slot, err := GetSlotByID(db, slotID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot.UserID.Valid {
+		t.Fatalf("slot still belongs to user %d", slot.UserID.Int64)
+	}
+}
+
+func TestReleaseUnconfirmedIgnoresEarlierBookingsDeposit(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	addTestUsers(t, db, 1, 2)
+
+	slot, err := BookTimeSlot(db, testSlotTime(10, 0), 2, "user", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A deposit paid for an earlier booking of the same slot
+	_, err = db.Exec(`
+		INSERT INTO payments (slot_id, user_id, code, amount, currency, telegram_charge_id, status)
+		VALUES (?, 1, 'OLD001', 50000, 'RUB', 'tg-old', ?)
+	`, slot.ID, PaymentStatusPaid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := ReleaseUnconfirmedSlot(db, slot.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !released {
+		t.Fatal("unconfirmed booking kept because of another booking's deposit")
+	}
+}
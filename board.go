@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Queue event types
+const (
+	QueueEventIssued    = "issued"
+	QueueEventCalled    = "called"
+	QueueEventRecalled  = "recalled"
+	QueueEventServed    = "served"
+	QueueEventSkipped   = "skipped"
+	QueueEventCancelled = "cancelled"
+)
+
+// boardHeartbeat keeps idle SSE connections open through proxies
+const boardHeartbeat = 25 * time.Second
+
+// QueueEvent describes a change in the live queue
+type QueueEvent struct {
+	Type    string `json:"type"`
+	Ticket  string `json:"ticket"`
+	Counter int    `json:"counter,omitempty"`
+}
+
+// EventHub fans queue events out to subscribers such as display boards
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan QueueEvent]struct{}
+}
+
+// NewEventHub creates an event hub
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[chan QueueEvent]struct{})}
+}
+
+// Subscribe returns a channel receiving published events
+func (h *EventHub) Subscribe() chan QueueEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan QueueEvent, 16)
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe stops delivering events to the channel and closes it
+func (h *EventHub) Unsubscribe(ch chan QueueEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish sends the event to every subscriber, dropping it for subscribers that fall behind
+func (h *EventHub) Publish(event QueueEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// queueChanged publishes a queue event and tells visitors whose turn is near
+func (app *App) queueChanged(event QueueEvent) {
+	app.events.Publish(event)
+	app.notifyApproachingTickets()
+}
+
+// BoardServing is a ticket currently called to a counter
+type BoardServing struct {
+	Counter int    `json:"counter"`
+	Ticket  string `json:"ticket"`
+}
+
+// BoardState is everything the display board shows
+type BoardState struct {
+	Serving  []BoardServing `json:"serving"`
+	Upcoming []string       `json:"upcoming"`
+	Event    *QueueEvent    `json:"event,omitempty"`
+}
+
+// GetBoardState returns the called tickets per counter and the next waiting tickets
+func GetBoardState(db *sql.DB, config *Config) (*BoardState, error) {
+	now := time.Now()
+	queueDate := now.Format(queueDateLayout)
+	state := &BoardState{Serving: []BoardServing{}, Upcoming: []string{}}
+
+	rows, err := db.Query("SELECT "+ticketColumns+" FROM tickets WHERE queue_date = ? AND status = ? ORDER BY counter", queueDate, TicketStatusCalled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ticket, err := scanTicket(rows)
+		if err != nil {
+			return nil, err
+		}
+		state.Serving = append(state.Serving, BoardServing{Counter: int(ticket.Counter.Int64), Ticket: ticket.Label()})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	waiting, err := GetWaitingTickets(db, now, config)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(waiting) && i < config.BoardUpcoming; i++ {
+		state.Upcoming = append(state.Upcoming, waiting[i].Label())
+	}
+
+	return state, nil
+}
+
+// Handlers
+
+// handleBoard serves the display board page
+func (app *App) handleBoard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Title    string
+		Theme    string
+		Columns  int
+		Upcoming int
+	}{
+		Title:    app.config.BoardTitle,
+		Theme:    app.config.BoardTheme,
+		Columns:  app.config.BoardColumns,
+		Upcoming: app.config.BoardUpcoming,
+	}
+	if err := boardTemplate.Execute(w, data); err != nil {
+		log.Printf("Error rendering board: %v", err)
+	}
+}
+
+// handleBoardEvents streams board state over Server-Sent Events, once on connect and after every queue event
+func (app *App) handleBoardEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	events := app.events.Subscribe()
+	defer app.events.Unsubscribe(events)
+
+	send := func(event *QueueEvent) bool {
+		state, err := GetBoardState(app.db, app.config)
+		if err != nil {
+			log.Printf("Error getting board state: %v", err)
+			return true
+		}
+		state.Event = event
+
+		data, err := json.Marshal(state)
+		if err != nil {
+			log.Printf("Error encoding board state: %v", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !send(nil) {
+		return
+	}
+
+	heartbeat := time.NewTicker(boardHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if !send(&event) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// boardTemplate is self-contained so the board works on an offline kiosk
+var boardTemplate = template.Must(template.New("board").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+	:root { --bg: #10151f; --fg: #f5f7fa; --muted: #8a94a6; --panel: #1b2333; --accent: #ffcc00; }
+	body.light { --bg: #f5f7fa; --fg: #10151f; --muted: #5b6578; --panel: #ffffff; --accent: #d9480f; }
+	* { box-sizing: border-box; }
+	body { margin: 0; background: var(--bg); color: var(--fg); font-family: Arial, Helvetica, sans-serif; height: 100vh; display: flex; flex-direction: column; }
+	header { display: flex; justify-content: space-between; align-items: center; padding: 2vh 3vw; font-size: 4vh; }
+	#clock { color: var(--muted); }
+	main { flex: 1; display: grid; grid-template-columns: 2fr 1fr; gap: 3vw; padding: 0 3vw 3vh; }
+	h2 { font-size: 3vh; color: var(--muted); margin: 0 0 2vh; text-transform: uppercase; }
+	#serving { display: grid; grid-template-columns: repeat({{.Columns}}, 1fr); gap: 2vh; align-content: start; }
+	.call { background: var(--panel); border-radius: 1vh; padding: 2vh; display: flex; justify-content: space-between; font-size: 6vh; }
+	.call .counter { color: var(--muted); }
+	.call.flash { animation: flash 1s 5; }
+	@keyframes flash { 50% { background: var(--accent); color: var(--bg); } }
+	#upcoming div { font-size: 4.5vh; padding: 1vh 0; border-bottom: 1px solid var(--panel); }
+	#offline { display: none; position: fixed; bottom: 1vh; right: 1vw; color: var(--accent); font-size: 2vh; }
+</style>
+</head>
+<body class="{{.Theme}}">
+<header><span>{{.Title}}</span><span id="clock"></span></header>
+<main>
+	<section><h2>Сейчас обслуживаются</h2><div id="serving"></div></section>
+	<section><h2>Следующие</h2><div id="upcoming"></div></section>
+</main>
+<div id="offline">Нет связи с сервером…</div>
+<script>
+(function () {
+	var serving = document.getElementById("serving");
+	var upcoming = document.getElementById("upcoming");
+	var offline = document.getElementById("offline");
+
+	function tick() {
+		document.getElementById("clock").textContent = new Date().toLocaleTimeString("ru-RU", {hour: "2-digit", minute: "2-digit"});
+	}
+	tick();
+	setInterval(tick, 10000);
+
+	function render(state) {
+		serving.innerHTML = "";
+		state.serving.forEach(function (s) {
+			var el = document.createElement("div");
+			el.className = "call";
+			if (state.event && (state.event.type === "called" || state.event.type === "recalled") && state.event.ticket === s.ticket) {
+				el.className += " flash";
+			}
+			var ticket = document.createElement("span");
+			ticket.textContent = s.ticket;
+			var counter = document.createElement("span");
+			counter.className = "counter";
+			counter.textContent = "→ окно " + s.counter;
+			el.appendChild(ticket);
+			el.appendChild(counter);
+			serving.appendChild(el);
+		});
+
+		upcoming.innerHTML = "";
+		state.upcoming.forEach(function (t) {
+			var el = document.createElement("div");
+			el.textContent = t;
+			upcoming.appendChild(el);
+		});
+	}
+
+	var source = new EventSource("/board/events");
+	source.onmessage = function (e) {
+		offline.style.display = "none";
+		render(JSON.parse(e.data));
+	};
+	source.onerror = function () {
+		offline.style.display = "block";
+	};
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHubPublish(t *testing.T) {
+	hub := NewEventHub()
+	first := hub.Subscribe()
+	second := hub.Subscribe()
+	slow := hub.Subscribe()
+
+	// A subscriber that never reads fills up, the others still get every event
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			hub.Publish(QueueEvent{Type: QueueEventIssued, Ticket: "A-001"})
+			<-first
+			<-second
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a subscriber that doesn't read")
+	}
+	if len(slow) != cap(slow) {
+		t.Fatalf("slow subscriber holds %d events, want its buffer of %d full", len(slow), cap(slow))
+	}
+}
+
+func TestEventHubUnsubscribe(t *testing.T) {
+	hub := NewEventHub()
+	events := hub.Subscribe()
+
+	hub.Unsubscribe(events)
+	if _, ok := <-events; ok {
+		t.Fatal("got an event, want the channel closed")
+	}
+
+	// Publishing and unsubscribing again after that is harmless
+	hub.Publish(QueueEvent{Type: QueueEventIssued, Ticket: "A-001"})
+	hub.Unsubscribe(events)
+}
+
+func TestGetBoardState(t *testing.T) {
+	db := newTestDB(t)
+	addWaitingTickets(t, db, 5)
+
+	// The third and the first tickets are called to counters 2 and 1
+	now := time.Now()
+	for number, counter := range map[int]int{3: 2, 1: 1} {
+		if _, err := db.Exec("UPDATE tickets SET status = ?, called_at = ?, counter = ? WHERE number = ?", TicketStatusCalled, now, counter, number); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := newTestConfig()
+	config.BoardUpcoming = 2
+	state, err := GetBoardState(db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantServing := []BoardServing{{Counter: 1, Ticket: "A-001"}, {Counter: 2, Ticket: "A-003"}}
+	if !reflect.DeepEqual(state.Serving, wantServing) {
+		t.Fatalf("got serving %+v, want %+v", state.Serving, wantServing)
+	}
+	if want := []string{"A-002", "A-004"}; !reflect.DeepEqual(state.Upcoming, want) {
+		t.Fatalf("got upcoming %v, want the first %v", state.Upcoming, want)
+	}
+}
+
+func TestBoardEventsInitialState(t *testing.T) {
+	config := newTestConfig()
+	config.BoardUpcoming = 5
+	app := newTestApp(t, config)
+	addWaitingTickets(t, app.db, 1)
+
+	// The client is already gone: the handler sends the state once and returns
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/board/events", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	app.handleBoardEvents(rec, req)
+
+	if got := rec.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("got Content-Type %q, want text/event-stream", got)
+	}
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "data: ") || !strings.HasSuffix(body, "\n\n") {
+		t.Fatalf("got %q, want one SSE data frame", body)
+	}
+	var state BoardState
+	if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(body, "data: "))), &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Upcoming) != 1 || state.Event != nil {
+		t.Fatalf("got %+v, want the waiting ticket without an event", state)
+	}
+
+	// The stream unsubscribed on the way out
+	if len(app.events.subscribers) != 0 {
+		t.Fatalf("%d subscribers left after the client went away", len(app.events.subscribers))
+	}
+}
+
+func TestBoardEventsStreamsQueueEvents(t *testing.T) {
+	config := newTestConfig()
+	config.BoardUpcoming = 5
+	app := newTestApp(t, config)
+	server := httptest.NewServer(http.HandlerFunc(app.handleBoardEvents))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	frames := bufio.NewReader(resp.Body)
+
+	readState := func() BoardState {
+		t.Helper()
+		line, err := frames.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blank, err := frames.ReadString('\n'); err != nil || blank != "\n" {
+			t.Fatalf("frame %q not terminated by a blank line: %v", line, err)
+		}
+		var state BoardState
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "data: ")), &state); err != nil {
+			t.Fatalf("decoding %q: %v", line, err)
+		}
+		return state
+	}
+
+	if state := readState(); state.Event != nil {
+		t.Fatalf("got event %+v on connect, want the state only", state.Event)
+	}
+
+	addWaitingTickets(t, app.db, 1)
+	app.events.Publish(QueueEvent{Type: QueueEventIssued, Ticket: "A-001"})
+
+	state := readState()
+	if state.Event == nil || state.Event.Type != QueueEventIssued || !reflect.DeepEqual(state.Upcoming, []string{"A-001"}) {
+		t.Fatalf("got %+v, want the issued event with the new state", state)
+	}
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Broadcast audience segments
+const (
+	SegmentAll      = "all"      // Every registered user
+	SegmentDate     = "date"     // Users booked on a date, arg: ДД.ММ.ГГГГ
+	SegmentService  = "service"  // Users who booked or were served for a service, arg: service name
+	SegmentInactive = "inactive" // Users without bookings or visits for N months, arg: months
+)
+
+// Broadcast statuses
+const (
+	BroadcastDraft     = "draft"
+	BroadcastSending   = "sending"
+	BroadcastDone      = "done"
+	BroadcastCancelled = "cancelled"
+)
+
+// Recipient statuses
+const (
+	RecipientPending = "pending"
+	RecipientSent    = "sent"
+	RecipientFailed  = "failed"
+)
+
+// Broadcast sending settings
+const (
+	broadcastInterval      = 40 * time.Millisecond // About 25 messages per second, leaving room for replies to other users
+	broadcastBatch         = 25                    // Recipients loaded at once, the stop button is checked between batches
+	broadcastProgressEvery = 5 * time.Second
+	broadcastQuietWait     = time.Minute // Pause while the remaining recipients are in their quiet hours
+	maxBroadcastRetries    = 3           // Retries of a message after Telegram asks to slow down
+)
+
+// broadcastMu lets one broadcast send at a time, so together they stay under the rate limit
+var broadcastMu sync.Mutex
+
+// promoPrefix marks a segment of news and promotions, sent only to users who agreed to get them
+const promoPrefix = "promo"
+
+// Segment selects the recipients of a broadcast
+type Segment struct {
+	Kind  string
+	Arg   string
+	Promo bool // Only users who agreed to get news and promotions
+}
+
+// Broadcast is a message to a segment of users, sent after the admin confirms the preview
+type Broadcast struct {
+	ID        int64
+	AdminID   int64
+	ChatID    int64 // Chat of the preview, which then shows the progress
+	MessageID int
+	Segment   Segment
+	Text      string
+	Status    string
+	Total     int
+}
+
+// BroadcastProgress counts the recipients by delivery status
+type BroadcastProgress struct {
+	Sent    int
+	Failed  int
+	Pending int
+}
+
+// splitSegment splits a segment into its kind and argument without checking them
+func splitSegment(value string) Segment {
+	var segment Segment
+	kind, arg, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if strings.EqualFold(kind, promoPrefix) {
+		segment.Promo = true
+		kind, arg, _ = strings.Cut(strings.TrimSpace(arg), " ")
+	}
+	segment.Kind, segment.Arg = strings.ToLower(kind), strings.TrimSpace(arg)
+	return segment
+}
+
+// ParseSegment parses a segment like "all", "date 25.10.2026", "service Консультация" or "inactive 6",
+// optionally prefixed with "promo"
+func ParseSegment(value string, config *Config) (Segment, error) {
+	segment := splitSegment(value)
+
+	switch segment.Kind {
+	case SegmentAll:
+		if segment.Arg != "" {
+			return segment, fmt.Errorf("segment %s takes no argument", SegmentAll)
+		}
+	case SegmentDate:
+		if _, err := time.ParseInLocation("02.01.2006", segment.Arg, time.Local); err != nil {
+			return segment, fmt.Errorf("invalid date %q", segment.Arg)
+		}
+	case SegmentService:
+		found := false
+		for _, service := range config.Services {
+			if strings.EqualFold(service, segment.Arg) {
+				segment.Arg = service
+				found = true
+			}
+		}
+		if !found {
+			return segment, fmt.Errorf("unknown service %q", segment.Arg)
+		}
+	case SegmentInactive:
+		months, err := strconv.Atoi(segment.Arg)
+		if err != nil || months <= 0 {
+			return segment, fmt.Errorf("invalid number of months %q", segment.Arg)
+		}
+	default:
+		return segment, fmt.Errorf("unknown segment %q", segment.Kind)
+	}
+
+	return segment, nil
+}
+
+// String formats the segment the way ParseSegment reads it
+func (s Segment) String() string {
+	value := s.Kind
+	if s.Arg != "" {
+		value += " " + s.Arg
+	}
+	if s.Promo {
+		value = promoPrefix + " " + value
+	}
+	return value
+}
+
+// segmentDescription describes the audience for the admin
+func segmentDescription(segment Segment) string {
+	var description string
+	switch segment.Kind {
+	case SegmentDate:
+		description = "записанные на " + segment.Arg
+	case SegmentService:
+		description = "записанные на услугу «" + html.EscapeString(segment.Arg) + "» или получавшие её"
+	case SegmentInactive:
+		description = fmt.Sprintf("без записей и визитов %s мес.", segment.Arg)
+	default:
+		description = "все пользователи"
+	}
+	if segment.Promo {
+		description += ", согласные на новости и акции"
+	}
+	return description
+}
+
+// segmentQuery builds the query selecting the Telegram IDs of the segment's users
+func segmentQuery(segment Segment, now time.Time) (string, []interface{}, error) {
+	query := "SELECT telegram_id FROM users WHERE is_active = 1"
+	if segment.Promo {
+		query += " AND telegram_id IN (SELECT telegram_id FROM user_settings WHERE marketing = 1)"
+	}
+
+	switch segment.Kind {
+	case SegmentAll:
+		return query, nil, nil
+	case SegmentDate:
+		date, err := time.ParseInLocation("02.01.2006", segment.Arg, time.Local)
+		if err != nil {
+			return "", nil, err
+		}
+		query += ` AND telegram_id IN (
+			SELECT user_id FROM slots
+			WHERE user_id IS NOT NULL AND COALESCE(status, 'booked') IN (?, ?) AND start_time >= ? AND start_time < ?
+		)`
+		return query, []interface{}{SlotStatusBooked, SlotStatusArrived, date, date.AddDate(0, 0, 1)}, nil
+	case SegmentService:
+		// A visitor who went through a route has the service of each finished stage in ticket_stages
+		query += ` AND telegram_id IN (
+			SELECT user_id FROM slots WHERE user_id IS NOT NULL AND service = ?
+			UNION
+			SELECT user_id FROM tickets WHERE user_id IS NOT NULL AND service = ?
+			UNION
+			SELECT tickets.user_id FROM ticket_stages JOIN tickets ON tickets.id = ticket_stages.ticket_id
+			WHERE tickets.user_id IS NOT NULL AND ticket_stages.service = ?
+		)`
+		return query, []interface{}{segment.Arg, segment.Arg, segment.Arg}, nil
+	case SegmentInactive:
+		months, err := strconv.Atoi(segment.Arg)
+		if err != nil {
+			return "", nil, err
+		}
+		since := now.AddDate(0, -months, 0)
+		// created_at is filled by SQLite in UTC text
+		query += ` AND created_at < ?
+			AND NOT EXISTS (SELECT 1 FROM slots WHERE slots.user_id = users.telegram_id AND slots.start_time >= ?)
+			AND NOT EXISTS (SELECT 1 FROM tickets WHERE tickets.user_id = users.telegram_id AND tickets.issued_at >= ?)`
+		return query, []interface{}{since.UTC().Format("2006-01-02 15:04:05"), since, since}, nil
+	default:
+		return "", nil, fmt.Errorf("unknown segment %q", segment.Kind)
+	}
+}
+
+// SegmentRecipients returns the Telegram IDs of the segment's users
+func SegmentRecipients(db *sql.DB, segment Segment, now time.Time) ([]int64, error) {
+	query, args, err := segmentQuery(segment, now)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(query+" ORDER BY telegram_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+
+	return users, rows.Err()
+}
+
+// CreateBroadcast stores a draft waiting for the admin's confirmation
+func CreateBroadcast(db *sql.DB, b *Broadcast) error {
+	result, err := db.Exec(
+		"INSERT INTO broadcasts (admin_id, chat_id, message_id, segment, text, status, total, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		b.AdminID, b.ChatID, b.MessageID, b.Segment.String(), b.Text, BroadcastDraft, b.Total, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	b.ID, err = result.LastInsertId()
+	b.Status = BroadcastDraft
+	return err
+}
+
+// SetBroadcastMessage records the preview message that shows the progress
+func SetBroadcastMessage(db *sql.DB, broadcastID int64, messageID int) error {
+	_, err := db.Exec("UPDATE broadcasts SET message_id = ? WHERE id = ?", messageID, broadcastID)
+	return err
+}
+
+// GetBroadcast returns a broadcast by its ID, nil if not found
+func GetBroadcast(db *sql.DB, broadcastID int64) (*Broadcast, error) {
+	query := `
+		SELECT id, admin_id, chat_id, message_id, segment, text, status, total
+		FROM broadcasts
+		WHERE id = ?
+	`
+
+	var b Broadcast
+	var segment string
+	err := db.QueryRow(query, broadcastID).Scan(&b.ID, &b.AdminID, &b.ChatID, &b.MessageID, &segment, &b.Text, &b.Status, &b.Total)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b.Segment = splitSegment(segment)
+	return &b, nil
+}
+
+// StartBroadcast fixes the recipients of a draft and marks it as sending.
+// Returns false if the broadcast is no longer a draft.
+func StartBroadcast(db *sql.DB, broadcastID int64) (bool, error) {
+	b, err := GetBroadcast(db, broadcastID)
+	if err != nil || b == nil || b.Status != BroadcastDraft {
+		return false, err
+	}
+
+	users, err := SegmentRecipients(db, b.Segment, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE broadcasts SET status = ?, total = ?, started_at = ? WHERE id = ? AND status = ?",
+		BroadcastSending, len(users), time.Now(), broadcastID, BroadcastDraft)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	for _, userID := range users {
+		if _, err := tx.Exec("INSERT INTO broadcast_recipients (broadcast_id, user_id, status) VALUES (?, ?, ?)",
+			broadcastID, userID, RecipientPending); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// CancelBroadcast discards a draft or stops a broadcast that is being sent.
+// Returns false if it had already finished.
+func CancelBroadcast(db *sql.DB, broadcastID int64) (bool, error) {
+	result, err := db.Exec("UPDATE broadcasts SET status = ?, finished_at = ? WHERE id = ? AND status IN (?, ?)",
+		BroadcastCancelled, time.Now(), broadcastID, BroadcastDraft, BroadcastSending)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// finishBroadcast marks a broadcast done once every recipient was tried
+func finishBroadcast(db *sql.DB, broadcastID int64) error {
+	_, err := db.Exec("UPDATE broadcasts SET status = ?, finished_at = ? WHERE id = ? AND status = ?",
+		BroadcastDone, time.Now(), broadcastID, BroadcastSending)
+	return err
+}
+
+// GetSendingBroadcasts returns the broadcasts interrupted by a restart
+func GetSendingBroadcasts(db *sql.DB) ([]int64, error) {
+	rows, err := db.Query("SELECT id FROM broadcasts WHERE status = ? ORDER BY id", BroadcastSending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// pendingRecipients returns the next recipients still waiting for the message,
+// leaving out those in their quiet hours
+func pendingRecipients(db *sql.DB, broadcastID int64, limit int, now time.Time) ([]int64, error) {
+	query := `
+		SELECT user_id FROM broadcast_recipients r
+		WHERE broadcast_id = ? AND status = ?
+			AND NOT EXISTS (
+				SELECT 1 FROM user_settings us
+				WHERE us.telegram_id = r.user_id AND us.quiet_start IS NOT NULL AND us.quiet_end IS NOT NULL
+					AND CASE WHEN us.quiet_start < us.quiet_end
+						THEN ? >= us.quiet_start AND ? < us.quiet_end
+						ELSE ? >= us.quiet_start OR ? < us.quiet_end END
+			)
+		ORDER BY user_id
+		LIMIT ?
+	`
+
+	minute := minuteOfDay(now)
+	rows, err := db.Query(query, broadcastID, RecipientPending, minute, minute, minute, minute, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+
+	return users, rows.Err()
+}
+
+// markRecipient records the delivery result for one recipient
+func markRecipient(db *sql.DB, broadcastID int64, userID int64, sendErr error) error {
+	if sendErr != nil {
+		_, err := db.Exec("UPDATE broadcast_recipients SET status = ?, error = ? WHERE broadcast_id = ? AND user_id = ?",
+			RecipientFailed, sendErr.Error(), broadcastID, userID)
+		return err
+	}
+
+	_, err := db.Exec("UPDATE broadcast_recipients SET status = ?, sent_at = ? WHERE broadcast_id = ? AND user_id = ?",
+		RecipientSent, time.Now(), broadcastID, userID)
+	return err
+}
+
+// GetBroadcastProgress counts the recipients of a broadcast by delivery status
+func GetBroadcastProgress(db *sql.DB, broadcastID int64) (BroadcastProgress, error) {
+	var progress BroadcastProgress
+	rows, err := db.Query("SELECT status, COUNT(*) FROM broadcast_recipients WHERE broadcast_id = ? GROUP BY status", broadcastID)
+	if err != nil {
+		return progress, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return progress, err
+		}
+		switch status {
+		case RecipientSent:
+			progress.Sent = count
+		case RecipientFailed:
+			progress.Failed = count
+		case RecipientPending:
+			progress.Pending = count
+		}
+	}
+
+	return progress, rows.Err()
+}
+
+// resumeBroadcasts continues sending the broadcasts interrupted by a restart
+func (app *App) resumeBroadcasts() {
+	ids, err := GetSendingBroadcasts(app.db)
+	if err != nil {
+		log.Printf("Warning: failed to resume broadcasts: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		log.Printf("Resuming broadcast %d", id)
+		go app.runBroadcast(id)
+	}
+}
+
+// runBroadcast sends the broadcast to its pending recipients, reporting progress
+// on the admin's preview message until it is done or stopped
+func (app *App) runBroadcast(broadcastID int64) {
+	broadcastMu.Lock()
+	defer broadcastMu.Unlock()
+
+	lastReport := time.Now()
+	for {
+		b, err := GetBroadcast(app.db, broadcastID)
+		if err != nil || b == nil {
+			log.Printf("Error getting broadcast %d: %v", broadcastID, err)
+			return
+		}
+		if b.Status != BroadcastSending {
+			app.reportBroadcast(b)
+			return
+		}
+
+		users, err := pendingRecipients(app.db, broadcastID, broadcastBatch, time.Now())
+		if err != nil {
+			log.Printf("Error getting broadcast %d recipients: %v", broadcastID, err)
+			return
+		}
+
+		if len(users) == 0 {
+			progress, err := GetBroadcastProgress(app.db, broadcastID)
+			if err != nil {
+				log.Printf("Error getting broadcast %d progress: %v", broadcastID, err)
+				return
+			}
+			if progress.Pending > 0 {
+				// Everyone left is in their quiet hours
+				if time.Since(lastReport) >= broadcastProgressEvery {
+					app.reportBroadcast(b)
+					lastReport = time.Now()
+				}
+				// Other broadcasts may send meanwhile, the wait doesn't count against the rate limit
+				broadcastMu.Unlock()
+				time.Sleep(broadcastQuietWait)
+				broadcastMu.Lock()
+				continue
+			}
+
+			if err := finishBroadcast(app.db, broadcastID); err != nil {
+				log.Printf("Error finishing broadcast %d: %v", broadcastID, err)
+			}
+			b.Status = BroadcastDone
+			log.Printf("Broadcast %d finished", broadcastID)
+			app.reportBroadcast(b)
+			return
+		}
+
+		for _, userID := range users {
+			sendErr := app.sendBroadcastMessage(userID, b.Text)
+			if sendErr != nil {
+				log.Printf("Error sending broadcast %d to user %d: %v", broadcastID, userID, sendErr)
+			}
+			if err := markRecipient(app.db, broadcastID, userID, sendErr); err != nil {
+				log.Printf("Error recording broadcast %d delivery: %v", broadcastID, err)
+				return
+			}
+			time.Sleep(broadcastInterval)
+		}
+
+		if time.Since(lastReport) >= broadcastProgressEvery {
+			app.reportBroadcast(b)
+			lastReport = time.Now()
+		}
+	}
+}
+
+// sendBroadcastMessage sends the message directly rather than through the outbox, the recipients
+// table already tracks delivery. The send limiter waits as long as Telegram asks when sending too fast.
+func (app *App) sendBroadcastMessage(userID int64, text string) error {
+	item := &OutboxItem{ChatID: userID, Kind: OutboxMessage, Text: text, ParseMode: "HTML"}
+	for attempt := 0; ; attempt++ {
+		_, err := app.deliver(item)
+		if wait := retryAfter(err); wait > 0 && attempt < maxBroadcastRetries {
+			log.Printf("Broadcast throttled by Telegram, waiting %v", wait)
+			continue
+		}
+		return err
+	}
+}
+
+// reportBroadcast shows the broadcast's progress on the admin's preview message
+func (app *App) reportBroadcast(b *Broadcast) {
+	if b.MessageID == 0 {
+		return
+	}
+
+	progress, err := GetBroadcastProgress(app.db, b.ID)
+	if err != nil {
+		log.Printf("Error getting broadcast %d progress: %v", b.ID, err)
+		return
+	}
+
+	status := "⏳ Отправляется"
+	switch b.Status {
+	case BroadcastDone:
+		status = "✅ Завершена"
+	case BroadcastCancelled:
+		status = "⏹ Остановлена"
+	}
+
+	text := fmt.Sprintf(`📣 Рассылка: %s
+%s
+
+Отправлено: %d из %d
+Не доставлено: %d`, segmentDescription(b.Segment), status, progress.Sent, b.Total, progress.Failed)
+	if b.Status == BroadcastSending && progress.Pending > 0 {
+		text += fmt.Sprintf("\nОсталось: %d (получатели в тихие часы ждут их окончания)", progress.Pending)
+	}
+
+	keyboard := tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}
+	if b.Status == BroadcastSending {
+		keyboard = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⏹ Остановить", app.callbacks.Encode(cbBroadcastStop, strconv.FormatInt(b.ID, 10))),
+		))
+	}
+	app.editMessage(b.ChatID, b.MessageID, text, "HTML", keyboard)
+}
+
+// Handlers
+
+func handleBroadcast(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+
+	if !IsAdmin(app.config, update.Message.From.ID) {
+		return app.sendMessage(chatID, "У вас нет прав администратора")
+	}
+
+	usage := `📣 Рассылка пользователям:
+
+/broadcast СЕГМЕНТ
+Текст сообщения (со следующей строки)
+
+Сегменты:
+all - все пользователи
+date ДД.ММ.ГГГГ - записанные на дату
+service УСЛУГА - записанные на услугу или получавшие её
+inactive N - без записей и визитов N месяцев
+
+Для новостей и акций добавьте promo перед сегментом, например /broadcast promo all: сообщение получат только согласившиеся на них в /settings. Получателям в тихие часы сообщение придёт после их окончания.
+
+Перед отправкой бот покажет, как выглядит сообщение и сколько у него получателей.`
+
+	segmentStr, text, _ := strings.Cut(update.Message.CommandArguments(), "\n")
+	text = strings.TrimSpace(text)
+	if strings.TrimSpace(segmentStr) == "" || text == "" {
+		return app.sendMessage(chatID, usage)
+	}
+
+	segment, err := ParseSegment(segmentStr, app.config)
+	if err != nil {
+		return app.sendMessage(chatID, fmt.Sprintf("❌ Неверный сегмент: %s\n\n%s", html.EscapeString(err.Error()), usage))
+	}
+
+	users, err := SegmentRecipients(app.db, segment, time.Now())
+	if err != nil {
+		log.Printf("Error getting broadcast recipients: %v", err)
+		return app.sendMessage(chatID, "Ошибка при подборе получателей")
+	}
+	if len(users) == 0 {
+		return app.sendMessage(chatID, "В этом сегменте нет получателей")
+	}
+
+	b := &Broadcast{
+		AdminID: update.Message.From.ID,
+		ChatID:  chatID,
+		Segment: segment,
+		Text:    html.EscapeString(text),
+		Total:   len(users),
+	}
+	if err := CreateBroadcast(app.db, b); err != nil {
+		log.Printf("Error creating broadcast: %v", err)
+		return app.sendMessage(chatID, "Ошибка при создании рассылки")
+	}
+
+	// The message exactly as recipients will see it
+	if err := app.sendMessage(chatID, b.Text); err != nil {
+		return err
+	}
+
+	id := strconv.FormatInt(b.ID, 10)
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("📣 Рассылка: %s\nПолучателей: %d\n\nОтправить сообщение выше?", segmentDescription(segment), len(users)))
+	msg.ParseMode = "HTML"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("✅ Отправить", app.callbacks.Encode(cbBroadcastSend, id)),
+		tgbotapi.NewInlineKeyboardButtonData("✖️ Отмена", app.callbacks.Encode(cbBroadcastStop, id)),
+	))
+
+	return app.queueMessage(msg)
+}
+
+// handleBroadcastCallback starts a confirmed broadcast or stops it
+func (app *App) handleBroadcastCallback(callback *tgbotapi.CallbackQuery, action string, broadcastID int64) error {
+	chatID := callback.Message.Chat.ID
+
+	if !IsAdmin(app.config, callback.From.ID) {
+		return app.sendMessage(chatID, "У вас нет прав администратора")
+	}
+
+	// The preview went out through the outbox, its ID is known once the admin presses a button on it
+	if err := SetBroadcastMessage(app.db, broadcastID, callback.Message.MessageID); err != nil {
+		log.Printf("Error recording broadcast %d message: %v", broadcastID, err)
+		return app.sendMessage(chatID, "Ошибка при запуске рассылки")
+	}
+
+	if action == cbBroadcastSend {
+		started, err := StartBroadcast(app.db, broadcastID)
+		if err != nil {
+			log.Printf("Error starting broadcast %d: %v", broadcastID, err)
+			return app.sendMessage(chatID, "Ошибка при запуске рассылки")
+		}
+		if !started {
+			return app.sendMessage(chatID, "Рассылка уже запущена или отменена")
+		}
+		log.Printf("Admin %d started broadcast %d", callback.From.ID, broadcastID)
+		go app.runBroadcast(broadcastID)
+	} else {
+		cancelled, err := CancelBroadcast(app.db, broadcastID)
+		if err != nil {
+			log.Printf("Error cancelling broadcast %d: %v", broadcastID, err)
+			return app.sendMessage(chatID, "Ошибка при отмене рассылки")
+		}
+		if !cancelled {
+			return app.sendMessage(chatID, "Рассылка уже завершена")
+		}
+		log.Printf("Admin %d stopped broadcast %d", callback.From.ID, broadcastID)
+	}
+
+	b, err := GetBroadcast(app.db, broadcastID)
+	if err != nil || b == nil {
+		return err
+	}
+	app.reportBroadcast(b)
+	return nil
+}
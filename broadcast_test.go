@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSegment(t *testing.T) {
+	config := &Config{Services: []string{"Консультация", "Справка"}}
+
+	tests := []struct {
+		value   string
+		want    Segment
+		wantErr bool
+	}{
+		{"all", Segment{Kind: SegmentAll}, false},
+		{" ALL ", Segment{Kind: SegmentAll}, false},
+		{"all users", Segment{}, true},
+		{"date 25.10.2026", Segment{Kind: SegmentDate, Arg: "25.10.2026"}, false},
+		{"date 2026-10-25", Segment{}, true},
+		{"service консультация", Segment{Kind: SegmentService, Arg: "Консультация"}, false},
+		{"service Массаж", Segment{}, true},
+		{"inactive 6", Segment{Kind: SegmentInactive, Arg: "6"}, false},
+		{"inactive 0", Segment{}, true},
+		{"inactive six", Segment{}, true},
+		{"vip", Segment{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseSegment(tt.value, config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// addServiceTicket records a served ticket of the user tagged with the service
+func addServiceTicket(t *testing.T, db *sql.DB, userID int64, number int, service string) int64 {
+	t.Helper()
+	now := time.Now()
+	result, err := db.Exec(`
+		INSERT INTO tickets (queue_date, prefix, number, user_id, status, issued_at, service)
+		VALUES (?, 'A', ?, ?, ?, ?, ?)
+	`, now.Format(queueDateLayout), number, userID, TicketStatusServed, now, service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return id
+}
+
+func TestSegmentRecipients(t *testing.T) {
+	// SQLite fills created_at in UTC, the comparison must not depend on the local zone
+	local := time.Local
+	time.Local = time.FixedZone("UTC+3", 3*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	db := newTestDB(t)
+	now := time.Now()
+	addTestUsers(t, db, 1, 2, 3, 4, 5, 6, 7, 8)
+	if _, err := db.Exec("UPDATE users SET is_active = 0 WHERE telegram_id = 7"); err != nil {
+		t.Fatal(err)
+	}
+
+	// User 1 is booked on the date, user 3 on the next day
+	day := testSlotTime(10, 0)
+	addLegacyBooking(t, db, day, 1)
+	addLegacyBooking(t, db, day.Add(time.Hour), 3)
+	if _, err := db.Exec("UPDATE slots SET start_time = ? WHERE user_id = 3", day.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// User 3 booked a service, user 4 was served directly, user 5 at the first stage of a route
+	if _, err := db.Exec("UPDATE slots SET service = 'Справка' WHERE user_id = 3"); err != nil {
+		t.Fatal(err)
+	}
+	addServiceTicket(t, db, 4, 1, "Консультация")
+	routed := addServiceTicket(t, db, 5, 2, "Справка")
+	if _, err := db.Exec("INSERT INTO ticket_stages (ticket_id, stage, service, started_at, finished_at) VALUES (?, 0, 'Консультация', ?, ?)",
+		routed, now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users 2 and 6 registered long ago, and only user 6 came back recently. The others
+	// registered an hour after the inactivity cutoff: user 8 hasn't booked yet, but is new,
+	// which a comparison with the cutoff in local time would miss.
+	since := now.AddDate(0, -6, 0)
+	utc := func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05") }
+	if _, err := db.Exec("UPDATE users SET created_at = ?", utc(since.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE users SET created_at = ? WHERE telegram_id IN (2, 6)", utc(since.Add(-24*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	addServiceTicket(t, db, 6, 3, "")
+
+	tests := []struct {
+		segment Segment
+		want    []int64
+	}{
+		{Segment{Kind: SegmentAll}, []int64{1, 2, 3, 4, 5, 6, 8}},
+		{Segment{Kind: SegmentDate, Arg: day.Format("02.01.2006")}, []int64{1}},
+		{Segment{Kind: SegmentService, Arg: "Консультация"}, []int64{4, 5}},
+		{Segment{Kind: SegmentService, Arg: "Справка"}, []int64{3, 5}},
+		{Segment{Kind: SegmentInactive, Arg: "6"}, []int64{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.segment.String(), func(t *testing.T) {
+			got, err := SegmentRecipients(db, tt.segment, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got recipients %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestBroadcast creates a draft to all users
+func newTestBroadcast(t *testing.T, db *sql.DB) *Broadcast {
+	t.Helper()
+	b := &Broadcast{AdminID: 100, ChatID: 100, MessageID: 1, Segment: Segment{Kind: SegmentAll}, Text: "Новости"}
+	if err := CreateBroadcast(db, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// broadcastStatus returns the stored status of the broadcast
+func broadcastStatus(t *testing.T, db *sql.DB, broadcastID int64) string {
+	t.Helper()
+	b, err := GetBroadcast(db, broadcastID)
+	if err != nil || b == nil {
+		t.Fatalf("getting broadcast %d: %v, %v", broadcastID, b, err)
+	}
+	return b.Status
+}
+
+func TestStartBroadcastOnce(t *testing.T) {
+	db := newTestDB(t)
+	addTestUsers(t, db, 1, 2, 3)
+	b := newTestBroadcast(t, db)
+
+	for i, want := range []bool{true, false} {
+		started, err := StartBroadcast(db, b.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if started != want {
+			t.Fatalf("start %d: got %v, want %v", i+1, started, want)
+		}
+	}
+
+	progress, err := GetBroadcastProgress(db, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress != (BroadcastProgress{Pending: 3}) {
+		t.Fatalf("got progress %+v, want each user pending once", progress)
+	}
+	if stored, _ := GetBroadcast(db, b.ID); stored.Status != BroadcastSending || stored.Total != 3 {
+		t.Fatalf("got status %s with %d recipients, want sending to 3", stored.Status, stored.Total)
+	}
+}
+
+func TestCancelBroadcast(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		want   bool
+	}{
+		{"draft", BroadcastDraft, true},
+		{"sending", BroadcastSending, true},
+		{"done", BroadcastDone, false},
+		{"cancelled", BroadcastCancelled, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			b := newTestBroadcast(t, db)
+			if _, err := db.Exec("UPDATE broadcasts SET status = ? WHERE id = ?", tt.status, b.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			cancelled, err := CancelBroadcast(db, b.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cancelled != tt.want {
+				t.Fatalf("got cancelled %v, want %v", cancelled, tt.want)
+			}
+
+			want := tt.status
+			if tt.want {
+				want = BroadcastCancelled
+			}
+			if status := broadcastStatus(t, db, b.ID); status != want {
+				t.Fatalf("got status %s, want %s", status, want)
+			}
+		})
+	}
+}
+
+func TestGetBroadcastProgress(t *testing.T) {
+	db := newTestDB(t)
+	addTestUsers(t, db, 1, 2, 3, 4, 5, 6)
+	b := newTestBroadcast(t, db)
+	if _, err := StartBroadcast(db, b.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	results := map[int64]error{1: nil, 2: nil, 3: nil, 4: errors.New("Forbidden: bot was blocked by the user")}
+	for userID, sendErr := range results {
+		if err := markRecipient(db, b.ID, userID, sendErr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	progress, err := GetBroadcastProgress(db, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress != (BroadcastProgress{Sent: 3, Failed: 1, Pending: 2}) {
+		t.Fatalf("got progress %+v, want 3 sent, 1 failed, 2 pending", progress)
+	}
+}
+
+func TestRunBroadcastFinishes(t *testing.T) {
+	app, sent := newRecordingApp(t, &Config{})
+	addTestUsers(t, app.db, 1, 2, 3)
+	b := newTestBroadcast(t, app.db)
+	if _, err := StartBroadcast(app.db, b.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	app.runBroadcast(b.ID)
+
+	if status := broadcastStatus(t, app.db, b.ID); status != BroadcastDone {
+		t.Fatalf("got status %s, want %s", status, BroadcastDone)
+	}
+	for _, userID := range []int64{1, 2, 3} {
+		if got := sent.messages(userID); !reflect.DeepEqual(got, []string{b.Text}) {
+			t.Fatalf("user %d got %q, want the broadcast once", userID, got)
+		}
+	}
+	if progress, _ := GetBroadcastProgress(app.db, b.ID); progress != (BroadcastProgress{Sent: 3}) {
+		t.Fatalf("got progress %+v, want all 3 sent", progress)
+	}
+}
+
+func TestRunBroadcastStopsBetweenBatches(t *testing.T) {
+	app, sent := newRecordingApp(t, &Config{})
+	var users []int64
+	for id := int64(1); id <= broadcastBatch+5; id++ {
+		users = append(users, id)
+	}
+	addTestUsers(t, app.db, users...)
+	b := newTestBroadcast(t, app.db)
+	if _, err := StartBroadcast(app.db, b.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The admin presses stop while the first batch is being sent
+	sent.onCall = func(call telegramCall) {
+		if call.Method == "sendMessage" && call.Params.Get("chat_id") == "3" {
+			if _, err := CancelBroadcast(app.db, b.ID); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	app.runBroadcast(b.ID)
+
+	if status := broadcastStatus(t, app.db, b.ID); status != BroadcastCancelled {
+		t.Fatalf("got status %s, want %s", status, BroadcastCancelled)
+	}
+	progress, err := GetBroadcastProgress(app.db, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress != (BroadcastProgress{Sent: broadcastBatch, Pending: 5}) {
+		t.Fatalf("got progress %+v, want the first batch finished and the rest left", progress)
+	}
+}
+
+func TestPendingRecipientsSkipQuietHours(t *testing.T) {
+	db := newTestDB(t)
+	b := newTestBroadcast(t, db)
+
+	// 1 has no settings, 2 sleeps over midnight, 3 has daytime quiet hours, 4 has none
+	for userID := int64(1); userID <= 4; userID++ {
+		if _, err := db.Exec("INSERT INTO broadcast_recipients (broadcast_id, user_id, status) VALUES (?, ?, ?)", b.ID, userID, RecipientPending); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for userID, settings := range map[int64]*UserSettings{2: quietSettings(22, 8), 3: quietSettings(13, 15), 4: {}} {
+		settings.UserID = userID
+		if err := SaveUserSettings(db, settings); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		hour int
+		want []int64
+	}{
+		{"late evening", 23, []int64{1, 3, 4}},
+		{"night", 3, []int64{1, 3, 4}},
+		{"end of the night quiet hours", 8, []int64{1, 2, 3, 4}},
+		{"afternoon", 14, []int64{1, 2, 4}},
+		{"end of the daytime quiet hours", 15, []int64{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := pendingRecipients(db, b.ID, broadcastBatch, octoberAt(20, tt.hour, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(users, tt.want) {
+				t.Fatalf("got recipients %v, want %v", users, tt.want)
+			}
+		})
+	}
+}
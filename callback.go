@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+)
+
+// Callback data format: <version>|<action>|<arg>...|<tag>
+// The tag is a truncated HMAC of everything before it, so buttons can't be forged,
+// and the version lets us recognize keyboards sent by older releases.
+const (
+	callbackVersion   = "1"
+	callbackSeparator = "|"
+	callbackTagSize   = 8  // HMAC bytes kept in the tag
+	callbackMaxSize   = 64 // Telegram limit for callback_data
+)
+
+// Callback actions
+const (
+	cbDate   = "d"
+	cbSlot   = "s"
+	cbCancel = "c"
+
+	cbReschedule = "rs"
+	cbConfirm    = "cf"
+	cbWaitlist   = "wl"
+
+	cbAdminCancel = "ac"
+	cbLeaveQueue  = "lq"
+
+	cbOpsConfirm = "oc" // Booking card actions, arg: booking code
+	cbOpsCancel  = "ox"
+	cbOpsNoShow  = "on"
+	cbOpsMessage = "om"
+
+	cbBroadcastSend = "bs" // Arg: broadcast ID
+	cbBroadcastStop = "bx"
+
+	cbSettings = "st" // Arg: settings field
+
+	cbCallNext      = "tn"
+	cbTicketServed  = "ts"
+	cbTicketRecall  = "tr"
+	cbTicketSkip    = "tk"
+	cbTicketStart   = "tb"
+	cbTicketService = "tv" // Args: ticket ID, index in SERVICES
+	cbVisitReason   = "vr" // Args: slot ID, index in SERVICES
+)
+
+// Layouts used for dates and times inside callback data
+const (
+	callbackDateLayout = "20060102"
+	callbackSlotLayout = "200601021504"
+)
+
+// Callback data errors
+var (
+	ErrStaleCallback   = errors.New("callback data from an outdated keyboard")
+	ErrInvalidCallback = errors.New("callback data signature mismatch")
+	ErrCallbackTooLong = errors.New("callback data exceeds 64 bytes")
+)
+
+// CallbackCodec encodes and verifies signed callback data
+type CallbackCodec struct {
+	secret []byte
+}
+
+// NewCallbackCodec creates a codec signing with the given secret
+func NewCallbackCodec(secret string) *CallbackCodec {
+	return &CallbackCodec{secret: []byte(secret)}
+}
+
+// Encode builds signed callback data for an action and its arguments
+func (c *CallbackCodec) Encode(action string, args ...string) string {
+	data, err := c.encode(action, args...)
+	if err != nil {
+		// Telegram rejects the whole keyboard in this case
+		log.Printf("Warning: %v: %s", err, data)
+	}
+	return data
+}
+
+// encode builds signed callback data and reports data Telegram won't accept
+func (c *CallbackCodec) encode(action string, args ...string) (string, error) {
+	payload := strings.Join(append([]string{callbackVersion, action}, args...), callbackSeparator)
+	data := payload + callbackSeparator + c.tag(payload)
+	if len(data) > callbackMaxSize {
+		return data, ErrCallbackTooLong
+	}
+	return data, nil
+}
+
+// Decode verifies callback data and returns its action and arguments
+func (c *CallbackCodec) Decode(data string) (string, []string, error) {
+	parts := strings.Split(data, callbackSeparator)
+	if len(parts) < 3 || parts[0] != callbackVersion {
+		return "", nil, ErrStaleCallback
+	}
+
+	payload := strings.Join(parts[:len(parts)-1], callbackSeparator)
+	if !hmac.Equal([]byte(parts[len(parts)-1]), []byte(c.tag(payload))) {
+		return "", nil, ErrInvalidCallback
+	}
+
+	return parts[1], parts[2 : len(parts)-1], nil
+}
+
+// tag returns the truncated HMAC of the payload
+func (c *CallbackCodec) tag(payload string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:callbackTagSize])
+}
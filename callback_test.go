@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallbackCodecRoundTrip(t *testing.T) {
+	codec := NewCallbackCodec("secret")
+	data := codec.Encode(cbSlot, "202610201030", "7")
+
+	action, args, err := codec.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action != cbSlot || len(args) != 2 || args[0] != "202610201030" || args[1] != "7" {
+		t.Fatalf("Decode(%q) = %q %q, want the encoded action and arguments", data, action, args)
+	}
+}
+
+func TestCallbackCodecRejectsTamperedData(t *testing.T) {
+	codec := NewCallbackCodec("secret")
+	data := codec.Encode(cbCancel, "42")
+	parts := strings.Split(data, callbackSeparator)
+	tag := parts[len(parts)-1]
+
+	// Flip the first character of the tag
+	forgedTag := "A"
+	if tag[0] == 'A' {
+		forgedTag = "B"
+	}
+	forgedTag += tag[1:]
+
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"forged tag", strings.Join([]string{parts[0], parts[1], parts[2], forgedTag}, callbackSeparator), ErrInvalidCallback},
+		{"changed argument", strings.Join([]string{parts[0], parts[1], "43", tag}, callbackSeparator), ErrInvalidCallback},
+		{"missing tag", strings.Join(parts[:len(parts)-1], callbackSeparator), ErrInvalidCallback},
+		{"signed with another secret", NewCallbackCodec("other").Encode(cbCancel, "42"), ErrInvalidCallback},
+		{"older version", strings.Join(append([]string{"0"}, parts[1:]...), callbackSeparator), ErrStaleCallback},
+		{"unversioned legacy data", "cancel_42", ErrStaleCallback},
+		{"empty", "", ErrStaleCallback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := codec.Decode(tt.data); !errors.Is(err, tt.want) {
+				t.Fatalf("Decode(%q) = %v, want %v", tt.data, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallbackCodecRejectsLongData(t *testing.T) {
+	codec := NewCallbackCodec("secret")
+	if _, err := codec.encode(cbCancel, strings.Repeat("9", callbackMaxSize)); !errors.Is(err, ErrCallbackTooLong) {
+		t.Fatalf("encode of oversized data = %v, want %v", err, ErrCallbackTooLong)
+	}
+}
+
+// Every button the bot sends must fit into Telegram's callback_data limit with its longest arguments
+func TestCallbackActionsFitTelegramLimit(t *testing.T) {
+	maxID := strconv.FormatInt(math.MaxInt64, 10)
+	date := time.Now().Format(callbackDateLayout)
+	slot := time.Now().Format(callbackSlotLayout)
+	code := strings.Repeat("K", bookingCodeLength)
+
+	tests := []struct {
+		action string
+		args   []string
+	}{
+		{cbDate, []string{date}},
+		{cbSlot, []string{slot}},
+		{cbCancel, []string{maxID}},
+		{cbAdminCancel, []string{maxID}},
+		{cbLeaveQueue, []string{maxID}},
+		{cbCallNext, []string{maxID}},
+		{cbTicketServed, []string{maxID}},
+		{cbTicketRecall, []string{maxID}},
+		{cbTicketSkip, []string{maxID}},
+		{cbTicketStart, []string{maxID}},
+		{cbTicketService, []string{maxID, "99"}},
+		{cbReschedule, []string{maxID}},
+		{cbConfirm, []string{maxID}},
+		{cbWaitlist, []string{date}},
+		{cbOpsConfirm, []string{code}},
+		{cbOpsCancel, []string{code}},
+		{cbOpsNoShow, []string{code}},
+		{cbOpsMessage, []string{code}},
+		{cbBroadcastSend, []string{maxID}},
+		{cbBroadcastStop, []string{maxID}},
+		{cbVisitReason, []string{maxID, "99"}},
+		{cbSettings, []string{settingMarketing}},
+	}
+	codec := NewCallbackCodec("secret")
+	for _, tt := range tests {
+		if data, err := codec.encode(tt.action, tt.args...); err != nil {
+			t.Errorf("action %q: %v (%d bytes)", tt.action, err, len(data))
+		}
+	}
+}
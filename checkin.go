@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Check-in methods
+const (
+	CheckinByCommand  = "command"  // /checkin without verification
+	CheckinByLocation = "location" // Telegram location within CHECKIN_RADIUS of the venue
+	CheckinByQR       = "qr"       // Deep link from the QR code at reception
+)
+
+// checkinStartPrefix starts the /start payload of the reception QR code deep link
+const checkinStartPrefix = "checkin_"
+
+// checkinTokenSize is the number of HMAC bytes in a reception token
+const checkinTokenSize = 9
+
+// earthRadius is the mean Earth radius in meters
+const earthRadius = 6371000.0
+
+// ErrAlreadyArrived is returned when the visitor has already checked in
+var ErrAlreadyArrived = errors.New("visitor already checked in")
+
+// ParseCheckinMethods parses a comma-separated list of allowed check-in methods
+func ParseCheckinMethods(value string) ([]string, error) {
+	var methods []string
+	for _, method := range strings.Split(value, ",") {
+		method = strings.TrimSpace(method)
+		switch method {
+		case "":
+			continue
+		case CheckinByCommand, CheckinByLocation, CheckinByQR:
+			methods = append(methods, method)
+		default:
+			return nil, fmt.Errorf("unknown check-in method %q", method)
+		}
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no check-in methods")
+	}
+	return methods, nil
+}
+
+// ParseVenueLocation parses "latitude,longitude", an empty value means no venue location
+func ParseVenueLocation(value string) (float64, float64, bool, error) {
+	if value == "" {
+		return 0, 0, false, nil
+	}
+
+	latStr, lonStr, ok := strings.Cut(value, ",")
+	lat, latErr := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	lon, lonErr := strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+	if !ok || latErr != nil || lonErr != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return 0, 0, false, fmt.Errorf("expected <latitude>,<longitude>, got %q", value)
+	}
+	return lat, lon, true, nil
+}
+
+// DistanceMeters returns the great-circle distance between two points
+func DistanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// CheckinToken returns the reception token valid during the period containing t.
+// Tokens rotate every CHECKIN_TOKEN_TTL minutes so a photo of the QR code stops working.
+func CheckinToken(t time.Time, config *Config) string {
+	period := t.Unix() / int64(config.CheckinTokenTTL*60)
+	mac := hmac.New(sha256.New, []byte(config.CallbackSecret))
+	mac.Write([]byte("checkin:" + strconv.FormatInt(period, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:checkinTokenSize])
+}
+
+// ValidCheckinToken accepts the current token and the previous one, so a scan right after rotation still works
+func ValidCheckinToken(token string, now time.Time, config *Config) bool {
+	ttl := time.Duration(config.CheckinTokenTTL) * time.Minute
+	for _, t := range []time.Time{now, now.Add(-ttl)} {
+		if hmac.Equal([]byte(token), []byte(CheckinToken(t, config))) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCheckinMethod checks if the check-in method is enabled
+func hasCheckinMethod(config *Config, method string) bool {
+	for _, m := range config.CheckinMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkSlotArrived records that the visitor of a confirmed booking has arrived
+func MarkSlotArrived(db *sql.DB, slotID int) error {
+	result, err := db.Exec("UPDATE slots SET status = ?, arrived_at = ? WHERE id = ? AND COALESCE(status, 'booked') = ?",
+		SlotStatusArrived, time.Now(), slotID, SlotStatusBooked)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrAlreadyArrived
+	}
+	return nil
+}
+
+// Handlers
+
+func handleCheckin(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+
+	slot, ok := app.checkinSlot(chatID, update.Message.From.ID)
+	if !ok {
+		return nil
+	}
+
+	if hasCheckinMethod(app.config, CheckinByCommand) {
+		return app.checkIn(chatID, slot, update.Message.From)
+	}
+
+	var ways []string
+	if hasCheckinMethod(app.config, CheckinByLocation) {
+		ways = append(ways, "отправьте геопозицию кнопкой ниже")
+	}
+	if hasCheckinMethod(app.config, CheckinByQR) {
+		ways = append(ways, "отсканируйте QR-код на стойке регистрации")
+	}
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("📍 Чтобы отметить приход на %s, %s.", slot.StartTime.Format("15:04"), strings.Join(ways, " или ")))
+	if hasCheckinMethod(app.config, CheckinByLocation) {
+		keyboard := tgbotapi.NewReplyKeyboard(tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButtonLocation("📍 Я на месте")))
+		keyboard.OneTimeKeyboard = true
+		keyboard.ResizeKeyboard = true
+		msg.ReplyMarkup = keyboard
+	}
+
+	return app.queueMessage(msg)
+}
+
+// handleLocation checks in a visitor who shared a location near the venue
+func (app *App) handleLocation(update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+	location := update.Message.Location
+
+	if !hasCheckinMethod(app.config, CheckinByLocation) {
+		return app.sendMessage(chatID, "Привет! Используйте команды из меню или /help для справки.")
+	}
+
+	slot, ok := app.checkinSlot(chatID, update.Message.From.ID)
+	if !ok {
+		return nil
+	}
+
+	distance := DistanceMeters(location.Latitude, location.Longitude, app.config.VenueLatitude, app.config.VenueLongitude)
+	if distance > float64(app.config.CheckinRadius) {
+		log.Printf("User %d checked in %.0f m away from the venue", update.Message.From.ID, distance)
+		return app.sendMessage(chatID, fmt.Sprintf("❌ Вы находитесь в %.0f м от места приёма. Отметиться можно, когда будете рядом.", distance))
+	}
+
+	return app.checkIn(chatID, slot, update.Message.From)
+}
+
+// handleCheckinStart checks in a visitor who scanned the reception QR code
+func (app *App) handleCheckinStart(chatID int64, from *tgbotapi.User, token string) error {
+	if !hasCheckinMethod(app.config, CheckinByQR) || !ValidCheckinToken(token, time.Now(), app.config) {
+		return app.sendMessage(chatID, "❌ QR-код устарел. Отсканируйте код на стойке регистрации ещё раз.")
+	}
+
+	slot, ok := app.checkinSlot(chatID, from.ID)
+	if !ok {
+		return nil
+	}
+
+	return app.checkIn(chatID, slot, from)
+}
+
+// checkinSlot returns today's booking to check in, telling the user when there is none
+func (app *App) checkinSlot(chatID, userID int64) (*Slot, bool) {
+	slot, err := GetUserTodaySlot(app.db, userID)
+	if err != nil {
+		log.Printf("Error getting today's booking: %v", err)
+		app.sendMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+		return nil, false
+	}
+	if slot == nil {
+		app.sendMessage(chatID, "У вас нет записи на сегодня. Записаться: /book, живая очередь: /queue")
+		return nil, false
+	}
+	if slot.Status == SlotStatusArrived {
+		app.sendMessage(chatID, "✅ Вы уже отметились. Ваша позиция в очереди: /position")
+		return nil, false
+	}
+	return slot, true
+}
+
+// checkIn marks the booking arrived, puts the visitor into the queue and tells the operators
+func (app *App) checkIn(chatID int64, slot *Slot, from *tgbotapi.User) error {
+	err := MarkSlotArrived(app.db, slot.ID)
+	if errors.Is(err, ErrAlreadyArrived) {
+		return app.sendMessage(chatID, "✅ Вы уже отметились. Ваша позиция в очереди: /position")
+	}
+	if err != nil {
+		log.Printf("Error marking slot %d arrived: %v", slot.ID, err)
+		return app.sendMessage(chatID, "Не удалось отметить приход. Попробуйте позже.")
+	}
+
+	log.Printf("User %d checked in for slot %d", from.ID, slot.ID)
+	app.syncBookingCard(slot, SlotStatusArrived, "")
+
+	removeKeyboard := tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Вы отметились! Запись на %s, код <b>%s</b>.", slot.StartTime.Format("15:04"), slot.Code))
+	removeKeyboard.ParseMode = "HTML"
+	removeKeyboard.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+	if err := app.queueMessage(removeKeyboard); err != nil {
+		log.Printf("Error sending check-in confirmation: %v", err)
+	}
+
+	operatorNote := fmt.Sprintf("📍 Пришёл посетитель %s: запись на %s, код %s", html.EscapeString(from.FirstName), slot.StartTime.Format("15:04"), slot.Code)
+
+	ticket, err := IssueAppointmentTicket(app.db, slot, app.config)
+	if err != nil && !errors.Is(err, ErrQueueClosed) && !errors.Is(err, ErrAlreadyInQueue) && !errors.Is(err, ErrAlreadyServed) {
+		log.Printf("Error issuing appointment ticket: %v", err)
+	}
+	if err == nil {
+		app.queueChanged(QueueEvent{Type: QueueEventIssued, Ticket: ticket.Label()})
+		operatorNote += fmt.Sprintf(", талон %s", ticket.Label())
+	}
+	app.notifyOperators(operatorNote)
+
+	if ticket != nil {
+		return app.sendTicketStatus(chatID, ticket)
+	}
+	return nil
+}
+
+func handleCheckinLink(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+
+	if !IsAdmin(app.config, update.Message.From.ID) {
+		return app.sendMessage(chatID, "У вас нет прав администратора")
+	}
+	if !hasCheckinMethod(app.config, CheckinByQR) {
+		return app.sendMessage(chatID, "Отметка по QR-коду выключена (CHECKIN_METHODS)")
+	}
+
+	message := fmt.Sprintf("🔗 Ссылка для QR-кода на стойке регистрации (меняется каждые %d мин.):\n\n%s", app.config.CheckinTokenTTL, app.checkinLink(time.Now()))
+	if app.config.KioskToken != "" {
+		message += fmt.Sprintf("\n\n🖥 Чтобы не печатать QR-код заново, откройте на экране у стойки страницу %s/checkin/qr и введите KIOSK_TOKEN - код на ней обновляется сам.", app.config.WebhookURL)
+	} else {
+		message += "\n\nНапечатанный QR-код перестанет работать после смены ссылки. Задайте KIOSK_TOKEN, чтобы показывать всегда актуальный код на экране у стойки."
+	}
+	return app.sendMessage(chatID, message)
+}
+
+// checkinLink returns the deep link of the reception QR code valid at the given time
+func (app *App) checkinLink(t time.Time) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s%s", app.bot.Self.UserName, checkinStartPrefix, CheckinToken(t, app.config))
+}
+
+// checkinPageAllowed checks that the reception QR page is enabled and the kiosk token is given
+func (app *App) checkinPageAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if app.config.KioskToken == "" || !hasCheckinMethod(app.config, CheckinByQR) {
+		http.NotFound(w, r)
+		return false
+	}
+	if !app.kioskAuthorized(r) {
+		if r.URL.Path == "/checkin/qr" {
+			app.kioskLogin(w, r.URL.Path, false)
+		} else {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+		return false
+	}
+	return true
+}
+
+// handleCheckinPage serves the reception screen with the check-in QR code, which reloads
+// itself so the code always carries the current token
+func (app *App) handleCheckinPage(w http.ResponseWriter, r *http.Request) {
+	if !app.checkinPageAllowed(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := checkinPageTemplate.Execute(w, app.config.BoardTitle); err != nil {
+		log.Printf("Error rendering check-in page: %v", err)
+	}
+}
+
+// handleCheckinQR renders the QR code of the current check-in link
+func (app *App) handleCheckinQR(w http.ResponseWriter, r *http.Request) {
+	if !app.checkinPageAllowed(w, r) {
+		return
+	}
+
+	qr, err := EncodeQR([]byte(app.checkinLink(time.Now())))
+	if err != nil {
+		log.Printf("Error encoding check-in QR code: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	picture, err := qr.PNG(qrScale)
+	if err != nil {
+		log.Printf("Error rendering check-in QR code: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(picture)
+}
+
+// checkinPageTemplate shows the check-in QR code and refreshes it every minute
+var checkinPageTemplate = template.Must(template.New("checkin").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}}</title>
+<style>
+	body { margin: 0; height: 100vh; display: flex; flex-direction: column; align-items: center; justify-content: center; font-family: Arial, Helvetica, sans-serif; background: #ffffff; color: #10151f; }
+	h1 { font-size: 5vh; margin: 0 0 4vh; }
+	img { width: 60vmin; height: 60vmin; image-rendering: pixelated; }
+	p { font-size: 3vh; margin-top: 4vh; }
+</style>
+</head>
+<body>
+<h1>{{.}}</h1>
+<img id="qr" src="/checkin/qr.png" alt="QR-код для отметки о приходе">
+<p>Отсканируйте код, чтобы отметить приход</p>
+<script>
+setInterval(function () {
+	document.getElementById("qr").src = "/checkin/qr.png?t=" + Date.now();
+}, 60000);
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestCheckinTokenRotation(t *testing.T) {
+	config := &Config{CallbackSecret: "secret", CheckinTokenTTL: 60}
+	now := time.Now()
+
+	if !ValidCheckinToken(CheckinToken(now, config), now, config) {
+		t.Fatal("current token rejected")
+	}
+	if !ValidCheckinToken(CheckinToken(now.Add(-time.Hour), config), now, config) {
+		t.Fatal("previous token rejected")
+	}
+	if ValidCheckinToken(CheckinToken(now.Add(-2*time.Hour), config), now, config) {
+		t.Fatal("token two periods old accepted")
+	}
+}
+
+func TestCheckinQRPage(t *testing.T) {
+	app := &App{
+		bot: &tgbotapi.BotAPI{Self: tgbotapi.User{UserName: "queue_bot"}},
+		config: &Config{
+			CallbackSecret:  "secret",
+			CheckinTokenTTL: 60,
+			CheckinMethods:  []string{CheckinByQR},
+			KioskToken:      "kiosk",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		auth   string
+		handle http.HandlerFunc
+		status int
+		kind   string
+	}{
+		{"page without token", "/checkin/qr", "", app.handleCheckinPage, http.StatusUnauthorized, "text/html; charset=utf-8"},
+		{"page with the token in the URL", "/checkin/qr?token=kiosk", "", app.handleCheckinPage, http.StatusUnauthorized, "text/html; charset=utf-8"},
+		{"page", "/checkin/qr", "Bearer kiosk", app.handleCheckinPage, http.StatusOK, "text/html; charset=utf-8"},
+		{"image with a wrong token", "/checkin/qr.png", "Bearer wrong", app.handleCheckinQR, http.StatusUnauthorized, ""},
+		{"image", "/checkin/qr.png", "Bearer kiosk", app.handleCheckinQR, http.StatusOK, "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			tt.handle(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.status)
+			}
+			if tt.kind != "" && rec.Header().Get("Content-Type") != tt.kind {
+				t.Fatalf("got content type %q, want %q", rec.Header().Get("Content-Type"), tt.kind)
+			}
+		})
+	}
+}
+
+func TestMarkLegacyBookingArrived(t *testing.T) {
+	db := newTestDB(t)
+	addTestUsers(t, db, 1)
+	slotID := addLegacyBooking(t, db, testSlotTime(10, 0), 1)
+
+	if err := MarkSlotArrived(db, slotID); err != nil {
+		t.Fatalf("MarkSlotArrived of a booking without status: %v", err)
+	}
+	if err := MarkSlotArrived(db, slotID); err != ErrAlreadyArrived {
+		t.Fatalf("second check-in: got %v, want %v", err, ErrAlreadyArrived)
+	}
+}
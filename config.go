@@ -6,6 +6,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -22,8 +23,54 @@ type Config struct {
 	ScheduleDays  int
 	SkipWeekend   bool
 	AdminIDs      []int64
-	RateLimit     int // Requests per minute
-	SlotsPerRow   int // Number of time slot buttons per row
+	OperatorIDs   []int64 // Staff serving the live queue, admins are operators too
+	RateLimit     int     // Requests per minute
+	SlotsPerRow   int     // Number of time slot buttons per row
+	LeadTime      int     // Minimum minutes between booking and slot start
+
+	CallbackSecret string // Key for signing inline button data
+
+	PaymentProvider string // "telegram" or "fake" for local testing
+	PaymentToken    string // Telegram payment provider token
+	DepositAmount   int    // Deposit in minor currency units, 0 disables payments
+	DepositCurrency string
+	PaymentHoldTime int // Minutes a slot is held while awaiting payment
+	RefundCutoff    int // Hours before the slot until which cancellations are refunded
+
+	GroupRules []GroupRule // Priority booking rules per user group
+
+	QuotaLimit  int    // Max bookings per quota period, 0 disables the quota
+	QuotaPeriod string // day, week or month
+
+	QueuePrefix          string // Letter before live queue ticket numbers
+	QueueNotifyPositions int    // Notify visitors this many positions before their turn
+	QueueNotifyMinutes   int    // or this many minutes before it
+	AppointmentPrefix    string // Letter before tickets of booked visitors
+	AppointmentGrace     int    // Minutes around the slot start when a booked visitor has priority
+
+	CheckinMethods  []string // Allowed ways to check in: command, location, qr
+	VenueLatitude   float64
+	VenueLongitude  float64
+	CheckinRadius   int // Meters from the venue a location check-in is accepted within
+	CheckinTokenTTL int // Minutes the reception QR code token stays valid
+
+	BoardTitle    string
+	BoardTheme    string // dark or light
+	BoardColumns  int    // Columns of the "now serving" grid
+	BoardUpcoming int    // Number of upcoming tickets shown
+
+	KioskToken string // Secret of the reception kiosk, empty disables the kiosk endpoints
+
+	OpsChatID int64 // Operations group receiving booking cards, 0 disables them
+
+	Services []string // Services operators tag visits with for duration analytics
+
+	Route []RouteStage // Ordered stations of a visit, empty for a single queue
+
+	Reminders       []time.Duration // How long before a booking its reminders are sent
+	ConfirmDeadline time.Duration   // Unconfirmed bookings are released this long before start, 0 keeps them
+
+	AgendaTime string // Time of the daily agenda digest to staff like "08:00", empty disables it
 }
 
 // LoadConfig loads configuration from environment variables and .env file
@@ -47,17 +94,112 @@ func LoadConfig() (*Config, error) {
 		SkipWeekend:   getEnvBoolOrDefault("SKIP_WEEKEND", true),
 		RateLimit:     getEnvIntOrDefault("RATE_LIMIT", 60),
 		SlotsPerRow:   getEnvIntOrDefault("SLOTS_PER_ROW", 3),
+		LeadTime:      getEnvIntOrDefault("BOOKING_LEAD_TIME", 0),
+
+		CallbackSecret: os.Getenv("CALLBACK_SECRET"),
+
+		PaymentProvider: getEnvOrDefault("PAYMENT_PROVIDER", "telegram"),
+		PaymentToken:    os.Getenv("PAYMENT_PROVIDER_TOKEN"),
+		DepositAmount:   getEnvIntOrDefault("DEPOSIT_AMOUNT", 0),
+		DepositCurrency: getEnvOrDefault("DEPOSIT_CURRENCY", "RUB"),
+		PaymentHoldTime: getEnvIntOrDefault("PAYMENT_HOLD_TIME", 15),
+		RefundCutoff:    getEnvIntOrDefault("REFUND_CUTOFF", 24),
+
+		QueuePrefix:          getEnvOrDefault("QUEUE_PREFIX", "A"),
+		QueueNotifyPositions: getEnvIntOrDefault("QUEUE_NOTIFY_POSITIONS", 3),
+		QueueNotifyMinutes:   getEnvIntOrDefault("QUEUE_NOTIFY_MINUTES", 10),
+		AppointmentPrefix:    getEnvOrDefault("APPOINTMENT_PREFIX", "B"),
+		AppointmentGrace:     getEnvIntOrDefault("APPOINTMENT_GRACE", 10),
+
+		CheckinRadius:   getEnvIntOrDefault("CHECKIN_RADIUS", 200),
+		CheckinTokenTTL: getEnvIntOrDefault("CHECKIN_TOKEN_TTL", 60),
+
+		BoardTitle:    getEnvOrDefault("BOARD_TITLE", "Электронная очередь"),
+		BoardTheme:    getEnvOrDefault("BOARD_THEME", "dark"),
+		BoardColumns:  getEnvIntOrDefault("BOARD_COLUMNS", 2),
+		BoardUpcoming: getEnvIntOrDefault("BOARD_UPCOMING", 8),
+
+		KioskToken: os.Getenv("KIOSK_TOKEN"),
+	}
+
+	// Parse admin and operator IDs
+	config.AdminIDs = parseIDList(os.Getenv("ADMIN_IDS"))
+	config.OperatorIDs = parseIDList(os.Getenv("OPERATOR_IDS"))
+
+	// Parse services
+	for _, service := range strings.Split(os.Getenv("SERVICES"), ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			config.Services = append(config.Services, service)
+		}
+	}
+
+	// Parse group rules
+	groupRules, err := ParseGroupRules(os.Getenv("GROUP_RULES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GROUP_RULES: %w", err)
+	}
+	config.GroupRules = groupRules
+
+	// Parse booking quota
+	config.QuotaLimit, config.QuotaPeriod, err = ParseQuota(os.Getenv("BOOKING_QUOTA"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid BOOKING_QUOTA: %w", err)
+	}
+
+	// Parse booking reminders
+	config.Reminders, err = ParseReminders(getEnvOrDefault("REMINDERS", "24h,2h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REMINDERS: %w", err)
 	}
 
-	// Parse admin IDs
-	adminIDsStr := os.Getenv("ADMIN_IDS")
-	if adminIDsStr != "" {
-		for _, idStr := range strings.Split(adminIDsStr, ",") {
-			if id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64); err == nil {
-				config.AdminIDs = append(config.AdminIDs, id)
-			}
+	if deadline := os.Getenv("CONFIRM_DEADLINE"); deadline != "" {
+		config.ConfirmDeadline, err = time.ParseDuration(deadline)
+		if err != nil || config.ConfirmDeadline < 0 {
+			return nil, fmt.Errorf("invalid CONFIRM_DEADLINE %q", deadline)
 		}
 	}
+	if config.ConfirmDeadline > 0 && !remindsBefore(config.Reminders, config.ConfirmDeadline) {
+		return nil, fmt.Errorf("CONFIRM_DEADLINE must be shorter than the earliest reminder in REMINDERS")
+	}
+
+	// Parse agenda digest time
+	config.AgendaTime = getEnvOrDefault("AGENDA_TIME", "08:00")
+	if config.AgendaTime == "off" {
+		config.AgendaTime = ""
+	} else if _, err := time.Parse("15:04", config.AgendaTime); err != nil {
+		return nil, fmt.Errorf("invalid AGENDA_TIME %q", config.AgendaTime)
+	}
+
+	// Parse operations group
+	if opsChat := os.Getenv("OPS_CHAT_ID"); opsChat != "" {
+		config.OpsChatID, err = strconv.ParseInt(strings.TrimSpace(opsChat), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OPS_CHAT_ID %q", opsChat)
+		}
+	}
+
+	// Parse visit route
+	config.Route, err = ParseRoute(os.Getenv("ROUTE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ROUTE: %w", err)
+	}
+
+	// Parse check-in settings
+	config.CheckinMethods, err = ParseCheckinMethods(getEnvOrDefault("CHECKIN_METHODS", CheckinByCommand))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CHECKIN_METHODS: %w", err)
+	}
+	var hasVenue bool
+	config.VenueLatitude, config.VenueLongitude, hasVenue, err = ParseVenueLocation(os.Getenv("VENUE_LOCATION"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid VENUE_LOCATION: %w", err)
+	}
+	if hasCheckinMethod(config, CheckinByLocation) && !hasVenue {
+		return nil, fmt.Errorf("VENUE_LOCATION is required for location check-in")
+	}
+	if config.CheckinTokenTTL <= 0 {
+		return nil, fmt.Errorf("CHECKIN_TOKEN_TTL must be positive")
+	}
 
 	// Validate required fields
 	if config.TelegramToken == "" {
@@ -67,9 +209,32 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("WEBHOOK_URL is required")
 	}
 
+	if config.DepositAmount > 0 && config.PaymentProvider == "telegram" && config.PaymentToken == "" {
+		return nil, fmt.Errorf("PAYMENT_PROVIDER_TOKEN is required when DEPOSIT_AMOUNT is set")
+	}
+
+	// Fall back to the bot token, which is secret and stable across restarts
+	if config.CallbackSecret == "" {
+		config.CallbackSecret = config.TelegramToken
+	}
+
 	return config, nil
 }
 
+// parseIDList parses a comma-separated list of Telegram IDs, skipping invalid entries
+func parseIDList(value string) []int64 {
+	var ids []int64
+	if value == "" {
+		return ids
+	}
+	for _, idStr := range strings.Split(value, ",") {
+		if id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
 // getEnvOrDefault gets environment variable with default value
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -105,3 +270,16 @@ func IsAdmin(config *Config, userID int64) bool {
 	}
 	return false
 }
+
+// IsOperator checks if user can serve the live queue
+func IsOperator(config *Config, userID int64) bool {
+	if IsAdmin(config, userID) {
+		return true
+	}
+	for _, operatorID := range config.OperatorIDs {
+		if operatorID == userID {
+			return true
+		}
+	}
+	return false
+}
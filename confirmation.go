@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// bookingTokenAction marks booking tokens signed with the callback codec
+const bookingTokenAction = "qr"
+
+// qrScale is the size of a QR code module in pixels
+const qrScale = 8
+
+// Booking token errors
+var (
+	ErrInvalidBookingToken = errors.New("invalid booking token")
+	ErrBookingNotFound     = errors.New("booking not found")
+)
+
+// BookingToken returns the signed token printed into the booking QR code
+func BookingToken(callbacks *CallbackCodec, slot *Slot) string {
+	return callbacks.Encode(bookingTokenAction, strconv.Itoa(slot.ID), slot.Code)
+}
+
+// VerifyBookingToken checks the token signature and returns the booking it refers to.
+// A token stops working once the booking is cancelled, even if the slot is booked again.
+func VerifyBookingToken(db *sql.DB, callbacks *CallbackCodec, token string) (*Slot, error) {
+	action, args, err := callbacks.Decode(strings.TrimSpace(token))
+	if err != nil || action != bookingTokenAction || len(args) != 2 {
+		return nil, ErrInvalidBookingToken
+	}
+
+	slotID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, ErrInvalidBookingToken
+	}
+
+	slot, err := GetSlotByID(db, slotID)
+	if err != nil {
+		return nil, err
+	}
+	if slot == nil || !slot.UserID.Valid || slot.Code != args[1] {
+		return nil, ErrBookingNotFound
+	}
+
+	return slot, nil
+}
+
+// sendBookingQR sends the booking QR code to show at reception
+func (app *App) sendBookingQR(chatID int64, slot *Slot) {
+	qr, err := EncodeQR([]byte(BookingToken(app.callbacks, slot)))
+	if err != nil {
+		log.Printf("Error encoding booking QR code: %v", err)
+		return
+	}
+
+	picture, err := qr.PNG(qrScale)
+	if err != nil {
+		log.Printf("Error rendering booking QR code: %v", err)
+		return
+	}
+
+	// Queued after the confirmation text, so it arrives second and is retried like any message
+	if err := app.queuePhoto(chatID, picture, "Покажите этот QR-код на стойке регистрации"); err != nil {
+		log.Printf("Error queueing booking QR code: %v", err)
+	}
+}
+
+// Handlers
+
+func handleVerify(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+
+	if !IsOperator(app.config, update.Message.From.ID) {
+		return app.sendMessage(chatID, "У вас нет прав оператора")
+	}
+
+	token := update.Message.CommandArguments()
+	if token == "" {
+		return app.sendMessage(chatID, "Отсканируйте QR-код записи и отправьте: /verify ТОКЕН")
+	}
+
+	slot, err := VerifyBookingToken(app.db, app.callbacks, token)
+	switch {
+	case errors.Is(err, ErrInvalidBookingToken):
+		return app.sendMessage(chatID, "❌ QR-код недействителен")
+	case errors.Is(err, ErrBookingNotFound):
+		return app.sendMessage(chatID, "❌ Запись отменена или не найдена")
+	case err != nil:
+		log.Printf("Error verifying booking token: %v", err)
+		return app.sendMessage(chatID, "Ошибка при проверке QR-кода")
+	}
+
+	return app.sendBookingCard(chatID, slot)
+}
+
+// verifyResponse is the JSON answer of the verification endpoint
+type verifyResponse struct {
+	Valid     bool       `json:"valid"`
+	Error     string     `json:"error,omitempty"`
+	Code      string     `json:"code,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+	Name      string     `json:"name,omitempty"`
+}
+
+// handleVerifyEndpoint validates a scanned booking token for reception software.
+// It reveals the visitor's details, so it requires the kiosk token and is off without one.
+func (app *App) handleVerifyEndpoint(w http.ResponseWriter, r *http.Request) {
+	if app.config.KioskToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var response verifyResponse
+	status := http.StatusOK
+
+	// The token parameter holds the booking token, the kiosk is signed in by header or cookie
+	authorized := app.kioskAuthorized(r)
+
+	var slot *Slot
+	var err error
+	if authorized {
+		slot, err = VerifyBookingToken(app.db, app.callbacks, r.URL.Query().Get("token"))
+	}
+	switch {
+	case !authorized:
+		status, response.Error = http.StatusUnauthorized, "unauthorized"
+	case errors.Is(err, ErrInvalidBookingToken):
+		status, response.Error = http.StatusBadRequest, "invalid token"
+	case errors.Is(err, ErrBookingNotFound):
+		status, response.Error = http.StatusNotFound, "booking not found"
+	case err != nil:
+		log.Printf("Error verifying booking token: %v", err)
+		status, response.Error = http.StatusInternalServerError, "internal error"
+	default:
+		response.Valid = true
+		response.Code = slot.Code
+		response.Status = slot.Status
+		response.StartTime = &slot.StartTime
+		if user, err := GetUserByTelegramID(app.db, slot.UserID.Int64); err == nil && user != nil {
+			response.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		}
+	}
+
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error writing verify response: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerifyEndpointRequiresKioskToken(t *testing.T) {
+	app := &App{
+		db:        newTestDB(t),
+		config:    &Config{KioskToken: "kiosk"},
+		callbacks: NewCallbackCodec("secret"),
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		auth   string
+		status int
+	}{
+		{"no token", "/verify?token=x", "", http.StatusUnauthorized},
+		{"wrong token", "/verify?token=x", "Bearer other", http.StatusUnauthorized},
+		{"kiosk token in the query only", "/verify?token=kiosk", "", http.StatusUnauthorized},
+		{"kiosk token", "/verify?token=x", "Bearer kiosk", http.StatusBadRequest}, // Passes auth, the booking token is invalid
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			app.handleVerifyEndpoint(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+
+	app.config.KioskToken = ""
+	rec := httptest.NewRecorder()
+	app.handleVerifyEndpoint(rec, httptest.NewRequest(http.MethodGet, "/verify?token=x", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d without KIOSK_TOKEN, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestBookingQRQueuedAfterConfirmation(t *testing.T) {
+	app := newTestApp(t, newTestConfig())
+	addTestUsers(t, app.db, 1)
+
+	slot, err := BookTimeSlot(app.db, testSlotTime(10, 0), 1, "user", app.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.sendMessage(1, "✅ Запись подтверждена"); err != nil {
+		t.Fatal(err)
+	}
+	app.sendBookingQR(1, slot)
+
+	rows, err := app.db.Query("SELECT kind, LENGTH(photo) FROM outbox WHERE chat_id = 1 ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var kinds []string
+	for rows.Next() {
+		var kind string
+		var size sql.NullInt64
+		if err := rows.Scan(&kind, &size); err != nil {
+			t.Fatal(err)
+		}
+		if kind == OutboxPhoto && size.Int64 == 0 {
+			t.Fatal("QR photo queued without the picture")
+		}
+		kinds = append(kinds, kind)
+	}
+	if len(kinds) != 2 || kinds[0] != OutboxMessage || kinds[1] != OutboxPhoto {
+		t.Fatalf("got outbox %v, want the confirmation and then the QR photo", kinds)
+	}
+}
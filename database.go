@@ -1,11 +1,30 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 )
 
+// Booking errors returned by BookTimeSlot
+var (
+	ErrSlotTaken       = errors.New("slot is already booked")
+	ErrBookingLimit    = errors.New("user already has an active booking")
+	ErrOutsideSchedule = errors.New("slot is outside the schedule")
+	ErrTooLate         = errors.New("slot is in the past or too soon to book")
+	ErrSlotReserved    = errors.New("slot is reserved for another group")
+)
+
+// ErrBookingChanged is returned when the slot no longer holds the booking an action was meant for
+var ErrBookingChanged = errors.New("slot no longer holds the booking")
+
+// ErrDuplicateBookings is returned by InitDB when older versions left several bookings at one time
+var ErrDuplicateBookings = errors.New("several bookings share a slot time")
+
 // User represents a registered user
 type User struct {
 	ID          int64
@@ -25,7 +44,57 @@ type Slot struct {
 	EndTime   time.Time
 	UserID    sql.NullInt64
 	Username  sql.NullString
+	Code      string // Booking reference code, empty for free slots
+	Status    string // Booking status, empty for free slots
+	HoldUntil sql.NullTime
 	CreatedAt time.Time
+
+	ConfirmedAt sql.NullTime // When the visitor confirmed they will come
+}
+
+// Booking statuses
+const (
+	SlotStatusBooked          = "booked"
+	SlotStatusAwaitingPayment = "awaiting_payment" // Held until the deposit is paid
+	SlotStatusArrived         = "arrived"          // Visitor checked in at the venue
+	SlotStatusNoShow          = "no_show"          // Visitor didn't come, marked by staff
+)
+
+// releaseSlotColumns resets every booking column of a slot
+const releaseSlotColumns = "user_id = NULL, username = NULL, code = NULL, status = NULL, hold_until = NULL, arrived_at = NULL, confirmed_at = NULL, service = NULL"
+
+// releaseSlots frees the booked slots matching the condition. Their codes move to
+// cancelled_bookings, so /find still reports them and they are never issued again.
+func releaseSlots(ex execer, where string, args ...any) (sql.Result, error) {
+	archive := `
+		INSERT OR IGNORE INTO cancelled_bookings (code, start_time, user_id, username, cancelled_at)
+		SELECT code, start_time, user_id, username, ? FROM slots WHERE code IS NOT NULL AND (` + where + `)
+	`
+	if _, err := ex.Exec(archive, append([]any{time.Now()}, args...)...); err != nil {
+		return nil, err
+	}
+	return ex.Exec("UPDATE slots SET "+releaseSlotColumns+" WHERE "+where, args...)
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// rowQueryer is implemented by both *sql.DB and *sql.Tx
+type rowQueryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// execQueryer reads and writes within the same *sql.DB or *sql.Tx
+type execQueryer interface {
+	execer
+	rowQueryer
 }
 
 // Stats holds statistics
@@ -38,7 +107,9 @@ type Stats struct {
 
 // InitDB initializes the database
 func InitDB(dbFile string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbFile)
+	// Immediate transactions take the write lock up front, so concurrent
+	// bookings are serialized instead of failing on lock upgrade
+	db, err := sql.Open("sqlite3", sqliteDSN(dbFile))
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +123,7 @@ func InitDB(dbFile string) (*sql.DB, error) {
 		last_name TEXT,
 		username TEXT,
 		phone_number TEXT,
+		phone_normalized TEXT,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		is_active BOOLEAN DEFAULT 1
 	);
@@ -62,12 +134,191 @@ func InitDB(dbFile string) (*sql.DB, error) {
 		end_time DATETIME NOT NULL,
 		user_id INTEGER,
 		username TEXT,
+		code TEXT,
+		status TEXT,
+		hold_until DATETIME,
+		arrived_at DATETIME,
+		confirmed_at DATETIME,
+		service TEXT,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (user_id) REFERENCES users (telegram_id)
 	);
 
+	CREATE TABLE IF NOT EXISTS cancelled_bookings (
+		code TEXT PRIMARY KEY,
+		start_time DATETIME NOT NULL,
+		user_id INTEGER,
+		username TEXT,
+		cancelled_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS payments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		slot_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		currency TEXT NOT NULL,
+		telegram_charge_id TEXT NOT NULL,
+		provider_charge_id TEXT,
+		status TEXT NOT NULL,
+		code TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		refunded_at DATETIME,
+		FOREIGN KEY (slot_id) REFERENCES slots (id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_payments_slot_id ON payments(slot_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_charge_id ON payments(telegram_charge_id);
+
+	CREATE TABLE IF NOT EXISTS user_groups (
+		telegram_id INTEGER NOT NULL,
+		group_name TEXT NOT NULL,
+		PRIMARY KEY (telegram_id, group_name)
+	);
+
+	CREATE TABLE IF NOT EXISTS tickets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		queue_date TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		number INTEGER NOT NULL,
+		user_id INTEGER,
+		status TEXT NOT NULL,
+		issued_at DATETIME NOT NULL,
+		called_at DATETIME,
+		served_at DATETIME,
+		counter INTEGER,
+		operator_id INTEGER,
+		notified_at DATETIME,
+		kind TEXT,
+		slot_id INTEGER,
+		due_at DATETIME,
+		started_at DATETIME,
+		service TEXT,
+		stage INTEGER,
+		stage_at DATETIME,
+		UNIQUE (queue_date, prefix, number)
+	);
+
+	CREATE TABLE IF NOT EXISTS ticket_stages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ticket_id INTEGER NOT NULL,
+		stage INTEGER NOT NULL,
+		operator_id INTEGER,
+		counter INTEGER,
+		service TEXT,
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME NOT NULL,
+		FOREIGN KEY (ticket_id) REFERENCES tickets (id)
+	);
+
+	CREATE TABLE IF NOT EXISTS operators (
+		telegram_id INTEGER PRIMARY KEY,
+		counter INTEGER NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS delays (
+		queue_date TEXT PRIMARY KEY,
+		minutes INTEGER NOT NULL,
+		operator_id INTEGER,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS ops_cards (
+		code TEXT PRIMARY KEY,
+		message_id INTEGER NOT NULL,
+		outbox_id INTEGER NOT NULL DEFAULT 0,
+		slot_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		start_time DATETIME NOT NULL,
+		state TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS broadcasts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		admin_id INTEGER NOT NULL,
+		chat_id INTEGER NOT NULL,
+		message_id INTEGER NOT NULL DEFAULT 0,
+		segment TEXT NOT NULL,
+		text TEXT NOT NULL,
+		status TEXT NOT NULL,
+		total INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		started_at DATETIME,
+		finished_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS broadcast_recipients (
+		broadcast_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		sent_at DATETIME,
+		PRIMARY KEY (broadcast_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS user_settings (
+		telegram_id INTEGER PRIMARY KEY,
+		reminders TEXT NOT NULL DEFAULT '',
+		quiet_start INTEGER,
+		quiet_end INTEGER,
+		language TEXT NOT NULL DEFAULT 'ru',
+		marketing INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		chat_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		text TEXT NOT NULL DEFAULT '',
+		parse_mode TEXT NOT NULL DEFAULT '',
+		reply_markup TEXT NOT NULL DEFAULT '',
+		message_id INTEGER NOT NULL DEFAULT 0,
+		photo BLOB,
+		target_id INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		last_error TEXT,
+		created_at DATETIME NOT NULL,
+		sent_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_outbox_status ON outbox(status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS idx_outbox_chat ON outbox(chat_id, status);
+
+	CREATE TABLE IF NOT EXISTS waitlist (
+		user_id INTEGER NOT NULL,
+		date TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, date)
+	);
+
+	CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		slot_id INTEGER,
+		user_id INTEGER,
+		run_at DATETIME NOT NULL,
+		payload TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		finished_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_jobs_due ON jobs(status, run_at);
+	CREATE INDEX IF NOT EXISTS idx_jobs_slot_id ON jobs(slot_id);
+
+	CREATE INDEX IF NOT EXISTS idx_tickets_queue ON tickets(queue_date, status);
+	CREATE INDEX IF NOT EXISTS idx_tickets_user_id ON tickets(user_id);
+
 	CREATE INDEX IF NOT EXISTS idx_users_telegram_id ON users(telegram_id);
-	CREATE INDEX IF NOT EXISTS idx_start_time ON slots(start_time);
+	DROP INDEX IF EXISTS idx_start_time;
 	CREATE INDEX IF NOT EXISTS idx_user_id ON slots(user_id);
 	`
 
@@ -75,13 +326,174 @@ func InitDB(dbFile string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Older versions could create several rows for one time, keep one before enforcing it
+	if err := removeDuplicateSlots(db); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_slots_start_time ON slots(start_time)"); err != nil {
+		return nil, err
+	}
+
+	// Bring databases created by older versions up to date
+	for _, m := range columnMigrations {
+		if err := addColumnIfMissing(db, m.table, m.column, m.definition); err != nil {
+			return nil, err
+		}
+	}
+
+	// Indexes on migrated columns
+	indexQuery := `
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_slots_code ON slots(code);
+	CREATE INDEX IF NOT EXISTS idx_users_phone_normalized ON users(phone_normalized);
+	`
+
+	if _, err := db.Exec(indexQuery); err != nil {
+		return nil, err
+	}
+
+	if err := backfillNormalizedPhones(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
+// sqliteDSN adds the locking options to the database file, keeping any options it already has
+func sqliteDSN(dbFile string) string {
+	separator := "?"
+	if strings.Contains(dbFile, "?") {
+		separator = "&"
+	}
+	return dbFile + separator + "_txlock=immediate&_busy_timeout=5000"
+}
+
+// columnMigrations lists columns added after the initial schema
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"slots", "code", "TEXT"},
+	{"slots", "status", "TEXT"},
+	{"slots", "hold_until", "DATETIME"},
+	{"slots", "arrived_at", "DATETIME"},
+	{"slots", "confirmed_at", "DATETIME"},
+	{"slots", "service", "TEXT"},
+	{"users", "phone_normalized", "TEXT"},
+	{"tickets", "counter", "INTEGER"},
+	{"tickets", "operator_id", "INTEGER"},
+	{"tickets", "notified_at", "DATETIME"},
+	{"tickets", "kind", "TEXT"},
+	{"tickets", "slot_id", "INTEGER"},
+	{"tickets", "due_at", "DATETIME"},
+	{"tickets", "started_at", "DATETIME"},
+	{"tickets", "service", "TEXT"},
+	{"tickets", "stage", "INTEGER"},
+	{"tickets", "stage_at", "DATETIME"},
+	{"ticket_stages", "operator_id", "INTEGER"},
+	{"ticket_stages", "service", "TEXT"},
+	{"ticket_stages", "counter", "INTEGER"},
+	{"ops_cards", "outbox_id", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// removeDuplicateSlots keeps one row per start time, preferring a booked one, and deletes the free rest.
+// Bookings are never dropped: if a time holds several of them, nothing is deleted and the
+// conflicts are reported, so the admin resolves them with the owners before starting the bot.
+func removeDuplicateSlots(db *sql.DB) error {
+	query := `
+		SELECT id, start_time, user_id, COALESCE(username, '')
+		FROM slots
+		WHERE start_time IN (SELECT start_time FROM slots GROUP BY start_time HAVING COUNT(*) > 1)
+		ORDER BY start_time, user_id IS NULL, id
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+
+	var duplicates []int
+	var conflicts []string
+	var kept time.Time
+	first := true
+	for rows.Next() {
+		var id int
+		var startTime time.Time
+		var userID sql.NullInt64
+		var username string
+		if err := rows.Scan(&id, &startTime, &userID, &username); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if first || !startTime.Equal(kept) {
+			kept, first = startTime, false
+			continue
+		}
+		if userID.Valid {
+			conflicts = append(conflicts, fmt.Sprintf("slot %d of user %d (%s) at %s", id, userID.Int64, username, startTime.Format("02.01.2006 15:04")))
+			continue
+		}
+		duplicates = append(duplicates, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w, cancel one of each: %s", ErrDuplicateBookings, strings.Join(conflicts, "; "))
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range duplicates {
+		if _, err := tx.Exec("DELETE FROM slots WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	log.Printf("Removed %d duplicate free slots", len(duplicates))
+
+	return tx.Commit()
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already there
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 // GetUserSlots returns slots for a specific user
 func GetUserSlots(db *sql.DB, userID int64) ([]Slot, error) {
 	query := `
-		SELECT id, start_time, end_time, created_at
+		SELECT id, start_time, end_time, COALESCE(code, ''), COALESCE(status, 'booked'), hold_until, created_at, confirmed_at
 		FROM slots
 		WHERE user_id = ? AND start_time > ?
 		ORDER BY start_time
@@ -96,7 +508,7 @@ func GetUserSlots(db *sql.DB, userID int64) ([]Slot, error) {
 	var slots []Slot
 	for rows.Next() {
 		var slot Slot
-		if err := rows.Scan(&slot.ID, &slot.StartTime, &slot.EndTime, &slot.CreatedAt); err != nil {
+		if err := rows.Scan(&slot.ID, &slot.StartTime, &slot.EndTime, &slot.Code, &slot.Status, &slot.HoldUntil, &slot.CreatedAt, &slot.ConfirmedAt); err != nil {
 			return nil, err
 		}
 		slot.UserID.Int64 = userID
@@ -109,13 +521,13 @@ func GetUserSlots(db *sql.DB, userID int64) ([]Slot, error) {
 
 // CancelSlot cancels a user's slot
 func CancelSlot(db *sql.DB, slotID int, userID int64) error {
-	query := `
-		UPDATE slots 
-		SET user_id = NULL, username = NULL
-		WHERE id = ? AND user_id = ?
-	`
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	result, err := db.Exec(query, slotID, userID)
+	result, err := releaseSlots(tx, "id = ? AND user_id = ?", slotID, userID)
 	if err != nil {
 		return err
 	}
@@ -129,7 +541,11 @@ func CancelSlot(db *sql.DB, slotID int, userID int64) error {
 		return fmt.Errorf("slot not found or not owned by user")
 	}
 
-	return nil
+	if err := cancelSlotJobs(tx, slotID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // GetStatistics returns booking statistics
@@ -186,19 +602,11 @@ func GenerateSlots(db *sql.DB, config *Config, from, to time.Time) error {
 		for slot := start; slot.Before(end); slot = slot.Add(time.Duration(config.SlotDuration) * time.Minute) {
 			slotEnd := slot.Add(time.Duration(config.SlotDuration) * time.Minute)
 
-			// Check if slot already exists
-			var exists bool
-			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM slots WHERE start_time = ?)", slot).Scan(&exists)
+			// Unique index on start_time skips already existing slots
+			_, err := db.Exec("INSERT OR IGNORE INTO slots (start_time, end_time) VALUES (?, ?)", slot, slotEnd)
 			if err != nil {
 				return err
 			}
-
-			if !exists {
-				_, err = db.Exec("INSERT INTO slots (start_time, end_time) VALUES (?, ?)", slot, slotEnd)
-				if err != nil {
-					return err
-				}
-			}
 		}
 	}
 
@@ -287,11 +695,11 @@ func CreateUser(db *sql.DB, telegramID int64, firstName, lastName, username stri
 func UpdateUserPhone(db *sql.DB, telegramID int64, phoneNumber string) error {
 	query := `
 		UPDATE users 
-		SET phone_number = ?
+		SET phone_number = ?, phone_normalized = ?
 		WHERE telegram_id = ?
 	`
 
-	result, err := db.Exec(query, phoneNumber, telegramID)
+	result, err := db.Exec(query, phoneNumber, NormalizePhone(phoneNumber), telegramID)
 	if err != nil {
 		return err
 	}
@@ -381,15 +789,22 @@ func FilterFutureSlots(slots []time.Time, now time.Time) []time.Time {
 	return futureSlots
 }
 
-// GetAvailableSlotsForDate returns available (unbooked) slots for a specific date
-func GetAvailableSlotsForDate(db *sql.DB, date time.Time, config *Config) ([]time.Time, error) {
+// GetAvailableSlotsForDate returns slots of a specific date the user can book:
+// not booked and not reserved for a group the user is not in
+func GetAvailableSlotsForDate(db *sql.DB, date time.Time, userID int64, config *Config) ([]time.Time, error) {
+	groups, err := GetUserGroups(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Generate all possible slots for the date
 	allSlots := GenerateSlotsForDate(date, config)
+	reserved := ReservedSlots(allSlots, config)
 
-	// Filter future slots if it's today
+	// Filter slots that are too soon to book if it's today
 	now := time.Now()
 	if date.Format("2006-01-02") == now.Format("2006-01-02") {
-		allSlots = FilterFutureSlots(allSlots, now)
+		allSlots = FilterFutureSlots(allSlots, now.Add(time.Duration(config.LeadTime)*time.Minute))
 	}
 
 	// Get booked slots from database
@@ -414,10 +829,10 @@ func GetAvailableSlotsForDate(db *sql.DB, date time.Time, config *Config) ([]tim
 		bookedSlots[bookedTime.Format("15:04")] = true
 	}
 
-	// Filter out booked slots
+	// Filter out booked and reserved slots
 	var availableSlots []time.Time
 	for _, slot := range allSlots {
-		if !bookedSlots[slot.Format("15:04")] {
+		if !bookedSlots[slot.Format("15:04")] && isSlotOpenForGroups(slot, reserved, groups, now) {
 			availableSlots = append(availableSlots, slot)
 		}
 	}
@@ -428,7 +843,7 @@ func GetAvailableSlotsForDate(db *sql.DB, date time.Time, config *Config) ([]tim
 // GetUserActiveSlot returns user's active slot (future booking)
 func GetUserActiveSlot(db *sql.DB, userID int64) (*Slot, error) {
 	query := `
-		SELECT id, start_time, end_time, created_at
+		SELECT id, start_time, end_time, COALESCE(code, ''), COALESCE(status, 'booked'), hold_until, created_at
 		FROM slots
 		WHERE user_id = ? AND start_time > ?
 		ORDER BY start_time
@@ -437,7 +852,7 @@ func GetUserActiveSlot(db *sql.DB, userID int64) (*Slot, error) {
 
 	var slot Slot
 	err := db.QueryRow(query, userID, time.Now()).Scan(
-		&slot.ID, &slot.StartTime, &slot.EndTime, &slot.CreatedAt,
+		&slot.ID, &slot.StartTime, &slot.EndTime, &slot.Code, &slot.Status, &slot.HoldUntil, &slot.CreatedAt,
 	)
 
 	if err != nil {
@@ -453,28 +868,184 @@ func GetUserActiveSlot(db *sql.DB, userID int64) (*Slot, error) {
 	return &slot, nil
 }
 
-// BookTimeSlot books a specific time slot for a user
-func BookTimeSlot(db *sql.DB, slotTime time.Time, userID int64, username string, config *Config) error {
+// BookTimeSlot books a specific time slot for a user and returns the booked slot.
+// The whole check-and-book sequence runs in a single transaction, so concurrent
+// requests can neither double-book a slot nor give one user two active bookings.
+func BookTimeSlot(db *sql.DB, slotTime time.Time, userID int64, username string, config *Config) (*Slot, error) {
+	if err := checkSlotOpen(db, slotTime, userID, config); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	// Check if user already has an active booking
-	activeSlot, err := GetUserActiveSlot(db, userID)
+	var activeCount int
+	err = tx.QueryRow("SELECT COUNT(*) FROM slots WHERE user_id = ? AND start_time > ?", userID, time.Now()).Scan(&activeCount)
+	if err != nil {
+		return nil, err
+	}
+	if activeCount > 0 {
+		return nil, ErrBookingLimit
+	}
+
+	// Check the per-period quota shared by accounts with the same phone
+	if err := checkBookingQuota(tx, slotTime, userID, config); err != nil {
+		return nil, err
+	}
+
+	code, err := newBookingCode(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	// With a deposit configured the slot is only held until the payment arrives
+	status := SlotStatusBooked
+	var holdUntil sql.NullTime
+	if config.DepositAmount > 0 {
+		status = SlotStatusAwaitingPayment
+		holdUntil = sql.NullTime{Time: time.Now().Add(time.Duration(config.PaymentHoldTime) * time.Minute), Valid: true}
+	}
+
+	slot := &Slot{
+		StartTime: slotTime,
+		EndTime:   slotTime.Add(time.Duration(config.SlotDuration) * time.Minute),
+		UserID:    sql.NullInt64{Int64: userID, Valid: true},
+		Username:  sql.NullString{String: username, Valid: true},
+		Code:      code,
+		Status:    status,
+		HoldUntil: holdUntil,
+	}
+	if err := claimSlot(tx, slot); err != nil {
+		return nil, err
+	}
+
+	if err := leaveWaitlist(tx, userID); err != nil {
+		return nil, err
+	}
+
+	// Held slots get their reminders once the deposit is paid
+	if slot.Status == SlotStatusBooked {
+		if err := scheduleReminders(tx, slot, config); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return slot, nil
+}
+
+// RescheduleSlot moves a user's confirmed booking to another time keeping its code and deposit
+func RescheduleSlot(db *sql.DB, slotID int, slotTime time.Time, userID int64, config *Config) (*Slot, error) {
+	if err := checkSlotOpen(db, slotTime, userID, config); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var slot Slot
+	var service sql.NullString
+	err = tx.QueryRow(`
+		SELECT id, start_time, username, code, service
+		FROM slots
+		WHERE id = ? AND user_id = ? AND COALESCE(status, 'booked') = ? AND start_time > ?
+	`, slotID, userID, SlotStatusBooked, time.Now()).Scan(&slot.ID, &slot.StartTime, &slot.Username, &slot.Code, &service)
+	if err == sql.ErrNoRows {
+		return nil, ErrBookingNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if slot.StartTime.Equal(slotTime) {
+		return nil, ErrSlotTaken
+	}
+
+	// Free the old time first so it doesn't count towards the quota and its code can move
+	if _, err := tx.Exec("UPDATE slots SET "+releaseSlotColumns+" WHERE id = ?", slotID); err != nil {
+		return nil, err
+	}
+
+	if err := checkBookingQuota(tx, slotTime, userID, config); err != nil {
+		return nil, err
+	}
+
+	slot.StartTime = slotTime
+	slot.EndTime = slotTime.Add(time.Duration(config.SlotDuration) * time.Minute)
+	slot.UserID = sql.NullInt64{Int64: userID, Valid: true}
+	slot.Status = SlotStatusBooked
+	if err := claimSlot(tx, &slot); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE slots SET service = ? WHERE id = ?", service, slot.ID); err != nil {
+		return nil, err
+	}
+
+	// Only this booking's deposit moves, other rows of the old slot belong to earlier bookings
+	_, err = tx.Exec("UPDATE payments SET slot_id = ? WHERE slot_id = ? AND user_id = ? AND code = ? AND status = ?",
+		slot.ID, slotID, userID, slot.Code, PaymentStatusPaid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cancelSlotJobs(tx, slotID); err != nil {
+		return nil, err
+	}
+	if err := scheduleReminders(tx, &slot, config); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &slot, nil
+}
+
+// checkSlotOpen checks the schedule and group reservations before booking a slot
+func checkSlotOpen(db *sql.DB, slotTime time.Time, userID int64, config *Config) error {
+	groups, err := GetUserGroups(db, userID)
 	if err != nil {
 		return err
 	}
-	if activeSlot != nil {
-		return fmt.Errorf("пользователь уже имеет активную запись на %s", activeSlot.StartTime.Format("02.01.2006 15:04"))
+
+	now := time.Now()
+	if err := ValidateSlotTime(slotTime, now, groups, config); err != nil {
+		return err
+	}
+
+	reserved := ReservedSlots(GenerateSlotsForDate(slotTime, config), config)
+	if !isSlotOpenForGroups(slotTime, reserved, groups, now) {
+		return ErrSlotReserved
 	}
 
-	// Calculate end time
-	endTime := slotTime.Add(time.Duration(config.SlotDuration) * time.Minute)
+	return nil
+}
+
+// claimSlot assigns the slot at slot.StartTime to the booking if it is still free and fills in its ID
+func claimSlot(tx *sql.Tx, slot *Slot) error {
+	// Create the slot if it was not generated yet, then claim it if still free
+	_, err := tx.Exec("INSERT OR IGNORE INTO slots (start_time, end_time) VALUES (?, ?)", slot.StartTime, slot.EndTime)
+	if err != nil {
+		return err
+	}
 
-	// First try to update existing empty slot
 	updateQuery := `
 		UPDATE slots 
-		SET user_id = ?, username = ?
+		SET user_id = ?, username = ?, code = ?, status = ?, hold_until = ?
 		WHERE start_time = ? AND user_id IS NULL
 	`
 
-	result, err := db.Exec(updateQuery, userID, username, slotTime)
+	result, err := tx.Exec(updateQuery, slot.UserID, slot.Username, slot.Code, slot.Status, slot.HoldUntil, slot.StartTime)
 	if err != nil {
 		return err
 	}
@@ -484,24 +1055,218 @@ func BookTimeSlot(db *sql.DB, slotTime time.Time, userID int64, username string,
 		return err
 	}
 
-	if affected > 0 {
-		return nil // Successfully booked existing slot
+	if affected == 0 {
+		return ErrSlotTaken
 	}
 
-	// If no existing slot was updated, try to create new one
-	insertQuery := `
-		INSERT INTO slots (start_time, end_time, user_id, username)
-		VALUES (?, ?, ?, ?)
+	return tx.QueryRow("SELECT id, end_time, created_at FROM slots WHERE start_time = ?", slot.StartTime).Scan(&slot.ID, &slot.EndTime, &slot.CreatedAt)
+}
+
+// bookingCodeAlphabet omits characters that are easy to confuse (0/O, 1/I)
+const bookingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// bookingCodeLength is the number of characters in a booking reference code
+const bookingCodeLength = 6
+
+// newBookingCode generates a booking reference code not used by any slot or cancelled booking
+func newBookingCode(tx *sql.Tx) (string, error) {
+	for {
+		buf := make([]byte, bookingCodeLength)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for i, b := range buf {
+			buf[i] = bookingCodeAlphabet[int(b)%len(bookingCodeAlphabet)]
+		}
+		code := string(buf)
+
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM slots WHERE code = ?) OR EXISTS(SELECT 1 FROM cancelled_bookings WHERE code = ?)", code, code).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return code, nil
+		}
+	}
+}
+
+// GetSlotByCode returns the booked slot with the given reference code
+func GetSlotByCode(db *sql.DB, code string) (*Slot, error) {
+	query := `
+		SELECT id, start_time, end_time, user_id, username, code, COALESCE(status, 'booked'), hold_until, created_at
+		FROM slots
+		WHERE code = ?
 	`
 
-	_, err = db.Exec(insertQuery, slotTime, endTime, userID, username)
+	var slot Slot
+	err := db.QueryRow(query, strings.ToUpper(strings.TrimSpace(code))).Scan(
+		&slot.ID, &slot.StartTime, &slot.EndTime, &slot.UserID, &slot.Username, &slot.Code, &slot.Status, &slot.HoldUntil, &slot.CreatedAt,
+	)
+
 	if err != nil {
-		return fmt.Errorf("слот уже забронирован или произошла ошибка")
+		if err == sql.ErrNoRows {
+			return nil, nil // No booking with this code
+		}
+		return nil, err
 	}
 
+	return &slot, nil
+}
+
+// CancelledBooking is a booking that was cancelled or released, kept by its code
+type CancelledBooking struct {
+	Code        string
+	StartTime   time.Time
+	UserID      sql.NullInt64
+	Username    sql.NullString
+	CancelledAt time.Time
+}
+
+// GetCancelledBooking returns the cancelled booking with the given reference code
+func GetCancelledBooking(db *sql.DB, code string) (*CancelledBooking, error) {
+	var booking CancelledBooking
+	err := db.QueryRow(
+		"SELECT code, start_time, user_id, username, cancelled_at FROM cancelled_bookings WHERE code = ?",
+		strings.ToUpper(strings.TrimSpace(code)),
+	).Scan(&booking.Code, &booking.StartTime, &booking.UserID, &booking.Username, &booking.CancelledAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No cancelled booking with this code
+		}
+		return nil, err
+	}
+
+	return &booking, nil
+}
+
+// GetUserTodaySlot returns the user's confirmed or checked-in booking for today that hasn't ended yet
+func GetUserTodaySlot(db *sql.DB, userID int64) (*Slot, error) {
+	now := time.Now()
+	dayEnd := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).AddDate(0, 0, 1)
+
+	var slotID int
+	err := db.QueryRow(`
+		SELECT id
+		FROM slots
+		WHERE user_id = ? AND COALESCE(status, 'booked') IN (?, ?) AND end_time > ? AND start_time < ?
+		ORDER BY start_time
+		LIMIT 1
+	`, userID, SlotStatusBooked, SlotStatusArrived, now, dayEnd).Scan(&slotID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No booking today
+		}
+		return nil, err
+	}
+
+	return GetSlotByID(db, slotID)
+}
+
+// GetSlotByID returns a slot by its ID
+func GetSlotByID(db *sql.DB, slotID int) (*Slot, error) {
+	query := `
+		SELECT id, start_time, end_time, user_id, username, COALESCE(code, ''),
+			CASE WHEN user_id IS NULL THEN '' ELSE COALESCE(status, 'booked') END, hold_until, created_at, confirmed_at
+		FROM slots
+		WHERE id = ?
+	`
+
+	var slot Slot
+	err := db.QueryRow(query, slotID).Scan(
+		&slot.ID, &slot.StartTime, &slot.EndTime, &slot.UserID, &slot.Username, &slot.Code, &slot.Status, &slot.HoldUntil, &slot.CreatedAt, &slot.ConfirmedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Slot not found
+		}
+		return nil, err
+	}
+
+	return &slot, nil
+}
+
+// ReleaseSlot frees the booking with the code regardless of its owner, returning the user it was booked by.
+// The code guards against freeing a booking made on the slot after it was looked up.
+func ReleaseSlot(db *sql.DB, slotID int, code string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID sql.NullInt64
+	err = tx.QueryRow("SELECT user_id FROM slots WHERE id = ? AND code = ?", slotID, code).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if !userID.Valid {
+		return 0, ErrBookingChanged
+	}
+
+	if _, err := releaseSlots(tx, "id = ? AND code = ?", slotID, code); err != nil {
+		return 0, err
+	}
+
+	if err := cancelSlotJobs(tx, slotID); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return userID.Int64, nil
+}
+
+// ValidateSlotTime checks a requested slot against the schedule, calendar,
+// booking horizon and lead time, since callback data comes from the client
+func ValidateSlotTime(slotTime, now time.Time, groups []string, config *Config) error {
+	if !isScheduledSlot(slotTime, config) {
+		return fmt.Errorf("%w: %s is not a slot start", ErrOutsideSchedule, slotTime.Format("15:04"))
+	}
+	if config.SkipWeekend && IsWeekend(slotTime) {
+		return fmt.Errorf("%w: %s is a weekend", ErrOutsideSchedule, slotTime.Format("02.01.2006"))
+	}
+	if slotTime.Format("2006-01-02") > GetBookingHorizon(now, groups, config).Format("2006-01-02") {
+		return fmt.Errorf("%w: %s is beyond the booking horizon", ErrOutsideSchedule, slotTime.Format("02.01.2006"))
+	}
+	if !slotTime.After(now.Add(time.Duration(config.LeadTime) * time.Minute)) {
+		return ErrTooLate
+	}
 	return nil
 }
 
+// GetBookingHorizon returns the last date open for booking to a user with the given groups.
+// With a single-day schedule the next workday is offered once today is full, so it is included too.
+func GetBookingHorizon(now time.Time, groups []string, config *Config) time.Time {
+	horizon := now.AddDate(0, 0, GetBookingDays(groups, config)-1)
+	if config.ScheduleDays <= 1 {
+		if nextWorkday := GetNextAvailableWorkday(now, config); nextWorkday.After(horizon) {
+			return nextWorkday
+		}
+	}
+	return horizon
+}
+
+// GetBookingDays returns the number of days open for booking, including early access of the groups
+func GetBookingDays(groups []string, config *Config) int {
+	return config.ScheduleDays + ExtraBookingDays(groups, config)
+}
+
+// isScheduledSlot checks that the time matches one of the slots generated for its date
+func isScheduledSlot(slotTime time.Time, config *Config) bool {
+	for _, slot := range GenerateSlotsForDate(slotTime, config) {
+		if slot.Equal(slotTime) {
+			return true
+		}
+	}
+	return false
+}
+
 // IsWeekend checks if the given date is a weekend day
 func IsWeekend(date time.Time) bool {
 	return date.Weekday() == time.Saturday || date.Weekday() == time.Sunday
@@ -520,3 +1285,44 @@ func GetNextAvailableWorkday(startDate time.Time, config *Config) time.Time {
 
 	return nextDay
 }
+
+// ReleaseExpiredHolds frees slots whose deposit was not paid in time and returns them as they were held
+func ReleaseExpiredHolds(db *sql.DB) ([]Slot, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	rows, err := tx.Query(
+		"SELECT id, start_time, end_time, user_id, username, code FROM slots WHERE status = ? AND hold_until <= ?",
+		SlotStatusAwaitingPayment, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var slots []Slot
+	for rows.Next() {
+		var slot Slot
+		if err := rows.Scan(&slot.ID, &slot.StartTime, &slot.EndTime, &slot.UserID, &slot.Username, &slot.Code); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(slots) == 0 {
+		return nil, nil
+	}
+
+	if _, err := releaseSlots(tx, "status = ? AND hold_until <= ?", SlotStatusAwaitingPayment, now); err != nil {
+		return nil, err
+	}
+
+	return slots, tx.Commit()
+}
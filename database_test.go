@@ -0,0 +1,443 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestDB opens an empty database in a temporary directory
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestConfig returns a schedule of 30 minute slots from 09:00 to 18:00
+func newTestConfig() *Config {
+	return &Config{
+		WorkStart:    "09:00",
+		WorkEnd:      "18:00",
+		SlotDuration: 30,
+		ScheduleDays: 14,
+	}
+}
+
+// testSlotTime returns a slot start on a working day in the near future
+func testSlotTime(hour, minute int) time.Time {
+	day := time.Now().AddDate(0, 0, 2)
+	for IsWeekend(day) {
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, time.Local)
+}
+
+// addTestUsers registers users with distinct phones
+func addTestUsers(t *testing.T, db *sql.DB, ids ...int64) {
+	t.Helper()
+	for _, id := range ids {
+		if _, err := db.Exec("INSERT INTO users (telegram_id, first_name, phone_number) VALUES (?, 'Test', ?)", id, fmt.Sprintf("+7900%07d", id)); err != nil {
+			t.Fatalf("adding user %d: %v", id, err)
+		}
+	}
+}
+
+func TestBookTimeSlotSameTimeConcurrently(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	slotTime := testSlotTime(10, 0)
+
+	const users = 20
+	var ids []int64
+	for i := int64(1); i <= users; i++ {
+		ids = append(ids, i)
+	}
+	addTestUsers(t, db, ids...)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, users)
+	start := make(chan struct{})
+	for _, id := range ids {
+		wg.Add(1)
+		go func(userID int64) {
+			defer wg.Done()
+			<-start
+			_, err := BookTimeSlot(db, slotTime, userID, "user", config)
+			errs <- err
+		}(id)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	booked := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			booked++
+		case errors.Is(err, ErrSlotTaken):
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if booked != 1 {
+		t.Fatalf("got %d bookings of the same slot, want 1", booked)
+	}
+
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM slots WHERE start_time = ?", slotTime).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("got %d rows for the slot, want 1", rows)
+	}
+}
+
+func TestBookTimeSlotOneActiveBookingConcurrently(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	addTestUsers(t, db, 1)
+
+	const attempts = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	start := make(chan struct{})
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(slotTime time.Time) {
+			defer wg.Done()
+			<-start
+			_, err := BookTimeSlot(db, slotTime, 1, "user", config)
+			errs <- err
+		}(testSlotTime(9, 0).Add(time.Duration(i) * 30 * time.Minute))
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	booked := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			booked++
+		case errors.Is(err, ErrBookingLimit):
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if booked != 1 {
+		t.Fatalf("user got %d active bookings, want 1", booked)
+	}
+
+	var active int
+	if err := db.QueryRow("SELECT COUNT(*) FROM slots WHERE user_id = 1").Scan(&active); err != nil {
+		t.Fatal(err)
+	}
+	if active != 1 {
+		t.Fatalf("got %d slots held by the user, want 1", active)
+	}
+}
+
+func TestInitDBRemovesDuplicateSlots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	db, err := InitDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A database of a version without the unique index
+	slotTime := testSlotTime(11, 0)
+	end := slotTime.Add(30 * time.Minute)
+	if _, err := db.Exec("DROP INDEX idx_slots_start_time"); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []any{nil, 7, nil} {
+		if _, err := db.Exec("INSERT INTO slots (start_time, end_time, user_id) VALUES (?, ?, ?)", slotTime, end, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db, err = InitDB(path)
+	if err != nil {
+		t.Fatalf("InitDB with duplicate slots: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	var userID sql.NullInt64
+	if err := db.QueryRow("SELECT COUNT(*), MAX(user_id) FROM slots WHERE start_time = ?", slotTime).Scan(&count, &userID); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || userID.Int64 != 7 {
+		t.Fatalf("got %d rows with user %v, want the booked row only", count, userID)
+	}
+}
+
+func TestInitDBRefusesDuplicateBookings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	db, err := InitDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slotTime := testSlotTime(11, 0)
+	end := slotTime.Add(30 * time.Minute)
+	if _, err := db.Exec("DROP INDEX idx_slots_start_time"); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []any{7, nil, 8} {
+		if _, err := db.Exec("INSERT INTO slots (start_time, end_time, user_id) VALUES (?, ?, ?)", slotTime, end, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	if _, err := InitDB(path); !errors.Is(err, ErrDuplicateBookings) {
+		t.Fatalf("InitDB with two bookings at one time: got %v, want %v", err, ErrDuplicateBookings)
+	}
+
+	// Nothing was deleted, both owners can still be contacted
+	db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM slots WHERE start_time = ?", slotTime).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("got %d rows left, want all 3", count)
+	}
+}
+
+func TestSqliteDSN(t *testing.T) {
+	tests := []struct {
+		dbFile string
+		want   string
+	}{
+		{"queue.db", "queue.db?_txlock=immediate&_busy_timeout=5000"},
+		{"file:queue.db?cache=shared", "file:queue.db?cache=shared&_txlock=immediate&_busy_timeout=5000"},
+	}
+	for _, tt := range tests {
+		if got := sqliteDSN(tt.dbFile); got != tt.want {
+			t.Errorf("sqliteDSN(%q) = %q, want %q", tt.dbFile, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSlotTime(t *testing.T) {
+	monday := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)
+	friday := time.Date(2026, 10, 23, 17, 0, 0, 0, time.Local)
+	at := func(day time.Time, hour, minute int) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name         string
+		now          time.Time
+		scheduleDays int
+		slot         time.Time
+		want         error
+	}{
+		{"next day", monday, 14, at(monday.AddDate(0, 0, 1), 10, 0), nil},
+		{"off the slot grid", monday, 14, at(monday.AddDate(0, 0, 1), 10, 15), ErrOutsideSchedule},
+		{"before working hours", monday, 14, at(monday.AddDate(0, 0, 1), 3, 0), ErrOutsideSchedule},
+		{"at the end of working hours", monday, 14, at(monday.AddDate(0, 0, 1), 18, 0), ErrOutsideSchedule},
+		{"weekend", monday, 14, at(monday.AddDate(0, 0, 6), 10, 0), ErrOutsideSchedule},
+		{"last day of the horizon", monday, 14, at(monday.AddDate(0, 0, 11), 10, 0), nil},
+		{"beyond the horizon", monday, 14, at(monday.AddDate(0, 0, 14), 10, 0), ErrOutsideSchedule},
+		{"in the past", monday, 14, at(monday, 9, 0), ErrTooLate},
+		{"inside the lead time", monday, 14, at(monday, 10, 30), ErrTooLate},
+		{"exactly at the lead time", monday, 14, at(monday, 11, 0), ErrTooLate},
+		{"after the lead time", monday, 14, at(monday, 11, 30), nil},
+		{"single-day schedule offers the next workday", friday, 1, at(friday.AddDate(0, 0, 3), 10, 0), nil},
+		{"single-day schedule stops after the next workday", friday, 1, at(friday.AddDate(0, 0, 4), 10, 0), ErrOutsideSchedule},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.SkipWeekend = true
+			config.LeadTime = 60
+			config.ScheduleDays = tt.scheduleDays
+
+			err := ValidateSlotTime(tt.slot, tt.now, nil, config)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ValidateSlotTime(%s) = %v, want %v", tt.slot.Format("Mon 02.01 15:04"), err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelledBookingKeepsCode(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	addTestUsers(t, db, 1)
+
+	slot, err := BookTimeSlot(db, testSlotTime(10, 0), 1, "user", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CancelSlot(db, slot.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if active, err := GetSlotByCode(db, slot.Code); err != nil || active != nil {
+		t.Fatalf("got active booking %+v, %v for a cancelled code", active, err)
+	}
+	cancelled, err := GetCancelledBooking(db, slot.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled == nil || !cancelled.StartTime.Equal(slot.StartTime) || cancelled.UserID.Int64 != 1 {
+		t.Fatalf("got %+v, want the cancelled booking kept by its code", cancelled)
+	}
+}
+
+func TestReleaseSlotChecksCode(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	addTestUsers(t, db, 1, 2)
+
+	// The visitor cancels and someone else books the same time before the admin's action
+	first, err := BookTimeSlot(db, testSlotTime(10, 0), 1, "first", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CancelSlot(db, first.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	second, err := BookTimeSlot(db, testSlotTime(10, 0), 2, "second", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID {
+		t.Fatalf("rebooked slot %d, want the same row %d", second.ID, first.ID)
+	}
+
+	if _, err := ReleaseSlot(db, first.ID, first.Code); !errors.Is(err, ErrBookingChanged) {
+		t.Fatalf("release of the cancelled booking: got %v, want %v", err, ErrBookingChanged)
+	}
+	if active, err := GetSlotByCode(db, second.Code); err != nil || active == nil {
+		t.Fatalf("got %+v, %v: want the new booking kept", active, err)
+	}
+
+	userID, err := ReleaseSlot(db, second.ID, second.Code)
+	if err != nil || userID != 2 {
+		t.Fatalf("got user %d, %v, want the new booking of user 2 released", userID, err)
+	}
+}
+
+// addLegacyBooking adds a booking the way versions before booking statuses stored it
+func addLegacyBooking(t *testing.T, db *sql.DB, slotTime time.Time, userID int64) int {
+	t.Helper()
+	result, err := db.Exec("INSERT INTO slots (start_time, end_time, user_id, username, code) VALUES (?, ?, ?, 'user', ?)",
+		slotTime, slotTime.Add(30*time.Minute), userID, fmt.Sprintf("L%05d", userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+func TestRescheduleLegacyBooking(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	addTestUsers(t, db, 1)
+	slotID := addLegacyBooking(t, db, testSlotTime(10, 0), 1)
+
+	slot, err := RescheduleSlot(db, slotID, testSlotTime(11, 0), 1, config)
+	if err != nil {
+		t.Fatalf("RescheduleSlot of a booking without status: %v", err)
+	}
+	if !slot.StartTime.Equal(testSlotTime(11, 0)) || slot.Code != "L00001" {
+		t.Fatalf("got booking at %v with code %q, want it moved keeping the code", slot.StartTime, slot.Code)
+	}
+}
+
+func TestRescheduleMovesOnlyTheBookingsDeposit(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	addTestUsers(t, db, 1, 2)
+
+	slot, err := BookTimeSlot(db, testSlotTime(10, 0), 1, "user", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deposits of earlier bookings of the slot and the current booking's own
+	payments := []struct {
+		userID int64
+		code   string
+		status string
+	}{
+		{2, "OLD001", PaymentStatusRefunded},
+		{2, "OLD002", PaymentStatusForfeited},
+		{1, slot.Code, PaymentStatusPaid},
+	}
+	for _, p := range payments {
+		_, err := db.Exec(`
+			INSERT INTO payments (slot_id, user_id, code, amount, currency, telegram_charge_id, status)
+			VALUES (?, ?, ?, 50000, 'RUB', ?, ?)
+		`, slot.ID, p.userID, p.code, "tg-"+p.code, p.status)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := RescheduleSlot(db, slot.ID, testSlotTime(11, 0), 1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range payments {
+		want := slot.ID
+		if p.code == slot.Code {
+			want = moved.ID
+		}
+		var slotID int
+		if err := db.QueryRow("SELECT slot_id FROM payments WHERE code = ?", p.code).Scan(&slotID); err != nil {
+			t.Fatal(err)
+		}
+		if slotID != want {
+			t.Fatalf("payment %s is on slot %d, want %d", p.code, slotID, want)
+		}
+	}
+}
+
+func TestVisitReasonInAgendaAfterReschedule(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	addTestUsers(t, db, 1)
+
+	slot, err := BookTimeSlot(db, testSlotTime(10, 0), 1, "user", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetVisitReason(db, slot.ID, 1, "Документы"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RescheduleSlot(db, slot.ID, testSlotTime(11, 0), 1, config); err != nil {
+		t.Fatal(err)
+	}
+
+	bookings, err := GetAgendaBookings(db, testSlotTime(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookings) != 1 || bookings[0].Service != "Документы" {
+		t.Fatalf("got agenda %+v, want the moved booking with its visit reason", bookings)
+	}
+}
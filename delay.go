@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxDelayMinutes caps a declared delay to catch typos
+const maxDelayMinutes = 600
+
+// SetScheduleDelay declares how far behind schedule today's appointments run, 0 clears it
+func SetScheduleDelay(db *sql.DB, now time.Time, minutes int, operatorID int64) error {
+	query := `
+		INSERT INTO delays (queue_date, minutes, operator_id, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (queue_date) DO UPDATE SET minutes = excluded.minutes, operator_id = excluded.operator_id, updated_at = excluded.updated_at
+	`
+
+	_, err := db.Exec(query, now.Format(queueDateLayout), minutes, operatorID, now)
+	return err
+}
+
+// GetScheduleDelay returns the delay declared for the day of now
+func GetScheduleDelay(db *sql.DB, now time.Time) (time.Duration, error) {
+	var minutes int
+	err := db.QueryRow("SELECT minutes FROM delays WHERE queue_date = ?", now.Format(queueDateLayout)).Scan(&minutes)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return time.Duration(minutes) * time.Minute, err
+}
+
+// GetDelayedBookings returns today's confirmed bookings that, with the delay, haven't started yet
+func GetDelayedBookings(db *sql.DB, now time.Time, delay time.Duration) ([]Slot, error) {
+	dayEnd := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).AddDate(0, 0, 1)
+
+	query := `
+		SELECT id, start_time, end_time, user_id, username, COALESCE(code, ''), COALESCE(status, 'booked'), hold_until, created_at
+		FROM slots
+		WHERE user_id IS NOT NULL AND COALESCE(status, 'booked') IN (?, ?) AND start_time > ? AND start_time < ?
+		ORDER BY start_time
+	`
+
+	rows, err := db.Query(query, SlotStatusBooked, SlotStatusArrived, now.Add(-delay), dayEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var slots []Slot
+	for rows.Next() {
+		var slot Slot
+		if err := rows.Scan(&slot.ID, &slot.StartTime, &slot.EndTime, &slot.UserID, &slot.Username, &slot.Code, &slot.Status, &slot.HoldUntil, &slot.CreatedAt); err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+
+	return slots, rows.Err()
+}
+
+// Handlers
+
+func handleLate(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+	operatorID := update.Message.From.ID
+
+	if !IsOperator(app.config, operatorID) {
+		return app.sendMessage(chatID, "У вас нет прав оператора")
+	}
+
+	now := time.Now()
+	previous, err := GetScheduleDelay(app.db, now)
+	if err != nil {
+		log.Printf("Error getting schedule delay: %v", err)
+		return app.sendMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+	}
+
+	minutes, err := strconv.Atoi(update.Message.CommandArguments())
+	if err != nil || minutes < 0 || minutes > maxDelayMinutes {
+		current := "приём идёт по расписанию"
+		if previous > 0 {
+			current = fmt.Sprintf("задержка %d мин.", int(previous.Minutes()))
+		}
+		return app.sendMessage(chatID, fmt.Sprintf("Сейчас %s.\n\nУкажите задержку в минутах: /late МИНУТЫ (/late 0 - снять задержку)", current))
+	}
+
+	delay := time.Duration(minutes) * time.Minute
+	if delay == previous {
+		return app.sendMessage(chatID, "Задержка не изменилась.")
+	}
+
+	if err := SetScheduleDelay(app.db, now, minutes, operatorID); err != nil {
+		log.Printf("Error setting schedule delay: %v", err)
+		return app.sendMessage(chatID, "Не удалось сохранить задержку.")
+	}
+	log.Printf("Operator %d declared a %d min delay", operatorID, minutes)
+
+	// Bookings affected by either the old or the new delay
+	bookings, err := GetDelayedBookings(app.db, now, max(delay, previous))
+	if err != nil {
+		log.Printf("Error getting delayed bookings: %v", err)
+		return app.sendMessage(chatID, "Задержка сохранена, но уведомить посетителей не удалось.")
+	}
+
+	notified := 0
+	for i := range bookings {
+		if err := app.notifyDelay(&bookings[i], delay); err != nil {
+			log.Printf("Error notifying user %d about the delay: %v", bookings[i].UserID.Int64, err)
+			continue
+		}
+		notified++
+	}
+
+	if delay == 0 {
+		return app.sendMessage(chatID, fmt.Sprintf("✅ Задержка снята. Уведомлено посетителей: %d", notified))
+	}
+	return app.sendMessage(chatID, fmt.Sprintf("⏰ Задержка %d мин. Уведомлено посетителей: %d", minutes, notified))
+}
+
+// notifyDelay tells the visitor their expected appointment time and offers to reschedule
+func (app *App) notifyDelay(slot *Slot, delay time.Duration) error {
+	if delay == 0 {
+		return app.sendMessage(slot.UserID.Int64, fmt.Sprintf("✅ Приём снова идёт по расписанию. Ваша запись: <b>%s</b>", slot.StartTime.Format("15:04")))
+	}
+
+	message := fmt.Sprintf(`⏰ Приём задерживается примерно на %d мин.
+
+Ваша запись: %s
+Ожидаемое время приёма: <b>%s</b>`, int(delay.Minutes()), slot.StartTime.Format("15:04"), slot.StartTime.Add(delay).Format("15:04"))
+
+	msg := tgbotapi.NewMessage(slot.UserID.Int64, message)
+	msg.ParseMode = "HTML"
+
+	// Visitors already at the venue keep their place
+	if slot.Status == SlotStatusBooked {
+		msg.Text += "\n\nЕсли время вам неудобно, запись можно перенести."
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Перенести запись", app.callbacks.Encode(cbReschedule, strconv.Itoa(slot.ID))),
+		))
+	}
+
+	return app.queueMessage(msg)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestGetDelayedBookings(t *testing.T) {
+	db := newTestDB(t)
+	addTestUsers(t, db, 1, 2, 3, 4, 5)
+	now := testSlotTime(12, 0)
+	addLegacyBooking(t, db, testSlotTime(11, 0), 1)
+	addLegacyBooking(t, db, testSlotTime(11, 30), 2)
+	addLegacyBooking(t, db, testSlotTime(12, 0), 3)
+	addLegacyBooking(t, db, testSlotTime(17, 30), 4)
+	addLegacyBooking(t, db, testSlotTime(10, 0).AddDate(0, 0, 1), 5) // Tomorrow
+
+	tests := []struct {
+		name  string
+		delay time.Duration
+		users []int64
+	}{
+		{"on schedule", 0, []int64{4}},
+		{"half an hour late", 30 * time.Minute, []int64{3, 4}},
+		{"longer delay", time.Hour, []int64{2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slots, err := GetDelayedBookings(db, now, tt.delay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var users []int64
+			for _, slot := range slots {
+				users = append(users, slot.UserID.Int64)
+			}
+			if len(users) != len(tt.users) {
+				t.Fatalf("got bookings of users %v, want %v", users, tt.users)
+			}
+			for i := range users {
+				if users[i] != tt.users[i] {
+					t.Fatalf("got bookings of users %v, want %v", users, tt.users)
+				}
+			}
+		})
+	}
+}
+
+func TestSetScheduleDelayOverwritesTheDay(t *testing.T) {
+	db := newTestDB(t)
+	today := testSlotTime(10, 0)
+
+	steps := []struct {
+		at      time.Time
+		minutes int
+	}{
+		{today, 20},
+		{today.Add(time.Hour), 45},
+		{today.Add(2 * time.Hour), 0},
+	}
+	for _, step := range steps {
+		if err := SetScheduleDelay(db, step.at, step.minutes, 1); err != nil {
+			t.Fatal(err)
+		}
+		delay, err := GetScheduleDelay(db, today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delay != time.Duration(step.minutes)*time.Minute {
+			t.Fatalf("got delay %v, want %d min", delay, step.minutes)
+		}
+	}
+
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM delays").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("got %d delay rows for one day, want 1", rows)
+	}
+
+	// Other days keep running on schedule
+	if delay, err := GetScheduleDelay(db, today.AddDate(0, 0, 1)); err != nil || delay != 0 {
+		t.Fatalf("got delay %v (%v) for the next day, want none", delay, err)
+	}
+}
+
+func TestLateZeroClearsTheDelay(t *testing.T) {
+	app := newTestApp(t, &Config{OperatorIDs: []int64{100}})
+	addTestUsers(t, app.db, 1)
+
+	// The booking started twenty minutes ago, the visitor was told to come later
+	now := time.Now()
+	started := now.Add(-20 * time.Minute)
+	if started.Day() != now.Day() {
+		started = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	}
+	addLegacyBooking(t, app.db, started, 1)
+	if err := SetScheduleDelay(app.db, now, 60, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	err := handleLate(app, &tgbotapi.Update{Message: &tgbotapi.Message{
+		From:     &tgbotapi.User{ID: 100},
+		Chat:     &tgbotapi.Chat{ID: 100},
+		Text:     "/late 0",
+		Entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 5}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delay, err := GetScheduleDelay(app.db, time.Now()); err != nil || delay != 0 {
+		t.Fatalf("got delay %v (%v), want it cleared", delay, err)
+	}
+	messages := outboxTexts(t, app, 1)
+	if len(messages) != 1 || !strings.Contains(messages[0], "по расписанию") {
+		t.Fatalf("visitor got %q, want told the schedule is back", messages)
+	}
+	if replies := outboxTexts(t, app, 100); len(replies) != 1 || !strings.Contains(replies[0], "Уведомлено посетителей: 1") {
+		t.Fatalf("operator got %q, want one visitor notified", replies)
+	}
+}
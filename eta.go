@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// serviceTimeSample is how many recent visits the average service time of a stage is based on
+const serviceTimeSample = 50
+
+// QueueEstimate is the expected wait for a ticket
+type QueueEstimate struct {
+	Ahead int           // Waiting tickets ahead
+	Wait  time.Duration // Expected time until the ticket is called
+}
+
+// AverageServiceTimes returns the mean service time of recent visits at each route stage,
+// measured from start (or call, if not started) to finish. Stages without data use the slot duration.
+func AverageServiceTimes(db *sql.DB, config *Config) (func(stage int) time.Duration, error) {
+	query := `
+		SELECT stage, started_at, finished_at FROM ticket_stages
+		UNION ALL
+		SELECT COALESCE(stage, 0), COALESCE(started_at, called_at), served_at
+		FROM tickets
+		WHERE status = ? AND called_at IS NOT NULL AND served_at IS NOT NULL
+		ORDER BY 3 DESC
+		LIMIT ?
+	`
+
+	rows, err := db.Query(query, TicketStatusServed, serviceTimeSample*max(len(config.Route), 1))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[int]time.Duration)
+	counts := make(map[int]int)
+	for rows.Next() {
+		var stage int
+		var startedAt, finishedAt time.Time
+		if err := rows.Scan(&stage, &startedAt, &finishedAt); err != nil {
+			return nil, err
+		}
+		duration := finishedAt.Sub(startedAt)
+		if counts[stage] >= serviceTimeSample || duration < 0 {
+			continue
+		}
+		totals[stage] += duration
+		counts[stage]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return func(stage int) time.Duration {
+		if counts[stage] == 0 {
+			return time.Duration(config.SlotDuration) * time.Minute
+		}
+		return totals[stage] / time.Duration(counts[stage])
+	}, nil
+}
+
+// ActiveCounters returns how many counters of each route stage called tickets during the last hour.
+// A ticket moved on along the route leaves its counter, so finished stages are counted too.
+func ActiveCounters(db *sql.DB, config *Config) (map[int]int, error) {
+	now := time.Now()
+	query := `
+		SELECT counter
+		FROM tickets
+		WHERE queue_date = ? AND called_at >= ? AND counter IS NOT NULL
+		UNION
+		SELECT counter
+		FROM ticket_stages
+		WHERE finished_at >= ? AND counter IS NOT NULL
+	`
+
+	rows, err := db.Query(query, now.Format(queueDateLayout), now.Add(-time.Hour), now.Add(-time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counters := make(map[int]int)
+	for rows.Next() {
+		var counter int
+		if err := rows.Scan(&counter); err != nil {
+			return nil, err
+		}
+		counters[StageOfCounter(config, counter)]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counters, nil
+}
+
+// EstimateQueue returns the expected wait for every waiting ticket by ID
+func EstimateQueue(db *sql.DB, config *Config) (map[int64]QueueEstimate, []Ticket, error) {
+	tickets, err := GetWaitingTickets(db, time.Now(), config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serviceTime, err := AverageServiceTimes(db, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	counters, err := ActiveCounters(db, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Every route stage has its own queue
+	ahead := make(map[int]int)
+	estimates := make(map[int64]QueueEstimate, len(tickets))
+	for _, ticket := range tickets {
+		i := ahead[ticket.Stage]
+		estimates[ticket.ID] = QueueEstimate{
+			Ahead: i,
+			Wait:  time.Duration(i) * serviceTime(ticket.Stage) / time.Duration(max(counters[ticket.Stage], 1)),
+		}
+		ahead[ticket.Stage]++
+	}
+
+	return estimates, tickets, nil
+}
+
+// markTicketNotified records that the visitor was told their turn is near
+func markTicketNotified(db *sql.DB, ticketID int64) error {
+	_, err := db.Exec("UPDATE tickets SET notified_at = ? WHERE id = ?", time.Now(), ticketID)
+	return err
+}
+
+// formatWait formats an expected wait for messages
+func formatWait(wait time.Duration) string {
+	minutes := int(wait.Round(time.Minute).Minutes())
+	if minutes < 1 {
+		return "меньше минуты"
+	}
+	return fmt.Sprintf("около %d мин.", minutes)
+}
+
+// notifyApproachingTickets messages visitors whose turn is close.
+// Called whenever the queue moves; each ticket is notified once.
+func (app *App) notifyApproachingTickets() {
+	estimates, tickets, err := EstimateQueue(app.db, app.config)
+	if err != nil {
+		log.Printf("Error estimating queue: %v", err)
+		return
+	}
+
+	positions := app.config.QueueNotifyPositions
+	wait := time.Duration(app.config.QueueNotifyMinutes) * time.Minute
+
+	for _, ticket := range tickets {
+		estimate := estimates[ticket.ID]
+		if !ticket.UserID.Valid || ticket.NotifiedAt.Valid {
+			continue
+		}
+		if estimate.Ahead >= positions && estimate.Wait > wait {
+			continue
+		}
+
+		message := fmt.Sprintf(`⏰ Скоро ваша очередь!
+
+🎫 Талон <b>%s</b>
+Перед вами: %d
+Ожидание: %s
+
+Пожалуйста, вернитесь в зал ожидания.`, ticket.Label(), estimate.Ahead, formatWait(estimate.Wait))
+
+		if err := app.sendMessage(ticket.UserID.Int64, message); err != nil {
+			log.Printf("Error notifying ticket %s: %v", ticket.Label(), err)
+			continue
+		}
+		if err := markTicketNotified(app.db, ticket.ID); err != nil {
+			log.Printf("Error marking ticket %s notified: %v", ticket.Label(), err)
+		}
+	}
+}
+
+// Handlers
+
+func handlePosition(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+
+	ticket, err := GetUserTicket(app.db, update.Message.From.ID)
+	if err != nil {
+		log.Printf("Error getting user ticket: %v", err)
+		return app.sendMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+	}
+	if ticket == nil {
+		return app.sendMessage(chatID, "Вы не стоите в очереди. Встать в очередь: /queue")
+	}
+
+	return app.sendTicketStatus(chatID, ticket)
+}
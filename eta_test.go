@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// addServedTicket records a finished visit at the counter that took the given time
+func addServedTicket(t *testing.T, db *sql.DB, number, counter int, took time.Duration) {
+	t.Helper()
+	now := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO tickets (queue_date, prefix, number, status, issued_at, called_at, served_at, counter, operator_id)
+		VALUES (?, 'S', ?, ?, ?, ?, ?, ?, 7)
+	`, now.Format(queueDateLayout), number, TicketStatusServed, now.Add(-time.Hour), now.Add(-took), now, counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEstimateQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		served   []time.Duration // Visits finished at counters 1, 2, ...
+		waiting  int
+		wantWait []time.Duration
+	}{
+		{"slot duration without data", nil, 3, []time.Duration{0, 30 * time.Minute, time.Hour}},
+		{"average of recent visits", []time.Duration{10 * time.Minute}, 3, []time.Duration{0, 10 * time.Minute, 20 * time.Minute}},
+		{"shared by active counters", []time.Duration{10 * time.Minute, 20 * time.Minute}, 3, []time.Duration{0, 7*time.Minute + 30*time.Second, 15 * time.Minute}},
+		{"empty queue", []time.Duration{10 * time.Minute}, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			for i, took := range tt.served {
+				addServedTicket(t, db, i+1, i+1, took)
+			}
+			addWaitingTickets(t, db, tt.waiting)
+
+			estimates, tickets, err := EstimateQueue(db, newTestConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tickets) != len(tt.wantWait) || len(estimates) != len(tt.wantWait) {
+				t.Fatalf("got %d tickets and %d estimates, want %d", len(tickets), len(estimates), len(tt.wantWait))
+			}
+			for i, ticket := range tickets {
+				estimate := estimates[ticket.ID]
+				if estimate.Ahead != i || estimate.Wait.Round(time.Second) != tt.wantWait[i] {
+					t.Fatalf("ticket %s: got %d ahead, wait %v, want %d ahead, wait %v", ticket.Label(), estimate.Ahead, estimate.Wait, i, tt.wantWait[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyApproachingTickets(t *testing.T) {
+	// With no service data every visit takes the 30 minute slot at one counter,
+	// so the tickets wait 0, 30, 60 and 90 minutes
+	tests := []struct {
+		name      string
+		positions int
+		minutes   int
+		want      []bool
+	}{
+		{"by position", 2, 10, []bool{true, true, false, false}},
+		{"by wait", 1, 60, []bool{true, true, true, false}},
+		{"wait over the threshold", 1, 29, []bool{true, false, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.QueueNotifyPositions = tt.positions
+			config.QueueNotifyMinutes = tt.minutes
+			app := newTestApp(t, config)
+			addWaitingTickets(t, app.db, len(tt.want))
+			if _, err := app.db.Exec("UPDATE tickets SET user_id = 100 + id"); err != nil {
+				t.Fatal(err)
+			}
+
+			app.notifyApproachingTickets()
+
+			notified := ticketsNotifiedAt(t, app.db)
+			for i, want := range tt.want {
+				if notified[i].Valid != want {
+					t.Fatalf("ticket %d notified: %v, want %v", i+1, notified[i].Valid, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyApproachingTicketsOnce(t *testing.T) {
+	config := newTestConfig()
+	config.QueueNotifyPositions = 2
+	app := newTestApp(t, config)
+	addWaitingTickets(t, app.db, 3)
+
+	// The first ticket is a kiosk ticket without a chat to notify
+	if _, err := app.db.Exec("UPDATE tickets SET user_id = 100 + id WHERE number > 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	app.notifyApproachingTickets()
+	first := ticketsNotifiedAt(t, app.db)
+	if first[0].Valid || !first[1].Valid || first[2].Valid {
+		t.Fatalf("got notified %v, want only the second ticket", first)
+	}
+
+	// The queue moves: the third ticket is now close, the second one isn't told again
+	if _, err := app.db.Exec("UPDATE tickets SET status = ? WHERE number = 1", TicketStatusServed); err != nil {
+		t.Fatal(err)
+	}
+	app.notifyApproachingTickets()
+	second := ticketsNotifiedAt(t, app.db)
+	if !second[1].Time.Equal(first[1].Time) {
+		t.Fatalf("second ticket notified again at %v, first at %v", second[1].Time, first[1].Time)
+	}
+	if !second[2].Valid {
+		t.Fatal("third ticket not notified when its turn came close")
+	}
+}
+
+// ticketsNotifiedAt returns when each ticket was notified, in the order of issue
+func ticketsNotifiedAt(t *testing.T, db *sql.DB) []sql.NullTime {
+	t.Helper()
+	rows, err := db.Query("SELECT notified_at FROM tickets ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var notified []sql.NullTime
+	for rows.Next() {
+		var at sql.NullTime
+		if err := rows.Scan(&at); err != nil {
+			t.Fatal(err)
+		}
+		notified = append(notified, at)
+	}
+	return notified
+}
+
+func TestAverageServiceTimesPerStage(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	route, err := ParseRoute("Регистрация:1;Специалист:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Route = route
+
+	// Called 20 minutes ago, but the visitor reached the counter only 4 minutes ago
+	now := time.Now()
+	result, err := db.Exec(`
+		INSERT INTO tickets (queue_date, prefix, number, status, issued_at, called_at, started_at, counter, operator_id, stage)
+		VALUES (?, 'A', 1, ?, ?, ?, ?, 1, 7, 0)
+	`, now.Format(queueDateLayout), TicketStatusCalled, now.Add(-30*time.Minute), now.Add(-20*time.Minute), now.Add(-4*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticketID, _ := result.LastInsertId()
+
+	ticket, err := FinishTicket(db, ticketID, 7, TicketStatusServed, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Stage != 1 {
+		t.Fatalf("got stage %d, want the ticket moved to the second stage", ticket.Stage)
+	}
+
+	serviceTime, err := AverageServiceTimes(db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serviceTime(0); got < 3*time.Minute || got > 5*time.Minute {
+		t.Fatalf("got %v for the first stage, want about 4 minutes from start to finish", got)
+	}
+	if got := serviceTime(1); got != 30*time.Minute {
+		t.Fatalf("got %v for the second stage without data, want the slot duration", got)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GroupRule describes booking privileges of a user group
+type GroupRule struct {
+	Name           string
+	ReservePercent int // Share of each day's slots reserved for the group
+	EarlyDays      int // Extra days the group can book beyond SCHEDULE_DAYS
+	ReleaseHours   int // Reserved slots open to everyone this many hours before start, 0 keeps them reserved
+}
+
+// ParseGroupRules parses rules like "pensioner:reserve=20,early=7,release=24;corporate:early=14"
+func ParseGroupRules(value string) ([]GroupRule, error) {
+	var rules []GroupRule
+	totalReserve := 0
+
+	for _, ruleStr := range strings.Split(value, ";") {
+		ruleStr = strings.TrimSpace(ruleStr)
+		if ruleStr == "" {
+			continue
+		}
+
+		name, params, _ := strings.Cut(ruleStr, ":")
+		rule := GroupRule{Name: strings.TrimSpace(name)}
+		if rule.Name == "" {
+			return nil, fmt.Errorf("group rule %q has no group name", ruleStr)
+		}
+
+		for _, param := range strings.Split(params, ",") {
+			if strings.TrimSpace(param) == "" {
+				continue
+			}
+			key, valueStr, _ := strings.Cut(param, "=")
+			n, err := strconv.Atoi(strings.TrimSpace(valueStr))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("group rule %q: invalid value for %s", ruleStr, key)
+			}
+			switch strings.TrimSpace(key) {
+			case "reserve":
+				rule.ReservePercent = n
+			case "early":
+				rule.EarlyDays = n
+			case "release":
+				rule.ReleaseHours = n
+			default:
+				return nil, fmt.Errorf("group rule %q: unknown parameter %s", ruleStr, key)
+			}
+		}
+
+		totalReserve += rule.ReservePercent
+		rules = append(rules, rule)
+	}
+
+	if totalReserve > 100 {
+		return nil, fmt.Errorf("groups reserve %d%% of slots in total", totalReserve)
+	}
+
+	// Stable order keeps reserved slot positions the same across restarts
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+	return rules, nil
+}
+
+// ExtraBookingDays returns how many days earlier than everyone else the groups may book
+func ExtraBookingDays(groups []string, config *Config) int {
+	extra := 0
+	for _, rule := range config.GroupRules {
+		if hasGroup(groups, rule.Name) && rule.EarlyDays > extra {
+			extra = rule.EarlyDays
+		}
+	}
+	return extra
+}
+
+// ReservedSlots maps slot start (unix seconds) to the group it is reserved for.
+// Each group gets its share of the day spread evenly over the day.
+func ReservedSlots(slots []time.Time, config *Config) map[int64]GroupRule {
+	reserved := make(map[int64]GroupRule)
+	free := append([]time.Time(nil), slots...)
+
+	for _, rule := range config.GroupRules {
+		count := (len(slots)*rule.ReservePercent + 99) / 100
+		if count == 0 || len(free) == 0 {
+			continue
+		}
+		if count > len(free) {
+			count = len(free)
+		}
+
+		step := float64(len(free)) / float64(count)
+		var picked []int
+		for i := 0; i < count; i++ {
+			picked = append(picked, int(step*float64(i)+step/2))
+		}
+
+		// Remove picked slots from the free list, last index first
+		for i := len(picked) - 1; i >= 0; i-- {
+			idx := picked[i]
+			reserved[free[idx].Unix()] = rule
+			free = append(free[:idx], free[idx+1:]...)
+		}
+	}
+
+	return reserved
+}
+
+// isSlotOpenForGroups checks whether a reserved slot may be booked by a user with the given groups
+func isSlotOpenForGroups(slot time.Time, reserved map[int64]GroupRule, groups []string, now time.Time) bool {
+	rule, ok := reserved[slot.Unix()]
+	if !ok || hasGroup(groups, rule.Name) {
+		return true
+	}
+	return rule.ReleaseHours > 0 && slot.Sub(now) <= time.Duration(rule.ReleaseHours)*time.Hour
+}
+
+// hasGroup checks if the group is in the list
+func hasGroup(groups []string, name string) bool {
+	for _, group := range groups {
+		if group == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Database functions
+
+// GetUserGroups returns the groups a user belongs to
+func GetUserGroups(db queryer, telegramID int64) ([]string, error) {
+	rows, err := db.Query("SELECT group_name FROM user_groups WHERE telegram_id = ? ORDER BY group_name", telegramID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []string
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+// AddUserGroup adds a user to a group
+func AddUserGroup(db *sql.DB, telegramID int64, group string) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO user_groups (telegram_id, group_name) VALUES (?, ?)", telegramID, group)
+	return err
+}
+
+// RemoveUserGroup removes a user from a group
+func RemoveUserGroup(db *sql.DB, telegramID int64, group string) error {
+	_, err := db.Exec("DELETE FROM user_groups WHERE telegram_id = ? AND group_name = ?", telegramID, group)
+	return err
+}
+
+// isKnownGroup checks if the group has rules configured
+func isKnownGroup(config *Config, name string) bool {
+	for _, rule := range config.GroupRules {
+		if rule.Name == name {
+			return true
+		}
+	}
+	return false
+}
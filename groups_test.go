@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseGroupRules(t *testing.T) {
+	rules, err := ParseGroupRules(" pensioner:reserve=20, early=7, release=24 ; corporate:early=14;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GroupRule{
+		{Name: "corporate", EarlyDays: 14},
+		{Name: "pensioner", ReservePercent: 20, EarlyDays: 7, ReleaseHours: 24},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Fatalf("got %+v, want %+v sorted by name", rules, want)
+	}
+
+	if rules, err := ParseGroupRules(""); err != nil || len(rules) != 0 {
+		t.Fatalf("got %+v, %v for empty GROUP_RULES, want no rules", rules, err)
+	}
+}
+
+func TestParseGroupRulesRejectsMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"missing group name", ":reserve=20"},
+		{"value is not a number", "pensioner:reserve=many"},
+		{"missing value", "pensioner:early"},
+		{"negative value", "pensioner:early=-1"},
+		{"unknown parameter", "pensioner:priority=1"},
+		{"reserve over 100 percent in total", "pensioner:reserve=60;corporate:reserve=50"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rules, err := ParseGroupRules(tt.value); err == nil {
+				t.Fatalf("ParseGroupRules(%q) = %+v, want an error", tt.value, rules)
+			}
+		})
+	}
+}
+
+func TestReservedSlots(t *testing.T) {
+	config := newTestConfig()
+	config.GroupRules = []GroupRule{
+		{Name: "corporate", ReservePercent: 10},
+		{Name: "pensioner", ReservePercent: 20},
+	}
+	slots := GenerateSlotsForDate(testSlotTime(0, 0), config)
+
+	reserved := ReservedSlots(slots, config)
+
+	// Shares are rounded up: 10% and 20% of 18 slots
+	counts := make(map[string]int)
+	for _, rule := range reserved {
+		counts[rule.Name]++
+	}
+	if counts["corporate"] != 2 || counts["pensioner"] != 4 {
+		t.Fatalf("got reserved counts %v, want corporate 2 and pensioner 4", counts)
+	}
+
+	known := make(map[int64]bool)
+	for _, slot := range slots {
+		known[slot.Unix()] = true
+	}
+	for start := range reserved {
+		if !known[start] {
+			t.Fatalf("reserved %s is not a slot of the day", time.Unix(start, 0).Format("15:04"))
+		}
+	}
+
+	// The same slots are picked every time
+	if again := ReservedSlots(slots, config); !reflect.DeepEqual(again, reserved) {
+		t.Fatal("reserved slots changed between calls")
+	}
+}
+
+func TestIsSlotOpenForGroups(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)
+	slot := now.Add(48 * time.Hour)
+	reserved := map[int64]GroupRule{
+		slot.Unix(): {Name: "pensioner", ReservePercent: 20, ReleaseHours: 24},
+	}
+	kept := map[int64]GroupRule{
+		slot.Unix(): {Name: "pensioner", ReservePercent: 20},
+	}
+
+	tests := []struct {
+		name     string
+		slot     time.Time
+		reserved map[int64]GroupRule
+		groups   []string
+		now      time.Time
+		want     bool
+	}{
+		{"unreserved slot", slot.Add(time.Hour), reserved, nil, now, true},
+		{"member of the group", slot, reserved, []string{"corporate", "pensioner"}, now, true},
+		{"non-member before release", slot, reserved, []string{"corporate"}, now, false},
+		{"non-member at release", slot, reserved, nil, slot.Add(-24 * time.Hour), true},
+		{"non-member inside the release window", slot, reserved, nil, slot.Add(-time.Hour), true},
+		{"non-member when the slot is never released", slot, kept, nil, slot.Add(-time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSlotOpenForGroups(tt.slot, tt.reserved, tt.groups, tt.now); got != tt.want {
+				t.Fatalf("isSlotOpenForGroups = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReservedSlotsHiddenFromNonMembers(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	config.GroupRules = []GroupRule{{Name: "pensioner", ReservePercent: 20}}
+	addTestUsers(t, db, 1, 2)
+	if err := AddUserGroup(db, 1, "pensioner"); err != nil {
+		t.Fatal(err)
+	}
+
+	day := testSlotTime(0, 0)
+	reserved := ReservedSlots(GenerateSlotsForDate(day, config), config)
+
+	memberSlots, err := GetAvailableSlotsForDate(db, day, 1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSlots, err := GetAvailableSlotsForDate(db, day, 2, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(memberSlots)-len(otherSlots) != len(reserved) {
+		t.Fatalf("member sees %d slots, others %d, want the %d reserved ones hidden from others",
+			len(memberSlots), len(otherSlots), len(reserved))
+	}
+	for _, slot := range otherSlots {
+		if _, ok := reserved[slot.Unix()]; ok {
+			t.Fatalf("reserved slot %s offered to a non-member", slot.Format("15:04"))
+		}
+	}
+
+	var reservedSlot time.Time
+	for start := range reserved {
+		reservedSlot = time.Unix(start, 0)
+		break
+	}
+	if _, err := BookTimeSlot(db, reservedSlot, 2, "other", config); !errors.Is(err, ErrSlotReserved) {
+		t.Fatalf("non-member booking of a reserved slot: got %v, want %v", err, ErrSlotReserved)
+	}
+	if _, err := BookTimeSlot(db, reservedSlot, 1, "member", config); err != nil {
+		t.Fatalf("member booking of a reserved slot: %v", err)
+	}
+}
+
+func TestEarlyBookingWindow(t *testing.T) {
+	config := newTestConfig()
+	config.GroupRules = []GroupRule{{Name: "corporate", EarlyDays: 7}}
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)
+
+	// Beyond the common 14 days, inside the group's extra week
+	slot := time.Date(2026, 11, 4, 10, 0, 0, 0, time.Local)
+	if err := ValidateSlotTime(slot, now, []string{"corporate"}, config); err != nil {
+		t.Fatalf("group member: %v, want the early window open", err)
+	}
+	if err := ValidateSlotTime(slot, now, nil, config); !errors.Is(err, ErrOutsideSchedule) {
+		t.Fatalf("other user: got %v, want %v", err, ErrOutsideSchedule)
+	}
+
+	beyond := time.Date(2026, 11, 9, 10, 0, 0, 0, time.Local)
+	if err := ValidateSlotTime(beyond, now, []string{"corporate"}, config); !errors.Is(err, ErrOutsideSchedule) {
+		t.Fatalf("group member past the early window: got %v, want %v", err, ErrOutsideSchedule)
+	}
+}
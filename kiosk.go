@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Kiosk ticket formats
+const (
+	KioskFormatHTML   = "html"
+	KioskFormatESCPOS = "escpos"
+)
+
+// ESC/POS commands
+var (
+	escposInit        = []byte{0x1B, 0x40}             // ESC @, reset the printer
+	escposCodePage866 = []byte{0x1B, 0x74, 17}         // ESC t 17, PC866 Cyrillic
+	escposCenter      = []byte{0x1B, 0x61, 1}          // ESC a 1
+	escposNormalSize  = []byte{0x1D, 0x21, 0x00}       // GS ! 0
+	escposDoubleSize  = []byte{0x1D, 0x21, 0x11}       // GS ! double width and height
+	escposHugeSize    = []byte{0x1D, 0x21, 0x33}       // GS ! quadruple width and height
+	escposFeedCut     = []byte{0x1D, 0x56, 0x42, 0x03} // GS V B, feed 3 lines and cut
+)
+
+// kioskCookie holds the session of kiosk screens signed in through the login form
+const kioskCookie = "kiosk_session"
+
+// kioskPages are the screens the login form may return to
+var kioskPages = map[string]bool{"/kiosk": true, "/checkin/qr": true}
+
+// kioskAuthorized checks the kiosk token from the Authorization header or the session cookie.
+// The token is never taken from the URL, where it would end up in logs and browser history.
+func (app *App) kioskAuthorized(r *http.Request) bool {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(app.config.KioskToken)) == 1
+	}
+	cookie, err := r.Cookie(kioskCookie)
+	return err == nil && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(app.kioskSession())) == 1
+}
+
+// kioskSession returns the session cookie value. It is derived from the token, so the cookie
+// doesn't reveal it and changing KIOSK_TOKEN signs all screens out.
+func (app *App) kioskSession() string {
+	mac := hmac.New(sha256.New, []byte(app.config.KioskToken))
+	mac.Write([]byte("kiosk session"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// kioskLogin asks for the kiosk token on a screen that isn't signed in yet
+func (app *App) kioskLogin(w http.ResponseWriter, next string, failed bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	data := struct {
+		Title  string
+		Next   string
+		Failed bool
+	}{app.config.BoardTitle, next, failed}
+	if err := kioskLoginTemplate.Execute(w, data); err != nil {
+		log.Printf("Error rendering kiosk login: %v", err)
+	}
+}
+
+// KioskTicket is what gets printed on a kiosk ticket
+type KioskTicket struct {
+	Title    string
+	Label    string
+	IssuedAt time.Time
+	Ahead    int
+	Wait     string
+}
+
+// ESCPOS renders the ticket for a thermal receipt printer
+func (t *KioskTicket) ESCPOS() []byte {
+	var buf bytes.Buffer
+	buf.Write(escposInit)
+	buf.Write(escposCodePage866)
+	buf.Write(escposCenter)
+
+	buf.Write(encodeCP866(t.Title + "\n\n"))
+	buf.Write(encodeCP866("Ваш талон\n"))
+	buf.Write(escposHugeSize)
+	buf.Write(encodeCP866(t.Label + "\n"))
+	buf.Write(escposNormalSize)
+	buf.WriteString("\n")
+	buf.Write(escposDoubleSize)
+	buf.Write(encodeCP866(fmt.Sprintf("Перед вами: %d\n", t.Ahead)))
+	buf.Write(escposNormalSize)
+	buf.Write(encodeCP866(fmt.Sprintf("Ожидание: %s\n\n", t.Wait)))
+	buf.Write(encodeCP866(t.IssuedAt.Format("02.01.2006 15:04") + "\n"))
+	buf.Write(encodeCP866("Следите за табло\n"))
+	buf.Write(escposFeedCut)
+
+	return buf.Bytes()
+}
+
+// encodeCP866 converts text to code page 866 understood by most thermal printers,
+// characters outside it become '?'
+func encodeCP866(s string) []byte {
+	result := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < 0x80:
+			result = append(result, byte(r))
+		case r >= 'А' && r <= 'п':
+			result = append(result, byte(0x80+r-'А'))
+		case r >= 'р' && r <= 'я':
+			result = append(result, byte(0xE0+r-'р'))
+		case r == 'Ё':
+			result = append(result, 0xF0)
+		case r == 'ё':
+			result = append(result, 0xF1)
+		case r == '№':
+			result = append(result, 0xFC)
+		default:
+			result = append(result, '?')
+		}
+	}
+	return result
+}
+
+// issueKioskTicket issues a walk-in ticket without Telegram and estimates its wait
+func (app *App) issueKioskTicket() (*KioskTicket, error) {
+	ticket, err := IssueTicket(app.db, 0, app.config)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Issued kiosk ticket %s", ticket.Label())
+	app.queueChanged(QueueEvent{Type: QueueEventIssued, Ticket: ticket.Label()})
+
+	printed := &KioskTicket{
+		Title:    app.config.BoardTitle,
+		Label:    ticket.Label(),
+		IssuedAt: ticket.IssuedAt,
+	}
+
+	estimates, _, err := EstimateQueue(app.db, app.config)
+	if err != nil {
+		log.Printf("Error estimating queue: %v", err)
+		printed.Wait = "уточняется"
+		return printed, nil
+	}
+
+	estimate := estimates[ticket.ID]
+	printed.Ahead = estimate.Ahead
+	printed.Wait = formatWait(estimate.Wait)
+	return printed, nil
+}
+
+// Handlers
+
+// handleKiosk serves the touch screen page with the "take a ticket" button
+func (app *App) handleKiosk(w http.ResponseWriter, r *http.Request) {
+	if app.config.KioskToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !app.kioskAuthorized(r) {
+		app.kioskLogin(w, "/kiosk", false)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := kioskTemplate.Execute(w, app.config.BoardTitle); err != nil {
+		log.Printf("Error rendering kiosk: %v", err)
+	}
+}
+
+// handleKioskLogin checks the token entered on a kiosk screen and signs the screen in with a cookie
+func (app *App) handleKioskLogin(w http.ResponseWriter, r *http.Request) {
+	if app.config.KioskToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	next := r.PostFormValue("next")
+	if !kioskPages[next] {
+		next = "/kiosk"
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(app.config.KioskToken)) != 1 {
+		app.kioskLogin(w, next, true)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     kioskCookie,
+		Value:    app.kioskSession(),
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.config.WebhookURL, "https://"),
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// handleKioskTicket issues a walk-in ticket and returns it as printable HTML or an ESC/POS stream
+func (app *App) handleKioskTicket(w http.ResponseWriter, r *http.Request) {
+	if app.config.KioskToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !app.kioskAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = KioskFormatHTML
+	}
+	if format != KioskFormatHTML && format != KioskFormatESCPOS {
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		return
+	}
+
+	ticket, err := app.issueKioskTicket()
+	if errors.Is(err, ErrQueueClosed) {
+		http.Error(w, fmt.Sprintf("Живая очередь работает с %s до %s", app.config.WorkStart, app.config.WorkEnd), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error issuing kiosk ticket: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if format == KioskFormatESCPOS {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ticket.Label+".bin"))
+		w.Write(ticket.ESCPOS())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := kioskTicketTemplate.Execute(w, ticket); err != nil {
+		log.Printf("Error rendering kiosk ticket: %v", err)
+	}
+}
+
+// kioskTemplate is the kiosk start screen
+var kioskTemplate = template.Must(template.New("kiosk").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}}</title>
+<style>
+	body { margin: 0; height: 100vh; display: flex; flex-direction: column; align-items: center; justify-content: center; font-family: Arial, Helvetica, sans-serif; background: #10151f; color: #f5f7fa; }
+	h1 { font-size: 6vh; margin-bottom: 6vh; }
+	button { font-size: 5vh; padding: 4vh 8vw; border: 0; border-radius: 2vh; background: #ffcc00; color: #10151f; cursor: pointer; }
+</style>
+</head>
+<body>
+<h1>{{.}}</h1>
+<form method="post" action="/kiosk/ticket?format=html">
+	<button type="submit">Получить талон</button>
+</form>
+</body>
+</html>
+`))
+
+// kioskLoginTemplate asks for the kiosk token once, the screen then keeps a session cookie
+var kioskLoginTemplate = template.Must(template.New("kiosk-login").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+	body { margin: 0; height: 100vh; display: flex; flex-direction: column; align-items: center; justify-content: center; font-family: Arial, Helvetica, sans-serif; background: #10151f; color: #f5f7fa; }
+	input, button { font-size: 3vh; padding: 1.5vh 2vw; margin: 1vh; border: 0; border-radius: 1vh; }
+	button { background: #ffcc00; color: #10151f; cursor: pointer; }
+	.error { color: #ff6b6b; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Failed}}<p class="error">Неверный ключ</p>{{end}}
+<form method="post" action="/kiosk/login">
+	<input type="hidden" name="next" value="{{.Next}}">
+	<input type="password" name="token" placeholder="KIOSK_TOKEN" autofocus>
+	<button type="submit">Войти</button>
+</form>
+</body>
+</html>
+`))
+
+// kioskTicketTemplate is the printable ticket, sized for 80 mm receipt paper
+var kioskTicketTemplate = template.Must(template.New("kiosk-ticket").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<title>Талон {{.Label}}</title>
+<style>
+	@page { size: 80mm auto; margin: 4mm; }
+	body { width: 72mm; margin: 0 auto; font-family: Arial, Helvetica, sans-serif; text-align: center; }
+	.label { font-size: 40pt; font-weight: bold; margin: 4mm 0; }
+	.ahead { font-size: 16pt; }
+	.muted { font-size: 10pt; color: #555; }
+	@media screen { body { padding-top: 10vh; } }
+</style>
+</head>
+<body onload="window.print(); setTimeout(function () { history.back(); }, 5000);">
+<div>{{.Title}}</div>
+<div class="muted">Ваш талон</div>
+<div class="label">{{.Label}}</div>
+<div class="ahead">Перед вами: {{.Ahead}}</div>
+<div>Ожидание: {{.Wait}}</div>
+<p class="muted">{{.IssuedAt.Format "02.01.2006 15:04"}}<br>Следите за табло</p>
+</body>
+</html>
+`))
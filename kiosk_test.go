@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newKioskApp creates an app with the kiosk enabled
+func newKioskApp() *App {
+	return &App{config: &Config{KioskToken: "kiosk", BoardTitle: "Приёмная"}}
+}
+
+// kioskLoginRequest posts the login form
+func kioskLoginRequest(token, next string) *http.Request {
+	form := url.Values{"token": {token}, "next": {next}}
+	req := httptest.NewRequest(http.MethodPost, "/kiosk/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestKioskAuthorized(t *testing.T) {
+	app := newKioskApp()
+	session := &http.Cookie{Name: kioskCookie, Value: app.kioskSession()}
+
+	tests := []struct {
+		name   string
+		target string
+		auth   string
+		cookie *http.Cookie
+		want   bool
+	}{
+		{"nothing", "/kiosk", "", nil, false},
+		{"bearer token", "/kiosk", "Bearer kiosk", nil, true},
+		{"wrong bearer token", "/kiosk", "Bearer other", nil, false},
+		{"token in the URL", "/kiosk?token=kiosk", "", nil, false},
+		{"session cookie", "/kiosk", "", session, true},
+		{"cookie holding the token itself", "/kiosk", "", &http.Cookie{Name: kioskCookie, Value: "kiosk"}, false},
+		{"forged cookie", "/kiosk", "", &http.Cookie{Name: kioskCookie, Value: "forged"}, false},
+		{"wrong header wins over a valid cookie", "/kiosk", "Bearer other", session, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			if got := app.kioskAuthorized(req); got != tt.want {
+				t.Fatalf("kioskAuthorized = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Changing the token signs screens out
+	app.config.KioskToken = "rotated"
+	req := httptest.NewRequest(http.MethodGet, "/kiosk", nil)
+	req.AddCookie(session)
+	if app.kioskAuthorized(req) {
+		t.Fatal("session of the previous token accepted")
+	}
+}
+
+func TestKioskLogin(t *testing.T) {
+	app := newKioskApp()
+
+	rec := httptest.NewRecorder()
+	app.handleKioskLogin(rec, kioskLoginRequest("wrong", "/checkin/qr"))
+	if rec.Code != http.StatusUnauthorized || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("wrong token: got status %d with cookies %v, want 401 without a session", rec.Code, rec.Result().Cookies())
+	}
+
+	rec = httptest.NewRecorder()
+	app.handleKioskLogin(rec, kioskLoginRequest("kiosk", "/checkin/qr"))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/checkin/qr" {
+		t.Fatalf("got status %d to %q, want a redirect back to the page", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != kioskCookie || !cookies[0].HttpOnly || strings.Contains(cookies[0].Value, "kiosk") {
+		t.Fatalf("got cookies %v, want an HttpOnly session cookie without the token", cookies)
+	}
+
+	// The signed in screen opens the kiosk, and the page doesn't carry the token
+	req := httptest.NewRequest(http.MethodGet, "/kiosk", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	app.handleKiosk(rec, req)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "token=") {
+		t.Fatalf("got status %d, want the kiosk page without the token in it:\n%s", rec.Code, rec.Body.String())
+	}
+
+	// Only kiosk pages are valid targets after signing in
+	rec = httptest.NewRecorder()
+	app.handleKioskLogin(rec, kioskLoginRequest("kiosk", "https://example.com/"))
+	if location := rec.Header().Get("Location"); location != "/kiosk" {
+		t.Fatalf("got redirect to %q, want /kiosk", location)
+	}
+}
+
+func TestEncodeCP866(t *testing.T) {
+	tests := []struct {
+		text string
+		want []byte
+	}{
+		{"A-042", []byte("A-042")},
+		{"АЯ", []byte{0x80, 0x9F}},
+		{"ап", []byte{0xA0, 0xAF}},
+		{"ря", []byte{0xE0, 0xEF}},
+		{"Ёё№", []byte{0xF0, 0xF1, 0xFC}},
+		{"Талон", []byte{0x92, 0xA0, 0xAB, 0xAE, 0xAD}},
+		{"€ ✓", []byte("? ?")},
+	}
+	for _, tt := range tests {
+		if got := encodeCP866(tt.text); !bytes.Equal(got, tt.want) {
+			t.Errorf("encodeCP866(%q) = % X, want % X", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestKioskTicketESCPOS(t *testing.T) {
+	ticket := &KioskTicket{
+		Title:    "Приёмная",
+		Label:    "A-007",
+		IssuedAt: time.Date(2026, 10, 19, 9, 5, 0, 0, time.Local),
+		Ahead:    3,
+		Wait:     "~15 мин",
+	}
+	out := ticket.ESCPOS()
+
+	// Reset and switch to PC866 before any text, then feed and cut at the end
+	header := append(append(append([]byte{}, escposInit...), escposCodePage866...), escposCenter...)
+	if !bytes.HasPrefix(out, header) {
+		t.Fatalf("ticket starts with % X, want reset, code page 866 and centering", out[:len(header)])
+	}
+	if !bytes.HasSuffix(out, escposFeedCut) {
+		t.Fatal("ticket doesn't end with feed and cut")
+	}
+
+	// The label is printed huge, then the size goes back to normal
+	label := append(append(append([]byte{}, escposHugeSize...), "A-007\n"...), escposNormalSize...)
+	if !bytes.Contains(out, label) {
+		t.Fatal("label isn't printed in the huge size")
+	}
+
+	for _, text := range []string{"Приёмная\n", "Перед вами: 3\n", "Ожидание: ~15 мин\n", "19.10.2026 09:05\n"} {
+		if !bytes.Contains(out, encodeCP866(text)) {
+			t.Errorf("ticket is missing %q in CP866", text)
+		}
+	}
+	if bytes.Contains(out, []byte("Перед")) {
+		t.Error("ticket contains UTF-8 text")
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"strconv"
@@ -16,10 +18,14 @@ import (
 
 // App contains all dependencies
 type App struct {
-	bot      *tgbotapi.BotAPI
-	db       *sql.DB
-	config   *Config
-	handlers map[string]HandlerFunc
+	bot       *tgbotapi.BotAPI
+	db        *sql.DB
+	config    *Config
+	handlers  map[string]HandlerFunc
+	callbacks *CallbackCodec
+	payments  PaymentProvider
+	events    *EventHub
+	outbox    *Outbox
 }
 
 // HandlerFunc is a simple handler function type
@@ -47,12 +53,17 @@ func main() {
 
 	// Create app instance
 	app := &App{
-		bot:      bot,
-		db:       db,
-		config:   config,
-		handlers: make(map[string]HandlerFunc),
+		bot:       bot,
+		db:        db,
+		config:    config,
+		handlers:  make(map[string]HandlerFunc),
+		callbacks: NewCallbackCodec(config.CallbackSecret),
+		events:    NewEventHub(),
+		outbox:    NewOutbox(),
 	}
 
+	app.payments = app.newPaymentProvider()
+
 	// Register handlers
 	app.registerHandlers()
 
@@ -66,6 +77,24 @@ func main() {
 		log.Printf("Warning: failed to generate slots: %v", err)
 	}
 
+	// Remind about bookings made before reminders were enabled, then run due jobs in the background
+	if n, err := BackfillReminders(db, config); err != nil {
+		log.Printf("Warning: failed to schedule reminders: %v", err)
+	} else if n > 0 {
+		log.Printf("Scheduled reminders for %d existing bookings", n)
+	}
+	if err := ScheduleAgenda(db, config, time.Now()); err != nil {
+		log.Printf("Warning: failed to schedule the agenda digest: %v", err)
+	}
+	go app.runScheduler()
+
+	// Deliver messages left in the outbox by the previous run, then new ones in the background
+	if err := ResetSendingOutbox(db); err != nil {
+		log.Printf("Warning: failed to reset outbox: %v", err)
+	}
+	go app.runOutbox()
+	app.resumeBroadcasts()
+
 	// Set webhook
 	webhookURL := fmt.Sprintf("%s/webhook/%s", config.WebhookURL, bot.Token)
 	webhook, _ := tgbotapi.NewWebhook(webhookURL)
@@ -83,6 +112,16 @@ func main() {
 		w.Write([]byte("OK"))
 	})
 
+	// Waiting room display board
+	http.HandleFunc("/board", app.handleBoard)
+	http.HandleFunc("/board/events", app.handleBoardEvents)
+	http.HandleFunc("/verify", app.handleVerifyEndpoint)
+	http.HandleFunc("/kiosk", app.handleKiosk)
+	http.HandleFunc("/kiosk/ticket", app.handleKioskTicket)
+	http.HandleFunc("/kiosk/login", app.handleKioskLogin)
+	http.HandleFunc("/checkin/qr", app.handleCheckinPage)
+	http.HandleFunc("/checkin/qr.png", app.handleCheckinQR)
+
 	log.Printf("Starting server on %s", config.ServerAddress)
 	if err := http.ListenAndServe(config.ServerAddress, nil); err != nil {
 		log.Fatal("Server failed:", err)
@@ -96,7 +135,23 @@ func (app *App) registerHandlers() {
 	app.handlers["book"] = handleBook
 	app.handlers["myslots"] = handleMySlots
 	app.handlers["cancel"] = handleCancel
+	app.handlers["queue"] = handleQueue
+	app.handlers["position"] = handlePosition
+	app.handlers["checkin"] = handleCheckin
+	app.handlers["settings"] = handleSettings
+	app.handlers["checkinlink"] = handleCheckinLink
+	app.handlers["verify"] = handleVerify
+	app.handlers["visits"] = handleVisits
+	app.handlers["counter"] = handleCounter
+	app.handlers["next"] = handleNext
+	app.handlers["late"] = handleLate
+	app.handlers["today"] = handleToday
+	app.handlers["tomorrow"] = handleTomorrow
 	app.handlers["admin"] = handleAdmin
+	app.handlers["find"] = handleFind
+	app.handlers["group"] = handleGroup
+	app.handlers["broadcast"] = handleBroadcast
+	app.handlers["outbox"] = handleOutbox
 }
 
 // registerBotCommands registers commands in Telegram Bot Menu
@@ -118,6 +173,22 @@ func (app *App) registerBotCommands() error {
 			Command:     "cancel",
 			Description: "❌ Отменить запись",
 		},
+		{
+			Command:     "queue",
+			Description: "🎫 Встать в живую очередь",
+		},
+		{
+			Command:     "position",
+			Description: "⏳ Моя позиция в очереди",
+		},
+		{
+			Command:     "checkin",
+			Description: "📍 Я пришёл на приём",
+		},
+		{
+			Command:     "settings",
+			Description: "🔔 Настройки уведомлений",
+		},
 		{
 			Command:     "help",
 			Description: "❓ Справка",
@@ -167,6 +238,11 @@ func (app *App) processUpdate(update *tgbotapi.Update) error {
 		return app.handleCallbackQuery(update.CallbackQuery)
 	}
 
+	// Handle payment checkout
+	if update.PreCheckoutQuery != nil {
+		return app.handlePreCheckoutQuery(update.PreCheckoutQuery)
+	}
+
 	// Handle messages
 	if update.Message != nil {
 		if update.Message.IsCommand() {
@@ -179,9 +255,17 @@ func (app *App) processUpdate(update *tgbotapi.Update) error {
 				return app.sendMessage(update.Message.Chat.ID, "Неизвестная команда. Используйте /help")
 			}
 			return handler(app, update)
+		} else if update.Message.SuccessfulPayment != nil {
+			return app.handleSuccessfulPayment(update)
 		} else if update.Message.Contact != nil {
 			// Handle shared contact
 			return app.handleContact(update)
+		} else if update.Message.Location != nil {
+			// Handle check-in by location
+			return app.handleLocation(update)
+		} else if app.config.OpsChatID != 0 && update.Message.Chat.ID == app.config.OpsChatID {
+			// Handle staff replies in the operations group
+			return app.handleOpsReply(update)
 		} else {
 			// Handle regular text messages
 			log.Printf("Received text message: '%s' from user %d", update.Message.Text, update.Message.From.ID)
@@ -220,70 +304,156 @@ func (app *App) handleContact(update *tgbotapi.Update) error {
 
 	msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
 
-	_, err = app.bot.Send(msg)
-	return err
+	return app.queueMessage(msg)
 }
 
 // handleCallbackQuery processes callback queries
 func (app *App) handleCallbackQuery(callback *tgbotapi.CallbackQuery) error {
+	action, args, err := app.callbacks.Decode(callback.Data)
+	if err != nil {
+		log.Printf("Rejected callback data %q from user %d: %v", callback.Data, callback.From.ID, err)
+		text := "Эта кнопка устарела. Пожалуйста, повторите команду."
+		if errors.Is(err, ErrInvalidCallback) {
+			text = "Недействительная кнопка."
+		}
+		app.answerCallback(callback.ID, text, true)
+		return nil
+	}
+
 	// Answer callback to remove loading state
-	callbackConfig := tgbotapi.NewCallback(callback.ID, "")
-	app.bot.Send(callbackConfig)
+	app.answerCallback(callback.ID, "", false)
 
-	// Parse callback data
-	parts := strings.Split(callback.Data, "_")
-	if len(parts) < 2 {
+	if len(args) == 0 {
 		return nil
 	}
 
-	action := parts[0]
-
 	switch action {
-	case "date":
-		if len(parts) != 2 {
+	case cbDate:
+		return app.handleDateCallback(callback, args[0], rescheduleArg(args))
+	case cbSlot:
+		return app.handleSlotCallback(callback, args[0], rescheduleArg(args))
+	case cbCancel:
+		slotID, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil
+		}
+		return app.handleCancelCallback(callback, slotID)
+	case cbReschedule:
+		slotID, err := strconv.Atoi(args[0])
+		if err != nil {
 			return nil
 		}
-		return app.handleDateCallback(callback, parts[1])
-	case "slot":
-		if len(parts) != 3 {
+		return app.handleRescheduleCallback(callback, slotID)
+	case cbConfirm:
+		slotID, err := strconv.Atoi(args[0])
+		if err != nil {
 			return nil
 		}
-		dateTimeStr := parts[1] + "_" + parts[2]
-		return app.handleSlotCallback(callback, dateTimeStr)
-	case "cancel":
-		slotID, err := strconv.Atoi(parts[1])
+		return app.handleConfirmCallback(callback, slotID)
+	case cbWaitlist:
+		return app.handleWaitlistCallback(callback, args[0])
+	case cbOpsConfirm, cbOpsCancel, cbOpsNoShow, cbOpsMessage:
+		return app.handleOpsCallback(callback, action, args[0])
+	case cbBroadcastSend, cbBroadcastStop:
+		broadcastID, err := strconv.ParseInt(args[0], 10, 64)
 		if err != nil {
 			return nil
 		}
-		return app.handleCancelCallback(callback, slotID)
+		return app.handleBroadcastCallback(callback, action, broadcastID)
+	case cbSettings:
+		return app.handleSettingsCallback(callback, args[0])
+	case cbAdminCancel:
+		slotID, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil
+		}
+		return app.handleAdminCancelCallback(callback, slotID)
+	case cbLeaveQueue:
+		ticketID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil
+		}
+		return app.handleLeaveQueueCallback(callback, ticketID)
+	case cbTicketServed, cbTicketRecall, cbTicketSkip, cbTicketStart, cbCallNext:
+		ticketID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil
+		}
+		return app.handleTicketCallback(callback, action, ticketID)
+	case cbTicketService:
+		if len(args) != 2 {
+			return nil
+		}
+		ticketID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil
+		}
+		service, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil
+		}
+		return app.handleTicketServiceCallback(callback, ticketID, service)
+	case cbVisitReason:
+		if len(args) != 2 {
+			return nil
+		}
+		slotID, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil
+		}
+		service, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil
+		}
+		return app.handleVisitReasonCallback(callback, slotID, service)
 	}
 
 	return nil
 }
 
+// rescheduleArg returns the booking being rescheduled from date and slot callback arguments, 0 for a new booking
+func rescheduleArg(args []string) int {
+	if len(args) < 2 {
+		return 0
+	}
+	slotID, _ := strconv.Atoi(args[1])
+	return slotID
+}
+
+// bookingCallback encodes a date or slot button, carrying the booking being rescheduled if any
+func (app *App) bookingCallback(action, value string, reschedule int) string {
+	if reschedule > 0 {
+		return app.callbacks.Encode(action, value, strconv.Itoa(reschedule))
+	}
+	return app.callbacks.Encode(action, value)
+}
+
 // handleDateCallback handles date selection
-func (app *App) handleDateCallback(callback *tgbotapi.CallbackQuery, dateStr string) error {
-	date, err := time.Parse("2006-01-02", dateStr)
+func (app *App) handleDateCallback(callback *tgbotapi.CallbackQuery, dateStr string, reschedule int) error {
+	date, err := time.ParseInLocation(callbackDateLayout, dateStr, time.Local)
 	if err != nil {
 		return app.sendMessage(callback.Message.Chat.ID, "Неверный формат даты")
 	}
 
 	// Delete the date selection message
-	deleteMsg := tgbotapi.NewDeleteMessage(callback.Message.Chat.ID, callback.Message.MessageID)
-	app.bot.Send(deleteMsg)
+	app.deleteMessage(callback.Message.Chat.ID, callback.Message.MessageID)
 
 	// Show slots for selected date
-	return app.showSlotsForDate(callback.Message.Chat.ID, date)
+	return app.showSlotsForDate(callback.Message.Chat.ID, date, reschedule)
 }
 
 // handleSlotCallback handles time slot selection and booking
-func (app *App) handleSlotCallback(callback *tgbotapi.CallbackQuery, dateTimeStr string) error {
-	// Parse date and time
-	slotTime, err := time.Parse("2006-01-02_15:04", dateTimeStr)
+func (app *App) handleSlotCallback(callback *tgbotapi.CallbackQuery, dateTimeStr string, reschedule int) error {
+	// Parse date and time in the same zone the slots are generated in
+	slotTime, err := time.ParseInLocation(callbackSlotLayout, dateTimeStr, time.Local)
 	if err != nil {
 		return app.sendMessage(callback.Message.Chat.ID, "Неверный формат времени")
 	}
 
+	if reschedule > 0 {
+		return app.rescheduleBooking(callback, reschedule, slotTime)
+	}
+
 	userID := callback.From.ID
 	username := callback.From.UserName
 	if username == "" {
@@ -291,50 +461,141 @@ func (app *App) handleSlotCallback(callback *tgbotapi.CallbackQuery, dateTimeStr
 	}
 
 	// Book the slot
-	err = BookTimeSlot(app.db, slotTime, userID, username, app.config)
+	slot, err := BookTimeSlot(app.db, slotTime, userID, username, app.config)
 	if err != nil {
 		log.Printf("Error booking slot: %v", err)
-		return app.sendMessage(callback.Message.Chat.ID, fmt.Sprintf("❌ Не удалось забронировать слот: %v", err))
+		return app.sendMessage(callback.Message.Chat.ID, app.bookingErrorMessage(err, userID))
 	}
 
+	app.syncBookingCard(slot, slot.Status, "")
+
 	// Delete the slot selection message
-	deleteMsg := tgbotapi.NewDeleteMessage(callback.Message.Chat.ID, callback.Message.MessageID)
-	app.bot.Send(deleteMsg)
+	app.deleteMessage(callback.Message.Chat.ID, callback.Message.MessageID)
+
+	if slot.Status == SlotStatusAwaitingPayment {
+		return app.requestDeposit(callback.Message.Chat.ID, slot)
+	}
+
+	message := fmt.Sprintf("✅ Вы успешно записались на приём:\n📅 %s\n🔖 Код записи: <b>%s</b>", slot.StartTime.Format("02.01.2006 15:04"), slot.Code)
+	if err := app.sendMessage(callback.Message.Chat.ID, message); err != nil {
+		return err
+	}
+	app.sendBookingQR(callback.Message.Chat.ID, slot)
+	app.askVisitReason(callback.Message.Chat.ID, slot)
+	return nil
+}
 
-	message := fmt.Sprintf("✅ Вы успешно записались на приём:\n📅 %s", slotTime.Format("02.01.2006 15:04"))
-	return app.sendMessage(callback.Message.Chat.ID, message)
+// bookingErrorMessage converts a booking error into a user-facing message
+func (app *App) bookingErrorMessage(err error, userID int64) string {
+	var quotaErr *QuotaError
+	switch {
+	case errors.Is(err, ErrSlotTaken):
+		return "❌ Это время уже занято. Пожалуйста, выберите другой слот."
+	case errors.Is(err, ErrOutsideSchedule):
+		return "❌ Это время недоступно для записи."
+	case errors.As(err, &quotaErr):
+		return fmt.Sprintf("❌ Можно записываться не более %d раз в %s (учитываются все аккаунты с вашим номером телефона). Новая запись станет доступна с %s.",
+			quotaErr.Limit, quotaPeriodName(quotaErr.Period), quotaErr.ResetAt.Format("02.01.2006"))
+	case errors.Is(err, ErrSlotReserved):
+		return "❌ Это время зарезервировано для льготных категорий посетителей. Пожалуйста, выберите другой слот."
+	case errors.Is(err, ErrTooLate):
+		return "❌ На это время записаться уже нельзя. Пожалуйста, выберите более позднее время."
+	case errors.Is(err, ErrBookingNotFound):
+		return "❌ Запись не найдена или её уже нельзя перенести."
+	case errors.Is(err, ErrBookingLimit):
+		if activeSlot, _ := GetUserActiveSlot(app.db, userID); activeSlot != nil {
+			return fmt.Sprintf("❌ У вас уже есть активная запись на %s", activeSlot.StartTime.Format("02.01.2006 15:04"))
+		}
+		return "❌ У вас уже есть активная запись."
+	default:
+		return "❌ Не удалось забронировать слот. Попробуйте позже."
+	}
 }
 
 // handleCancelCallback handles slot cancellation
 func (app *App) handleCancelCallback(callback *tgbotapi.CallbackQuery, slotID int) error {
 	userID := callback.From.ID
 
-	err := CancelSlot(app.db, slotID, userID)
+	slot, err := GetSlotByID(app.db, slotID)
+	if err != nil || slot == nil {
+		return app.sendMessage(callback.Message.Chat.ID, "Не удалось отменить запись.")
+	}
+
+	err = CancelSlot(app.db, slotID, userID)
 	if err != nil {
 		return app.sendMessage(callback.Message.Chat.ID, "Не удалось отменить запись.")
 	}
 
 	// Delete the keyboard message
-	deleteMsg := tgbotapi.NewDeleteMessage(callback.Message.Chat.ID, callback.Message.MessageID)
-	app.bot.Send(deleteMsg)
+	app.deleteMessage(callback.Message.Chat.ID, callback.Message.MessageID)
 
 	// Send cancellation confirmation
 	app.sendMessage(callback.Message.Chat.ID, "❌ Запись отменена.")
+	app.offerReleasedSlot(slot.StartTime)
+	app.syncBookingCard(slot, OpsStateCancelled, "")
+
+	if err := app.refundOnCancel(slot, false); err != nil {
+		log.Printf("Error refunding slot %d: %v", slotID, err)
+	}
 
 	// Automatically show booking options
-	if app.config.ScheduleDays > 1 {
-		return app.showBookingDates(callback.Message.Chat.ID)
-	} else {
-		return app.showSlotsForDate(callback.Message.Chat.ID, time.Now())
+	return app.showBookingOptions(callback.Message.Chat.ID, 0)
+}
+
+// handleRescheduleCallback offers new times for a booking
+func (app *App) handleRescheduleCallback(callback *tgbotapi.CallbackQuery, slotID int) error {
+	slot, err := GetSlotByID(app.db, slotID)
+	if err != nil || slot == nil || slot.UserID.Int64 != callback.From.ID || slot.Status != SlotStatusBooked || !slot.StartTime.After(time.Now()) {
+		return app.sendMessage(callback.Message.Chat.ID, "❌ Запись не найдена или её уже нельзя перенести.")
 	}
+
+	return app.showBookingOptions(callback.Message.Chat.ID, slotID)
 }
 
-// sendMessage sends a message to a user
+// rescheduleBooking moves the booking to the chosen time
+func (app *App) rescheduleBooking(callback *tgbotapi.CallbackQuery, slotID int, slotTime time.Time) error {
+	chatID := callback.Message.Chat.ID
+	userID := callback.From.ID
+
+	previous, err := GetSlotByID(app.db, slotID)
+	if err != nil || previous == nil {
+		return app.sendMessage(chatID, app.bookingErrorMessage(ErrBookingNotFound, userID))
+	}
+
+	slot, err := RescheduleSlot(app.db, slotID, slotTime, userID, app.config)
+	if err != nil {
+		log.Printf("Error rescheduling slot %d: %v", slotID, err)
+		return app.sendMessage(chatID, app.bookingErrorMessage(err, userID))
+	}
+	app.offerReleasedSlot(previous.StartTime)
+	app.syncBookingCard(slot, OpsStateRescheduled, "Перенесена с "+previous.StartTime.Format("02.01.2006 15:04"))
+
+	log.Printf("User %d rescheduled booking %s to %s", userID, slot.Code, slot.StartTime.Format("02.01.2006 15:04"))
+
+	app.deleteMessage(chatID, callback.Message.MessageID)
+
+	message := fmt.Sprintf("✅ Запись перенесена:\n📅 %s\n🔖 Код записи: <b>%s</b>", slot.StartTime.Format("02.01.2006 15:04"), slot.Code)
+	if err := app.sendMessage(chatID, message); err != nil {
+		return err
+	}
+	app.sendBookingQR(chatID, slot)
+	return nil
+}
+
+// sendMessage sends a message to a user through the outbox
 func (app *App) sendMessage(chatID int64, text string) error {
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = "HTML"
-	_, err := app.bot.Send(msg)
-	return err
+	return app.queueMessage(msg)
+}
+
+// notifyAdmins sends a message to every admin
+func (app *App) notifyAdmins(text string) {
+	for _, adminID := range app.config.AdminIDs {
+		if err := app.sendMessage(adminID, text); err != nil {
+			log.Printf("Error notifying admin %d: %v", adminID, err)
+		}
+	}
 }
 
 // Handler implementations
@@ -381,8 +642,12 @@ func handleStart(app *App, update *tgbotapi.Update) error {
 		msg.ReplyMarkup = keyboard
 		msg.ParseMode = "HTML"
 
-		_, err = app.bot.Send(msg)
-		return err
+		return app.queueMessage(msg)
+	}
+
+	// Reception QR code deep link
+	if token, ok := strings.CutPrefix(update.Message.CommandArguments(), checkinStartPrefix); ok {
+		return app.handleCheckinStart(update.Message.Chat.ID, update.Message.From, token)
 	}
 
 	// User is fully registered
@@ -395,6 +660,9 @@ func handleStart(app *App, update *tgbotapi.Update) error {
 📅 /book - Записаться на приём
 📋 /myslots - Мои записи  
 ❌ /cancel - Отменить запись
+🎫 /queue - Живая очередь
+📍 /checkin - Отметить приход
+🔔 /settings - Настройки уведомлений
 ❓ /help - Справка`, user.FirstName, user.PhoneNumber)
 
 	return app.sendMessage(update.Message.Chat.ID, message)
@@ -407,6 +675,10 @@ func handleHelp(app *App, update *tgbotapi.Update) error {
 /book - Выбрать время для записи
 /myslots - Посмотреть свои записи
 /cancel - Отменить существующую запись
+/queue - Встать в живую очередь на сегодня
+/position - Позиция в очереди и время ожидания
+/checkin - Отметить приход на сегодняшнюю запись
+/settings - Напоминания, тихие часы, язык и рассылки
 /help - Показать это сообщение`
 
 	return app.sendMessage(update.Message.Chat.ID, message)
@@ -442,27 +714,39 @@ func handleBook(app *App, update *tgbotapi.Update) error {
 Хотите отменить её и записаться на другое время?`,
 			activeSlot.StartTime.Format("02.01.2006 15:04"))
 
-		cancelBtn := tgbotapi.NewInlineKeyboardButtonData("❌ Отменить запись", fmt.Sprintf("cancel_%d", activeSlot.ID))
+		cancelBtn := tgbotapi.NewInlineKeyboardButtonData("❌ Отменить запись", app.callbacks.Encode(cbCancel, strconv.Itoa(activeSlot.ID)))
 		keyboard := tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{cancelBtn})
 
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID, message)
 		msg.ReplyMarkup = keyboard
 
-		_, err = app.bot.Send(msg)
-		return err
+		return app.queueMessage(msg)
 	}
 
-	// Show dates or slots based on SCHEDULE_DAYS
-	if app.config.ScheduleDays > 1 {
-		return app.showBookingDates(update.Message.Chat.ID)
-	} else {
-		return app.showSlotsForDate(update.Message.Chat.ID, time.Now())
+	return app.showBookingOptions(update.Message.Chat.ID, 0)
+}
+
+// showBookingOptions shows dates or today's slots depending on how many days the user can book.
+// Booking happens in private chats, so the chat ID is the user's Telegram ID.
+// A non-zero reschedule is the ID of the booking the chosen time replaces.
+func (app *App) showBookingOptions(chatID int64, reschedule int) error {
+	groups, err := GetUserGroups(app.db, chatID)
+	if err != nil {
+		log.Printf("Error getting user groups: %v", err)
+		return app.sendMessage(chatID, "Произошла ошибка. Попробуйте позже.")
 	}
+
+	// Show dates or slots based on SCHEDULE_DAYS and group early access
+	days := GetBookingDays(groups, app.config)
+	if days > 1 {
+		return app.showBookingDates(chatID, days, reschedule)
+	}
+	return app.showSlotsForDate(chatID, time.Now(), reschedule)
 }
 
 // showBookingDates shows available dates for booking
-func (app *App) showBookingDates(chatID int64) error {
-	dates := GetBookingDates(app.config.ScheduleDays, app.config)
+func (app *App) showBookingDates(chatID int64, days int, reschedule int) error {
+	dates := GetBookingDates(days, app.config)
 
 	if len(dates) == 0 {
 		return app.sendMessage(chatID, "Нет доступных дат для записи")
@@ -470,8 +754,6 @@ func (app *App) showBookingDates(chatID int64) error {
 
 	var rows [][]tgbotapi.InlineKeyboardButton
 	for _, date := range dates {
-		dateStr := date.Format("2006-01-02")
-
 		// Translate day names to Russian
 		dayName := ""
 		switch date.Weekday() {
@@ -489,21 +771,24 @@ func (app *App) showBookingDates(chatID int64) error {
 
 		displayStr := date.Format("02.01") + " (" + dayName + ")"
 
-		btn := tgbotapi.NewInlineKeyboardButtonData(displayStr, "date_"+dateStr)
+		btn := tgbotapi.NewInlineKeyboardButtonData(displayStr, app.bookingCallback(cbDate, date.Format(callbackDateLayout), reschedule))
 		rows = append(rows, []tgbotapi.InlineKeyboardButton{btn})
 	}
 
 	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
-	msg := tgbotapi.NewMessage(chatID, "Выберите дату для записи:")
+	text := "Выберите дату для записи:"
+	if reschedule > 0 {
+		text = "Выберите новую дату для записи:"
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ReplyMarkup = keyboard
 
-	_, err := app.bot.Send(msg)
-	return err
+	return app.queueMessage(msg)
 }
 
 // showSlotsForDate shows available time slots for a specific date
-func (app *App) showSlotsForDate(chatID int64, date time.Time) error {
-	slots, err := GetAvailableSlotsForDate(app.db, date, app.config)
+func (app *App) showSlotsForDate(chatID int64, date time.Time, reschedule int) error {
+	slots, err := GetAvailableSlotsForDate(app.db, date, chatID, app.config)
 	if err != nil {
 		log.Printf("Error getting available slots: %v", err)
 		return app.sendMessage(chatID, "Ошибка при получении доступных слотов")
@@ -514,7 +799,7 @@ func (app *App) showSlotsForDate(chatID int64, date time.Time) error {
 		today := time.Now()
 		if date.Format("2006-01-02") == today.Format("2006-01-02") {
 			nextWorkday := GetNextAvailableWorkday(today, app.config)
-			nextSlots, err := GetAvailableSlotsForDate(app.db, nextWorkday, app.config)
+			nextSlots, err := GetAvailableSlotsForDate(app.db, nextWorkday, chatID, app.config)
 			if err != nil {
 				log.Printf("Error getting next day slots: %v", err)
 				return app.sendMessage(chatID, "К сожалению, нет доступных слотов на сегодня")
@@ -528,20 +813,28 @@ func (app *App) showSlotsForDate(chatID int64, date time.Time) error {
 
 				nextDayBtn := tgbotapi.NewInlineKeyboardButtonData(
 					fmt.Sprintf("📅 Показать слоты на %s", nextDateStr),
-					fmt.Sprintf("date_%s", nextWorkday.Format("2006-01-02")),
+					app.bookingCallback(cbDate, nextWorkday.Format(callbackDateLayout), reschedule),
 				)
 				keyboard := tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{nextDayBtn})
 
 				msg := tgbotapi.NewMessage(chatID, message)
 				msg.ReplyMarkup = keyboard
 
-				_, err = app.bot.Send(msg)
-				return err
+				return app.queueMessage(msg)
 			}
 		}
 
 		dateStr := date.Format("02.01.2006")
-		return app.sendMessage(chatID, fmt.Sprintf("К сожалению, нет доступных слотов на %s", dateStr))
+		if reschedule > 0 {
+			return app.sendMessage(chatID, fmt.Sprintf("К сожалению, нет доступных слотов на %s", dateStr))
+		}
+
+		// Offer to wait for a cancellation
+		waitBtn := tgbotapi.NewInlineKeyboardButtonData("🔔 Сообщить, если освободится", app.callbacks.Encode(cbWaitlist, date.Format(callbackDateLayout)))
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("К сожалению, нет доступных слотов на %s", dateStr))
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{waitBtn})
+
+		return app.queueMessage(msg)
 	}
 
 	var rows [][]tgbotapi.InlineKeyboardButton
@@ -549,7 +842,7 @@ func (app *App) showSlotsForDate(chatID int64, date time.Time) error {
 
 	for i, slot := range slots {
 		timeStr := slot.Format("15:04")
-		slotData := fmt.Sprintf("slot_%s", slot.Format("2006-01-02_15:04"))
+		slotData := app.bookingCallback(cbSlot, slot.Format(callbackSlotLayout), reschedule)
 
 		btn := tgbotapi.NewInlineKeyboardButtonData(timeStr, slotData)
 		currentRow = append(currentRow, btn)
@@ -566,8 +859,7 @@ func (app *App) showSlotsForDate(chatID int64, date time.Time) error {
 	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Выберите время на %s:", dateStr))
 	msg.ReplyMarkup = keyboard
 
-	_, err = app.bot.Send(msg)
-	return err
+	return app.queueMessage(msg)
 }
 
 func handleMySlots(app *App, update *tgbotapi.Update) error {
@@ -595,9 +887,29 @@ func handleMySlots(app *App, update *tgbotapi.Update) error {
 		return app.sendMessage(update.Message.Chat.ID, "У вас нет активных записей")
 	}
 
+	// Expected time of today's bookings while the operator runs late
+	now := time.Now()
+	delay, err := GetScheduleDelay(app.db, now)
+	if err != nil {
+		log.Printf("Error getting schedule delay: %v", err)
+	}
+
 	message := "Ваши записи:\n\n"
 	for _, slot := range slots {
-		message += fmt.Sprintf("📅 %s\n", slot.StartTime.Format("02.01.2006 15:04"))
+		message += fmt.Sprintf("📅 %s — код <b>%s</b>", slot.StartTime.Format("02.01.2006 15:04"), slot.Code)
+		if slot.Status == SlotStatusAwaitingPayment {
+			message += fmt.Sprintf(" (ожидает оплаты до %s)", slot.HoldUntil.Time.Format("15:04"))
+		} else if slot.Status == SlotStatusArrived {
+			message += " (вы отметились)"
+		} else if slot.Status == SlotStatusNoShow {
+			message += " (отмечена неявка)"
+		} else if slot.ConfirmedAt.Valid {
+			message += " (визит подтверждён)"
+		}
+		if delay > 0 && slot.Status != SlotStatusAwaitingPayment && slot.StartTime.Format(queueDateLayout) == now.Format(queueDateLayout) {
+			message += fmt.Sprintf(" (ожидается ~%s)", slot.StartTime.Add(delay).Format("15:04"))
+		}
+		message += "\n"
 	}
 
 	return app.sendMessage(update.Message.Chat.ID, message)
@@ -633,7 +945,7 @@ func handleCancel(app *App, update *tgbotapi.Update) error {
 	for _, slot := range slots {
 		btn := tgbotapi.NewInlineKeyboardButtonData(
 			slot.StartTime.Format("02.01 15:04"),
-			fmt.Sprintf("cancel_%d", slot.ID),
+			app.callbacks.Encode(cbCancel, strconv.Itoa(slot.ID)),
 		)
 		rows = append(rows, []tgbotapi.InlineKeyboardButton{btn})
 	}
@@ -642,8 +954,7 @@ func handleCancel(app *App, update *tgbotapi.Update) error {
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Выберите запись для отмены:")
 	msg.ReplyMarkup = keyboard
 
-	_, err = app.bot.Send(msg)
-	return err
+	return app.queueMessage(msg)
 }
 
 func handleAdmin(app *App, update *tgbotapi.Update) error {
@@ -665,7 +976,16 @@ func handleAdmin(app *App, update *tgbotapi.Update) error {
 Всего слотов: %d
 Забронировано: %d
 Доступно: %d
-Пользователей: %d`,
+Пользователей: %d
+
+📋 Расписание на сегодня и завтра: /today, /tomorrow
+🔎 Поиск записи по коду: /find КОД
+👥 Группы пользователей: /group
+🔗 Ссылка для QR-кода отметки: /checkinlink
+📷 Проверка QR-кода записи: /verify ТОКЕН
+⏱ Длительность визитов: /visits [ДНЕЙ]
+📣 Рассылка пользователям: /broadcast
+📬 Доставка сообщений: /outbox`,
 		stats.TotalSlots,
 		stats.BookedSlots,
 		stats.AvailableSlots,
@@ -674,3 +994,175 @@ func handleAdmin(app *App, update *tgbotapi.Update) error {
 
 	return app.sendMessage(update.Message.Chat.ID, message)
 }
+
+func handleFind(app *App, update *tgbotapi.Update) error {
+	userID := update.Message.From.ID
+
+	// Check if user is admin
+	if !IsAdmin(app.config, userID) {
+		return app.sendMessage(update.Message.Chat.ID, "У вас нет прав администратора")
+	}
+
+	code := update.Message.CommandArguments()
+	if code == "" {
+		return app.sendMessage(update.Message.Chat.ID, "Укажите код записи: /find КОД")
+	}
+
+	slot, err := GetSlotByCode(app.db, code)
+	if err != nil {
+		log.Printf("Error finding slot by code: %v", err)
+		return app.sendMessage(update.Message.Chat.ID, "Ошибка при поиске записи")
+	}
+	if slot != nil {
+		return app.sendBookingCard(update.Message.Chat.ID, slot)
+	}
+
+	cancelled, err := GetCancelledBooking(app.db, code)
+	if err != nil {
+		log.Printf("Error finding cancelled booking by code: %v", err)
+		return app.sendMessage(update.Message.Chat.ID, "Ошибка при поиске записи")
+	}
+	if cancelled == nil {
+		return app.sendMessage(update.Message.Chat.ID, "Запись с таким кодом не найдена")
+	}
+
+	message := fmt.Sprintf(`🔖 Запись <b>%s</b> отменена %s
+
+📅 %s`, cancelled.Code, cancelled.CancelledAt.Format("02.01.2006 15:04"), cancelled.StartTime.Format("02.01.2006 15:04"))
+	if cancelled.UserID.Valid {
+		user, err := GetUserByTelegramID(app.db, cancelled.UserID.Int64)
+		if err != nil {
+			log.Printf("Error getting booking user: %v", err)
+		} else {
+			message += formatBookingUser(user)
+		}
+	}
+	return app.sendMessage(update.Message.Chat.ID, message)
+}
+
+// sendBookingCard sends booking details with admin actions
+func (app *App) sendBookingCard(chatID int64, slot *Slot) error {
+	user, err := GetUserByTelegramID(app.db, slot.UserID.Int64)
+	if err != nil {
+		log.Printf("Error getting booking user: %v", err)
+		return app.sendMessage(chatID, "Ошибка при получении данных пользователя")
+	}
+
+	message := fmt.Sprintf(`🔖 Запись <b>%s</b>
+
+📅 %s`, slot.Code, slot.StartTime.Format("02.01.2006 15:04"))
+	message += formatBookingUser(user)
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		[]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("❌ Отменить запись", app.callbacks.Encode(cbAdminCancel, strconv.Itoa(slot.ID))),
+			tgbotapi.NewInlineKeyboardButtonURL("💬 Написать", fmt.Sprintf("tg://user?id=%d", slot.UserID.Int64)),
+		},
+	)
+
+	msg := tgbotapi.NewMessage(chatID, message)
+	msg.ParseMode = "HTML"
+	msg.ReplyMarkup = keyboard
+
+	return app.queueMessage(msg)
+}
+
+// handleAdminCancelCallback cancels a booking on behalf of an admin and notifies the user
+func (app *App) handleAdminCancelCallback(callback *tgbotapi.CallbackQuery, slotID int) error {
+	if !IsAdmin(app.config, callback.From.ID) {
+		return app.sendMessage(callback.Message.Chat.ID, "У вас нет прав администратора")
+	}
+
+	slot, err := GetSlotByID(app.db, slotID)
+	if err != nil || slot == nil || !slot.UserID.Valid {
+		return app.sendMessage(callback.Message.Chat.ID, "Запись уже отменена или не найдена.")
+	}
+
+	userID, err := ReleaseSlot(app.db, slotID, slot.Code)
+	if errors.Is(err, ErrBookingChanged) {
+		return app.sendMessage(callback.Message.Chat.ID, "Запись уже отменена или изменилась.")
+	}
+	if err != nil {
+		log.Printf("Error releasing slot %d: %v", slotID, err)
+		return app.sendMessage(callback.Message.Chat.ID, "Не удалось отменить запись.")
+	}
+
+	// Remove the actions from the card
+	app.removeKeyboard(callback.Message.Chat.ID, callback.Message.MessageID)
+
+	app.sendMessage(userID, fmt.Sprintf("❌ Ваша запись на %s отменена администратором.", slot.StartTime.Format("02.01.2006 15:04")))
+	app.offerReleasedSlot(slot.StartTime)
+	app.syncBookingCard(slot, OpsStateCancelledByStaff, "Отменил "+staffName(callback.From))
+
+	if err := app.refundOnCancel(slot, true); err != nil {
+		log.Printf("Error refunding slot %d: %v", slotID, err)
+	}
+
+	return app.sendMessage(callback.Message.Chat.ID, fmt.Sprintf("❌ Запись %s отменена.", slot.Code))
+}
+
+func handleGroup(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+
+	// Check if user is admin
+	if !IsAdmin(app.config, update.Message.From.ID) {
+		return app.sendMessage(chatID, "У вас нет прав администратора")
+	}
+
+	usage := `Управление группами пользователей:
+
+/group ID - группы пользователя
+/group add ID ГРУППА - добавить в группу
+/group remove ID ГРУППА - убрать из группы`
+
+	args := strings.Fields(update.Message.CommandArguments())
+	if len(args) == 0 {
+		return app.sendMessage(chatID, usage)
+	}
+
+	// Listing takes just the user ID
+	if len(args) == 1 {
+		telegramID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return app.sendMessage(chatID, usage)
+		}
+		groups, err := GetUserGroups(app.db, telegramID)
+		if err != nil {
+			log.Printf("Error getting user groups: %v", err)
+			return app.sendMessage(chatID, "Ошибка при получении групп")
+		}
+		if len(groups) == 0 {
+			return app.sendMessage(chatID, fmt.Sprintf("Пользователь %d не состоит в группах", telegramID))
+		}
+		return app.sendMessage(chatID, fmt.Sprintf("Группы пользователя %d: %s", telegramID, html.EscapeString(strings.Join(groups, ", "))))
+	}
+
+	if len(args) != 3 {
+		return app.sendMessage(chatID, usage)
+	}
+
+	telegramID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return app.sendMessage(chatID, usage)
+	}
+	group := args[2]
+
+	switch args[0] {
+	case "add":
+		if !isKnownGroup(app.config, group) {
+			return app.sendMessage(chatID, fmt.Sprintf("Группа %s не настроена в GROUP_RULES", html.EscapeString(group)))
+		}
+		err = AddUserGroup(app.db, telegramID, group)
+	case "remove":
+		err = RemoveUserGroup(app.db, telegramID, group)
+	default:
+		return app.sendMessage(chatID, usage)
+	}
+
+	if err != nil {
+		log.Printf("Error updating user groups: %v", err)
+		return app.sendMessage(chatID, "Ошибка при изменении групп")
+	}
+
+	return app.sendMessage(chatID, "✅ Группы пользователя обновлены")
+}
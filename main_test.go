@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramLog records the Bot API calls the stub Telegram API received
+type telegramLog struct {
+	mu     sync.Mutex
+	calls  []telegramCall
+	onCall func(call telegramCall) // Runs before the stub answers, if set
+}
+
+// telegramCall is one Bot API request
+type telegramCall struct {
+	Method string
+	Params url.Values
+}
+
+// messages returns the texts sent to a chat, in order
+func (l *telegramLog) messages(chatID int64) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var texts []string
+	for _, call := range l.calls {
+		if call.Method == "sendMessage" && call.Params.Get("chat_id") == strconv.FormatInt(chatID, 10) {
+			texts = append(texts, call.Params.Get("text"))
+		}
+	}
+	return texts
+}
+
+// newTestApp creates an app on an empty database whose bot talks to a stub Telegram API
+// that accepts every request. Messages sent through the outbox stay in the database.
+func newTestApp(t *testing.T, config *Config) *App {
+	app, _ := newRecordingApp(t, config)
+	return app
+}
+
+// newRecordingApp is newTestApp that also returns the calls made to the stub Telegram API
+func newRecordingApp(t *testing.T, config *Config) (*App, *telegramLog) {
+	t.Helper()
+
+	sent := &telegramLog{}
+	telegram := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		call := telegramCall{Method: path.Base(r.URL.Path), Params: r.PostForm}
+		sent.mu.Lock()
+		sent.calls = append(sent.calls, call)
+		onCall := sent.onCall
+		sent.mu.Unlock()
+		if onCall != nil {
+			onCall(call)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"username":"queue_bot","message_id":1}}`))
+	}))
+	t.Cleanup(telegram.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithClient("test", telegram.URL+"/bot%s/%s", telegram.Client())
+	if err != nil {
+		t.Fatalf("creating bot: %v", err)
+	}
+
+	if config.CallbackSecret == "" {
+		config.CallbackSecret = "secret"
+	}
+	app := &App{
+		bot:       bot,
+		db:        newTestDB(t),
+		config:    config,
+		handlers:  make(map[string]HandlerFunc),
+		callbacks: NewCallbackCodec(config.CallbackSecret),
+		events:    NewEventHub(),
+		outbox:    NewOutbox(),
+	}
+	app.registerHandlers()
+	return app, sent
+}
+
+// outboxTexts returns the texts queued for the chat, oldest first
+func outboxTexts(t *testing.T, app *App, chatID int64) []string {
+	t.Helper()
+	rows, err := app.db.Query("SELECT text FROM outbox WHERE chat_id = ? AND kind = ? ORDER BY id", chatID, OutboxMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var texts []string
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, text)
+	}
+	return texts
+}
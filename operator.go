@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// SetOperatorCounter remembers which counter the operator is serving at
+func SetOperatorCounter(db *sql.DB, operatorID int64, counter int) error {
+	query := `
+		INSERT INTO operators (telegram_id, counter, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (telegram_id) DO UPDATE SET counter = excluded.counter, updated_at = excluded.updated_at
+	`
+
+	_, err := db.Exec(query, operatorID, counter, time.Now())
+	return err
+}
+
+// GetOperatorCounter returns the operator's counter, 0 if not chosen yet
+func GetOperatorCounter(db *sql.DB, operatorID int64) (int, error) {
+	var counter int
+	err := db.QueryRow("SELECT counter FROM operators WHERE telegram_id = ?", operatorID).Scan(&counter)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return counter, err
+}
+
+// notifyOperators sends a message to every operator and admin
+func (app *App) notifyOperators(text string) {
+	notified := make(map[int64]bool)
+	for _, ids := range [][]int64{app.config.OperatorIDs, app.config.AdminIDs} {
+		for _, id := range ids {
+			if notified[id] {
+				continue
+			}
+			notified[id] = true
+			if err := app.sendMessage(id, text); err != nil {
+				log.Printf("Error notifying operator %d: %v", id, err)
+			}
+		}
+	}
+}
+
+// Handlers
+
+func handleCounter(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+	operatorID := update.Message.From.ID
+
+	if !IsOperator(app.config, operatorID) {
+		return app.sendMessage(chatID, "У вас нет прав оператора")
+	}
+
+	counter, err := strconv.Atoi(update.Message.CommandArguments())
+	if err != nil || counter <= 0 {
+		current, _ := GetOperatorCounter(app.db, operatorID)
+		if current > 0 {
+			return app.sendMessage(chatID, fmt.Sprintf("Вы работаете в окне %d. Сменить окно: /counter НОМЕР", current))
+		}
+		return app.sendMessage(chatID, "Укажите номер окна: /counter НОМЕР")
+	}
+
+	stage := StageOfCounter(app.config, counter)
+	if stage < 0 {
+		return app.sendMessage(chatID, fmt.Sprintf("Окна %d нет в маршруте посетителей.\n\n%s", counter, routeDescription(app.config)))
+	}
+
+	if err := SetOperatorCounter(app.db, operatorID, counter); err != nil {
+		log.Printf("Error setting operator counter: %v", err)
+		return app.sendMessage(chatID, "Ошибка при выборе окна")
+	}
+
+	if name := stageName(app.config, stage); name != "" {
+		return app.sendMessage(chatID, fmt.Sprintf("✅ Вы работаете в окне %d, этап «%s». Вызвать следующего: /next", counter, html.EscapeString(name)))
+	}
+	return app.sendMessage(chatID, fmt.Sprintf("✅ Вы работаете в окне %d. Вызвать следующего: /next", counter))
+}
+
+func handleNext(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+	operatorID := update.Message.From.ID
+
+	if !IsOperator(app.config, operatorID) {
+		return app.sendMessage(chatID, "У вас нет прав оператора")
+	}
+
+	return app.callNext(chatID, operatorID)
+}
+
+// callNext calls the next ticket to the operator's counter
+func (app *App) callNext(chatID int64, operatorID int64) error {
+	counter, err := GetOperatorCounter(app.db, operatorID)
+	if err != nil {
+		log.Printf("Error getting operator counter: %v", err)
+		return app.sendMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+	}
+	if counter == 0 || StageOfCounter(app.config, counter) < 0 {
+		return app.sendMessage(chatID, "Сначала выберите окно: /counter НОМЕР")
+	}
+
+	// A served visitor with stages left on the route is sent on to the next one
+	ticket, finished, err := CallNextTicket(app.db, operatorID, counter, app.config)
+	advanced := finished != nil && finished.Status == TicketStatusWaiting
+	if advanced {
+		app.notifyNextStage(finished)
+	}
+	if errors.Is(err, ErrQueueEmpty) {
+		if advanced {
+			app.queueChanged(QueueEvent{Type: QueueEventServed, Ticket: finished.Label(), Counter: counter})
+		}
+		return app.sendMessage(chatID, "Очередь пуста. Повторите /next, когда появятся посетители.")
+	}
+	if err != nil {
+		log.Printf("Error calling next ticket: %v", err)
+		return app.sendMessage(chatID, "Не удалось вызвать следующего. Попробуйте позже.")
+	}
+
+	log.Printf("Operator %d called ticket %s to counter %d", operatorID, ticket.Label(), counter)
+	app.notifyTicketCalled(ticket)
+	app.queueChanged(QueueEvent{Type: QueueEventCalled, Ticket: ticket.Label(), Counter: counter})
+
+	return app.sendOperatorTicket(chatID, ticket)
+}
+
+// notifyTicketCalled tells the visitor which counter to go to
+func (app *App) notifyTicketCalled(ticket *Ticket) {
+	if !ticket.UserID.Valid {
+		return
+	}
+
+	message := fmt.Sprintf("🔔 Талон <b>%s</b>: пожалуйста, подойдите к окну %d", ticket.Label(), ticket.Counter.Int64)
+	if err := app.sendMessage(ticket.UserID.Int64, message); err != nil {
+		log.Printf("Error notifying ticket %s: %v", ticket.Label(), err)
+	}
+}
+
+// sendOperatorTicket shows the called ticket with operator actions
+func (app *App) sendOperatorTicket(chatID int64, ticket *Ticket) error {
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("📢 Вызван талон <b>%s</b> в окно %d", ticket.Label(), ticket.Counter.Int64))
+	msg.ParseMode = "HTML"
+	msg.ReplyMarkup = app.operatorTicketKeyboard(ticket)
+
+	return app.queueMessage(msg)
+}
+
+// operatorTicketKeyboard builds the operator actions for a called ticket
+func (app *App) operatorTicketKeyboard(ticket *Ticket) tgbotapi.InlineKeyboardMarkup {
+	ticketID := strconv.FormatInt(ticket.ID, 10)
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		{
+			tgbotapi.NewInlineKeyboardButtonData("✅ Обслужен", app.callbacks.Encode(cbTicketServed, ticketID)),
+			tgbotapi.NewInlineKeyboardButtonData("🔁 Повторить", app.callbacks.Encode(cbTicketRecall, ticketID)),
+			tgbotapi.NewInlineKeyboardButtonData("⏭ Пропустить", app.callbacks.Encode(cbTicketSkip, ticketID)),
+		},
+	}
+
+	if !ticket.StartedAt.Valid {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("▶️ Начать приём", app.callbacks.Encode(cbTicketStart, ticketID)),
+		))
+	}
+
+	// Service tags, the chosen one is marked
+	var row []tgbotapi.InlineKeyboardButton
+	for i, service := range app.config.Services {
+		label := service
+		if ticket.Service.String == service {
+			label = "☑️ " + service
+		}
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(label, app.callbacks.Encode(cbTicketService, ticketID, strconv.Itoa(i))))
+		if len(row) == 3 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("➡️ Следующий", app.callbacks.Encode(cbCallNext, ticketID)),
+	))
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// handleTicketCallback handles operator actions on a called ticket
+func (app *App) handleTicketCallback(callback *tgbotapi.CallbackQuery, action string, ticketID int64) error {
+	chatID := callback.Message.Chat.ID
+	operatorID := callback.From.ID
+
+	if !IsOperator(app.config, operatorID) {
+		return app.sendMessage(chatID, "У вас нет прав оператора")
+	}
+
+	ticket, err := GetTicketByID(app.db, ticketID)
+	if err != nil || ticket == nil {
+		return app.sendMessage(chatID, "Талон не найден")
+	}
+
+	// Recall keeps the ticket active, every other action closes this card
+	if action == cbTicketRecall {
+		if ticket.Status != TicketStatusCalled || ticket.Operator.Int64 != operatorID {
+			return app.sendMessage(chatID, fmt.Sprintf("Талон %s уже не обслуживается вами", ticket.Label()))
+		}
+		app.notifyTicketCalled(ticket)
+		app.queueChanged(QueueEvent{Type: QueueEventRecalled, Ticket: ticket.Label(), Counter: int(ticket.Counter.Int64)})
+		return app.sendMessage(chatID, fmt.Sprintf("🔁 Талон %s вызван повторно", ticket.Label()))
+	}
+
+	// Start also keeps the card, without the start button
+	if action == cbTicketStart {
+		if err := StartTicket(app.db, ticketID, operatorID); err != nil {
+			return app.sendMessage(chatID, fmt.Sprintf("Приём по талону %s уже начат или талон не обслуживается вами", ticket.Label()))
+		}
+		ticket.StartedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		app.editKeyboard(chatID, callback.Message.MessageID, app.operatorTicketKeyboard(ticket))
+		return nil
+	}
+
+	app.removeKeyboard(chatID, callback.Message.MessageID)
+
+	switch action {
+	case cbTicketServed:
+		finished, err := FinishTicket(app.db, ticketID, operatorID, TicketStatusServed, app.config)
+		if err != nil {
+			return app.sendMessage(chatID, fmt.Sprintf("Талон %s уже не обслуживается вами", ticket.Label()))
+		}
+		if finished.Status == TicketStatusWaiting {
+			app.queueChanged(QueueEvent{Type: QueueEventServed, Ticket: ticket.Label(), Counter: int(ticket.Counter.Int64)})
+			app.notifyNextStage(finished)
+			return app.sendMessage(chatID, fmt.Sprintf("✅ Талон %s направлен на этап «%s». Вызвать следующего: /next", ticket.Label(), html.EscapeString(stageName(app.config, finished.Stage))))
+		}
+		app.queueChanged(QueueEvent{Type: QueueEventServed, Ticket: ticket.Label(), Counter: int(ticket.Counter.Int64)})
+		return app.sendMessage(chatID, fmt.Sprintf("✅ Талон %s обслужен. Вызвать следующего: /next", ticket.Label()))
+	case cbTicketSkip:
+		if _, err := FinishTicket(app.db, ticketID, operatorID, TicketStatusSkipped, app.config); err != nil {
+			return app.sendMessage(chatID, fmt.Sprintf("Талон %s уже не обслуживается вами", ticket.Label()))
+		}
+		app.queueChanged(QueueEvent{Type: QueueEventSkipped, Ticket: ticket.Label(), Counter: int(ticket.Counter.Int64)})
+		if ticket.UserID.Valid {
+			app.sendMessage(ticket.UserID.Int64, fmt.Sprintf("⏭ Талон %s пропущен, так как вы не подошли по вызову. Чтобы встать в очередь снова, используйте /queue", ticket.Label()))
+		}
+		return app.sendMessage(chatID, fmt.Sprintf("⏭ Талон %s пропущен. Вызвать следующего: /next", ticket.Label()))
+	case cbCallNext:
+		return app.callNext(chatID, operatorID)
+	}
+
+	return nil
+}
+
+// handleTicketServiceCallback tags the visit with a service for the duration analytics
+func (app *App) handleTicketServiceCallback(callback *tgbotapi.CallbackQuery, ticketID int64, service int) error {
+	chatID := callback.Message.Chat.ID
+	operatorID := callback.From.ID
+
+	if !IsOperator(app.config, operatorID) {
+		return app.sendMessage(chatID, "У вас нет прав оператора")
+	}
+	if service < 0 || service >= len(app.config.Services) {
+		return nil
+	}
+
+	ticket, err := GetTicketByID(app.db, ticketID)
+	if err != nil || ticket == nil {
+		return app.sendMessage(chatID, "Талон не найден")
+	}
+
+	if err := SetTicketService(app.db, ticketID, operatorID, app.config.Services[service]); err != nil {
+		return app.sendMessage(chatID, fmt.Sprintf("Талон %s обслуживается не вами", ticket.Label()))
+	}
+
+	// Only a card still showing actions gets its marks updated
+	if ticket.Status == TicketStatusCalled {
+		ticket.Service = sql.NullString{String: app.config.Services[service], Valid: true}
+		app.editKeyboard(chatID, callback.Message.MessageID, app.operatorTicketKeyboard(ticket))
+	}
+	return nil
+}
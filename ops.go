@@ -0,0 +1,376 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Booking card states besides the slot statuses
+const (
+	OpsStateConfirmed        = "confirmed"
+	OpsStateRescheduled      = "rescheduled"     // Note holds the previous time
+	OpsStateCancelled        = "cancelled"       // By the visitor
+	OpsStateCancelledByStaff = "cancelled_staff" // Note holds the reason
+	OpsStateReleased         = "released"        // Not confirmed or paid in time
+)
+
+// opsStateLabels are the card statuses shown to staff
+var opsStateLabels = map[string]string{
+	SlotStatusAwaitingPayment: "⏳ Ожидает оплаты",
+	SlotStatusBooked:          "🆕 Новая запись",
+	OpsStateRescheduled:       "🔄 Перенесена",
+	OpsStateConfirmed:         "✅ Визит подтверждён",
+	SlotStatusArrived:         "📍 Посетитель пришёл",
+	SlotStatusNoShow:          "🚫 Посетитель не пришёл",
+	OpsStateCancelled:         "❌ Отменена посетителем",
+	OpsStateCancelledByStaff:  "❌ Отменена администрацией",
+	OpsStateReleased:          "⌛ Снята: визит не подтверждён или не оплачен",
+}
+
+// Replies to these prompts in the operations group carry the text of an action
+const (
+	opsCancelPrompt  = "❌ Причина отмены записи "
+	opsMessagePrompt = "✉️ Сообщение посетителю по записи "
+)
+
+// OpsCard is a booking card posted to the operations group, keyed by the booking code
+type OpsCard struct {
+	Code      string
+	MessageID int   // 0 for cards posted through the outbox, they are edited by OutboxID
+	OutboxID  int64 // Outbox item that posted the card
+	SlotID    int
+	UserID    int64
+	StartTime time.Time
+	State     string
+	Note      string
+}
+
+// GetOpsCard returns the card of a booking, nil if none was posted
+func GetOpsCard(db *sql.DB, code string) (*OpsCard, error) {
+	query := `
+		SELECT code, message_id, outbox_id, slot_id, user_id, start_time, state, note
+		FROM ops_cards
+		WHERE code = ?
+	`
+
+	var card OpsCard
+	err := db.QueryRow(query, code).Scan(&card.Code, &card.MessageID, &card.OutboxID, &card.SlotID, &card.UserID, &card.StartTime, &card.State, &card.Note)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &card, nil
+}
+
+// SaveOpsCard stores the card after it was posted or edited
+func SaveOpsCard(db *sql.DB, card *OpsCard) error {
+	query := `
+		INSERT INTO ops_cards (code, message_id, outbox_id, slot_id, user_id, start_time, state, note, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (code) DO UPDATE SET message_id = excluded.message_id, outbox_id = excluded.outbox_id, slot_id = excluded.slot_id,
+			start_time = excluded.start_time, state = excluded.state, note = excluded.note, updated_at = excluded.updated_at
+	`
+
+	_, err := db.Exec(query, card.Code, card.MessageID, card.OutboxID, card.SlotID, card.UserID, card.StartTime, card.State, card.Note, time.Now())
+	return err
+}
+
+// MarkSlotNoShow records that the visitor didn't come to a booking that has already started
+func MarkSlotNoShow(db *sql.DB, slotID int) error {
+	result, err := db.Exec("UPDATE slots SET status = ? WHERE id = ? AND COALESCE(status, 'booked') = ? AND start_time <= ?",
+		SlotStatusNoShow, slotID, SlotStatusBooked, time.Now())
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrBookingNotFound
+	}
+
+	return nil
+}
+
+// syncBookingCard posts the booking's card to the operations group or edits it in place
+func (app *App) syncBookingCard(slot *Slot, state, note string) {
+	if app.config.OpsChatID == 0 || slot.Code == "" || !slot.UserID.Valid {
+		return
+	}
+
+	card, err := GetOpsCard(app.db, slot.Code)
+	if err != nil {
+		log.Printf("Error getting ops card %s: %v", slot.Code, err)
+		return
+	}
+	if card == nil {
+		card = &OpsCard{Code: slot.Code, UserID: slot.UserID.Int64}
+	}
+	card.SlotID = slot.ID
+	card.StartTime = slot.StartTime
+	card.State = state
+	card.Note = note
+
+	if err := app.sendOpsCard(card); err != nil {
+		log.Printf("Error queueing ops card %s: %v", card.Code, err)
+		return
+	}
+	if err := SaveOpsCard(app.db, card); err != nil {
+		log.Printf("Error saving ops card %s: %v", card.Code, err)
+	}
+}
+
+// sendOpsCard queues the card's post the first time and edits of its message after that.
+// An edit may be queued before the post is delivered, the outbox resolves its message then.
+func (app *App) sendOpsCard(card *OpsCard) error {
+	markup, err := json.Marshal(app.opsCardKeyboard(card))
+	if err != nil {
+		return err
+	}
+
+	item := &OutboxItem{
+		ChatID:      app.config.OpsChatID,
+		Kind:        OutboxMessage,
+		Text:        app.opsCardText(card),
+		ParseMode:   "HTML",
+		ReplyMarkup: string(markup),
+	}
+	if card.MessageID != 0 || card.OutboxID != 0 {
+		item.Kind = OutboxEdit
+		item.MessageID = card.MessageID
+		item.TargetID = card.OutboxID
+	}
+
+	if err := app.enqueue(item); err != nil {
+		return err
+	}
+	if item.Kind == OutboxMessage {
+		card.OutboxID = item.ID
+	}
+	return nil
+}
+
+// opsCardText describes the booking and its current state
+func (app *App) opsCardText(card *OpsCard) string {
+	label, ok := opsStateLabels[card.State]
+	if !ok {
+		label = card.State
+	}
+
+	text := fmt.Sprintf(`🔖 Запись <b>%s</b>
+
+📅 %s`, card.Code, card.StartTime.Format("02.01.2006 15:04"))
+
+	user, err := GetUserByTelegramID(app.db, card.UserID)
+	if err != nil {
+		log.Printf("Error getting booking user: %v", err)
+	}
+	text += formatBookingUser(user)
+
+	text += "\n\nСтатус: " + label
+	if card.Note != "" {
+		text += "\n" + html.EscapeString(card.Note)
+	}
+	return text
+}
+
+// opsCardKeyboard offers the actions that make sense in the card's state
+func (app *App) opsCardKeyboard(card *OpsCard) tgbotapi.InlineKeyboardMarkup {
+	unconfirmed := card.State == SlotStatusBooked || card.State == OpsStateRescheduled
+	active := unconfirmed || card.State == OpsStateConfirmed
+
+	var row []tgbotapi.InlineKeyboardButton
+	if unconfirmed {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("✅ Подтвердить", app.callbacks.Encode(cbOpsConfirm, card.Code)))
+	}
+	if active || card.State == SlotStatusAwaitingPayment {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("❌ Отменить", app.callbacks.Encode(cbOpsCancel, card.Code)))
+	}
+	if active {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("🚫 Неявка", app.callbacks.Encode(cbOpsNoShow, card.Code)))
+	}
+
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("✉️ Написать посетителю", app.callbacks.Encode(cbOpsMessage, card.Code))),
+	}
+	if len(row) > 0 {
+		rows = append([][]tgbotapi.InlineKeyboardButton{row}, rows...)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// formatBookingUser formats the visitor's name, username and phone for booking cards
+func formatBookingUser(user *User) string {
+	if user == nil {
+		return ""
+	}
+
+	text := fmt.Sprintf("\n👤 %s", html.EscapeString(strings.TrimSpace(user.FirstName+" "+user.LastName)))
+	if user.Username != "" {
+		text += " @" + html.EscapeString(user.Username)
+	}
+	if user.PhoneNumber != "" {
+		text += "\n📱 " + html.EscapeString(user.PhoneNumber)
+	}
+	return text
+}
+
+// staffName returns how staff actions are signed on cards
+func staffName(from *tgbotapi.User) string {
+	if from.UserName != "" {
+		return "@" + from.UserName
+	}
+	return from.FirstName
+}
+
+// Handlers
+
+// handleOpsCallback handles the actions on a booking card
+func (app *App) handleOpsCallback(callback *tgbotapi.CallbackQuery, action, code string) error {
+	chatID := callback.Message.Chat.ID
+
+	if !IsOperator(app.config, callback.From.ID) {
+		app.answerCallback(callback.ID, "Действия с записями доступны администраторам и операторам", true)
+		return nil
+	}
+
+	card, err := GetOpsCard(app.db, code)
+	if err != nil || card == nil {
+		return app.sendMessage(chatID, "Карточка записи не найдена")
+	}
+
+	// Writing to the visitor works in any state
+	if action == cbOpsMessage {
+		return app.sendOpsPrompt(chatID, opsMessagePrompt+code, "Ответьте на это сообщение текстом для посетителя.")
+	}
+
+	slot, err := GetSlotByCode(app.db, code)
+	if err != nil {
+		log.Printf("Error finding slot by code: %v", err)
+		return app.sendMessage(chatID, "Ошибка при поиске записи")
+	}
+	if slot == nil {
+		return app.sendMessage(chatID, fmt.Sprintf("Запись %s уже отменена", code))
+	}
+
+	switch action {
+	case cbOpsConfirm:
+		if err := ConfirmSlot(app.db, slot.ID, slot.UserID.Int64); err != nil {
+			return app.sendMessage(chatID, fmt.Sprintf("Запись %s уже нельзя подтвердить", code))
+		}
+		app.sendMessage(slot.UserID.Int64, fmt.Sprintf("✅ Ваш визит %s подтверждён. Ждём вас!", slot.StartTime.Format("02.01.2006 в 15:04")))
+		app.syncBookingCard(slot, OpsStateConfirmed, "Подтвердил "+staffName(callback.From))
+	case cbOpsCancel:
+		return app.sendOpsPrompt(chatID, opsCancelPrompt+code, "Ответьте на это сообщение причиной отмены, посетитель её увидит.")
+	case cbOpsNoShow:
+		if err := MarkSlotNoShow(app.db, slot.ID); err != nil {
+			if err != ErrBookingNotFound {
+				log.Printf("Error marking slot %d as no-show: %v", slot.ID, err)
+			}
+			return app.sendMessage(chatID, fmt.Sprintf("Неявку по записи %s можно отметить только после начала приёма, если посетитель не отметился", code))
+		}
+		app.syncBookingCard(slot, SlotStatusNoShow, "Отметил "+staffName(callback.From))
+	}
+
+	return nil
+}
+
+// sendOpsPrompt asks staff for text; the prompt's first line tells the reply what it is for
+func (app *App) sendOpsPrompt(chatID int64, prompt, hint string) error {
+	msg := tgbotapi.NewMessage(chatID, prompt+"\n\n"+hint)
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true}
+
+	return app.queueMessage(msg)
+}
+
+// handleOpsReply carries out a prompted action with the text staff replied with
+func (app *App) handleOpsReply(update *tgbotapi.Update) error {
+	message := update.Message
+	prompt := message.ReplyToMessage
+	if prompt == nil || prompt.From == nil || prompt.From.ID != app.bot.Self.ID || message.Text == "" {
+		return nil
+	}
+	if !IsOperator(app.config, message.From.ID) {
+		return nil
+	}
+
+	firstLine, _, _ := strings.Cut(prompt.Text, "\n")
+	if code, ok := strings.CutPrefix(firstLine, opsMessagePrompt); ok {
+		return app.messageVisitor(message, code)
+	}
+	if code, ok := strings.CutPrefix(firstLine, opsCancelPrompt); ok {
+		return app.cancelByStaff(message, code)
+	}
+	return nil
+}
+
+// messageVisitor relays a staff message to the visitor of the booking
+func (app *App) messageVisitor(message *tgbotapi.Message, code string) error {
+	card, err := GetOpsCard(app.db, code)
+	if err != nil || card == nil {
+		return app.sendMessage(message.Chat.ID, "Карточка записи не найдена")
+	}
+
+	text := fmt.Sprintf("✉️ Сообщение по вашей записи на %s:\n\n%s", card.StartTime.Format("02.01.2006 15:04"), html.EscapeString(message.Text))
+	if err := app.sendMessage(card.UserID, text); err != nil {
+		log.Printf("Error queueing message to user %d: %v", card.UserID, err)
+		return app.sendMessage(message.Chat.ID, "❌ Не удалось поставить сообщение посетителю в очередь")
+	}
+
+	log.Printf("Staff %d messaged the visitor of booking %s", message.From.ID, code)
+	// Delivery happens later through the outbox, failures show up in /outbox
+	return app.sendMessage(message.Chat.ID, fmt.Sprintf("✅ Сообщение по записи %s поставлено в очередь на отправку", code))
+}
+
+// cancelByStaff cancels the booking with the reason staff replied with
+func (app *App) cancelByStaff(message *tgbotapi.Message, code string) error {
+	chatID := message.Chat.ID
+
+	slot, err := GetSlotByCode(app.db, code)
+	if err != nil {
+		log.Printf("Error finding slot by code: %v", err)
+		return app.sendMessage(chatID, "Ошибка при поиске записи")
+	}
+	if slot == nil {
+		return app.sendMessage(chatID, fmt.Sprintf("Запись %s уже отменена", code))
+	}
+	if slot.Status != SlotStatusBooked && slot.Status != SlotStatusAwaitingPayment {
+		return app.sendMessage(chatID, fmt.Sprintf("Запись %s уже нельзя отменить", code))
+	}
+
+	// Released only while the slot still holds this booking: the visitor may have cancelled
+	// or moved it since the card was read
+	userID, err := ReleaseSlot(app.db, slot.ID, code)
+	if errors.Is(err, ErrBookingChanged) {
+		return app.sendMessage(chatID, fmt.Sprintf("Запись %s уже отменена или изменилась", code))
+	}
+	if err != nil {
+		log.Printf("Error releasing slot %d: %v", slot.ID, err)
+		return app.sendMessage(chatID, "Не удалось отменить запись.")
+	}
+	log.Printf("Staff %d cancelled booking %s", message.From.ID, code)
+
+	app.sendMessage(userID, fmt.Sprintf("❌ Ваша запись на %s отменена.\nПричина: %s\n\nЗаписаться снова: /book",
+		slot.StartTime.Format("02.01.2006 15:04"), html.EscapeString(message.Text)))
+
+	if err := app.refundOnCancel(slot, true); err != nil {
+		log.Printf("Error refunding slot %d: %v", slot.ID, err)
+	}
+	app.offerReleasedSlot(slot.StartTime)
+	app.syncBookingCard(slot, OpsStateCancelledByStaff, fmt.Sprintf("Отменил %s. Причина: %s", staffName(message.From), message.Text))
+
+	return nil
+}
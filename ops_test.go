@@ -0,0 +1,197 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const testOpsChat = -1001
+
+// newOpsApp creates a deposit-taking app posting booking cards, with operator 100,
+// and a paid booking of visitor 1 whose card is posted
+func newOpsApp(t *testing.T) (*App, *Slot) {
+	t.Helper()
+	config := newDepositConfig()
+	config.OpsChatID = testOpsChat
+	config.OperatorIDs = []int64{100}
+
+	app := newTestApp(t, config)
+	app.payments = app.newPaymentProvider()
+	addTestUsers(t, app.db, 1)
+
+	slot, err := BookTimeSlot(app.db, testSlotTime(10, 0), 1, "user", app.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake provider pays right away, which posts the card
+	if err := app.requestDeposit(1, slot); err != nil {
+		t.Fatal(err)
+	}
+	if card, err := GetOpsCard(app.db, slot.Code); err != nil || card == nil {
+		t.Fatalf("got card %v, %v, want the paid booking posted", card, err)
+	}
+	return app, slot
+}
+
+// opsReply is a message in the operations group replying to the prompt
+func opsReply(from int64, prompt *tgbotapi.Message, text string) *tgbotapi.Update {
+	return &tgbotapi.Update{Message: &tgbotapi.Message{
+		From:           &tgbotapi.User{ID: from, UserName: "staff"},
+		Chat:           &tgbotapi.Chat{ID: testOpsChat},
+		Text:           text,
+		ReplyToMessage: prompt,
+	}}
+}
+
+func TestCancelByStaff(t *testing.T) {
+	app, slot := newOpsApp(t)
+
+	if err := app.cancelByStaff(opsReply(100, nil, "Врач заболел").Message, slot.Code); err != nil {
+		t.Fatal(err)
+	}
+
+	if booked, err := GetSlotByCode(app.db, slot.Code); err != nil || booked != nil {
+		t.Fatalf("got booking %v, %v, want it released", booked, err)
+	}
+	if status := paymentStatus(t, app.db, slot.ID); status != PaymentStatusRefunded {
+		t.Fatalf("got payment status %q, want the deposit refunded", status)
+	}
+
+	card, err := GetOpsCard(app.db, slot.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.State != OpsStateCancelledByStaff || card.Note != "Отменил @staff. Причина: Врач заболел" {
+		t.Fatalf("got card state %q, note %q, want cancelled by staff with the reason", card.State, card.Note)
+	}
+
+	told := false
+	for _, text := range outboxTexts(t, app, 1) {
+		told = told || strings.Contains(text, "Причина: Врач заболел")
+	}
+	if !told {
+		t.Fatalf("visitor got %q, want the reason", outboxTexts(t, app, 1))
+	}
+
+	// The booking is gone, so a second reply to the same prompt changes nothing
+	if err := app.cancelByStaff(opsReply(100, nil, "Ещё раз").Message, slot.Code); err != nil {
+		t.Fatal(err)
+	}
+	if status := paymentStatus(t, app.db, slot.ID); status != PaymentStatusRefunded {
+		t.Fatalf("got payment status %q after the second reply, want %q", status, PaymentStatusRefunded)
+	}
+}
+
+func TestHandleOpsReplyIgnoresOtherMessages(t *testing.T) {
+	app, slot := newOpsApp(t)
+	prompt := &tgbotapi.Message{From: &app.bot.Self, Text: opsCancelPrompt + slot.Code + "\n\nОтветьте на это сообщение причиной отмены"}
+
+	tests := []struct {
+		name   string
+		update *tgbotapi.Update
+	}{
+		{"not an operator", opsReply(200, prompt, "Отмена")},
+		{"not a reply", opsReply(100, nil, "Отмена")},
+		{"reply to staff", opsReply(100, &tgbotapi.Message{From: &tgbotapi.User{ID: 300}, Text: prompt.Text}, "Отмена")},
+		{"reply to another bot message", opsReply(100, &tgbotapi.Message{From: &app.bot.Self, Text: "Запись " + slot.Code}, "Отмена")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := app.handleOpsReply(tt.update); err != nil {
+				t.Fatal(err)
+			}
+			if booked, err := GetSlotByCode(app.db, slot.Code); err != nil || booked == nil {
+				t.Fatalf("got booking %v, %v, want it kept", booked, err)
+			}
+		})
+	}
+
+	// The operator's reply to the prompt does cancel
+	if err := app.handleOpsReply(opsReply(100, prompt, "Отмена")); err != nil {
+		t.Fatal(err)
+	}
+	if booked, err := GetSlotByCode(app.db, slot.Code); err != nil || booked != nil {
+		t.Fatalf("got booking %v, %v, want it cancelled", booked, err)
+	}
+}
+
+func TestOpsCardKeyboard(t *testing.T) {
+	app := &App{callbacks: NewCallbackCodec("secret")}
+
+	tests := []struct {
+		state string
+		want  [][]string
+	}{
+		{SlotStatusAwaitingPayment, [][]string{{cbOpsCancel}, {cbOpsMessage}}},
+		{SlotStatusBooked, [][]string{{cbOpsConfirm, cbOpsCancel, cbOpsNoShow}, {cbOpsMessage}}},
+		{OpsStateRescheduled, [][]string{{cbOpsConfirm, cbOpsCancel, cbOpsNoShow}, {cbOpsMessage}}},
+		{OpsStateConfirmed, [][]string{{cbOpsCancel, cbOpsNoShow}, {cbOpsMessage}}},
+		{SlotStatusArrived, [][]string{{cbOpsMessage}}},
+		{SlotStatusNoShow, [][]string{{cbOpsMessage}}},
+		{OpsStateCancelled, [][]string{{cbOpsMessage}}},
+		{OpsStateCancelledByStaff, [][]string{{cbOpsMessage}}},
+		{OpsStateReleased, [][]string{{cbOpsMessage}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			keyboard := app.opsCardKeyboard(&OpsCard{Code: "ABC123", State: tt.state})
+
+			var got [][]string
+			for _, row := range keyboard.InlineKeyboard {
+				var actions []string
+				for _, button := range row {
+					action, args, err := app.callbacks.Decode(*button.CallbackData)
+					if err != nil || len(args) != 1 || args[0] != "ABC123" {
+						t.Fatalf("button %q: got %v, %v, want an action on the booking", button.Text, args, err)
+					}
+					actions = append(actions, action)
+				}
+				got = append(got, actions)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got buttons %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBookingCardEditsGoThroughOutbox(t *testing.T) {
+	config := newTestConfig()
+	config.OpsChatID = -100
+	app := newTestApp(t, config)
+	addTestUsers(t, app.db, 1)
+
+	slot, err := BookTimeSlot(app.db, testSlotTime(10, 0), 1, "user", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.syncBookingCard(slot, SlotStatusBooked, "")
+	app.syncBookingCard(slot, OpsStateConfirmed, "")
+
+	card, err := GetOpsCard(app.db, slot.Code)
+	if err != nil || card == nil {
+		t.Fatalf("card not saved: %v", err)
+	}
+	var kind string
+	var targetID int64
+	err = app.db.QueryRow("SELECT kind, target_id FROM outbox WHERE chat_id = ? ORDER BY id DESC LIMIT 1", config.OpsChatID).Scan(&kind, &targetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != OutboxEdit || targetID != card.OutboxID {
+		t.Fatalf("got %s of item %d, want an edit of the card posted by item %d", kind, targetID, card.OutboxID)
+	}
+
+	app.deliverDueOutbox()
+	stats, err := GetOutboxStats(app.db, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Sent != 2 {
+		t.Fatalf("got %+v, want the card and its edit delivered", stats)
+	}
+}
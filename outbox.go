@@ -0,0 +1,607 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Outbox item kinds
+const (
+	OutboxMessage = "message"
+	OutboxDelete  = "delete" // MessageID is the message to delete
+	OutboxEdit    = "edit"   // MessageID is the message to edit, without Text only its keyboard is replaced
+	OutboxPhoto   = "photo"  // Photo is the picture, Text its caption
+)
+
+// Outbox statuses
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+// Outbox settings
+const (
+	outboxPoll        = time.Second
+	outboxBatch       = 50
+	outboxSenders     = 8 // Chats delivered to at the same time
+	maxOutboxAttempts = 8 // Transient errors are retried with doubling delays, then given up
+	maxOutboxBackoff  = 10 * time.Minute
+	outboxKeep        = 7 * 24 * time.Hour // Finished items are kept this long for /outbox
+)
+
+// Telegram send limits
+const (
+	globalSendInterval = time.Second / 30 // 30 messages per second to all chats
+	chatSendInterval   = time.Second      // 1 message per second to a private chat
+	groupSendInterval  = 3 * time.Second  // 20 messages per minute to a group
+	chatSendBurst      = 3                // Messages a chat may get at once before the spacing applies
+)
+
+// OutboxItem is a message or a deletion waiting to be delivered to Telegram
+type OutboxItem struct {
+	ID          int64
+	ChatID      int64
+	Kind        string
+	Text        string
+	ParseMode   string
+	ReplyMarkup string // JSON, empty for none
+	MessageID   int    // Message to delete or edit, or the message sent
+	Photo       []byte // PNG of a photo
+	TargetID    int64  // Item that sends the message to delete or edit while its ID is not known yet
+	Attempts    int
+	LastError   string
+	CreatedAt   time.Time
+}
+
+// OutboxStats counts outbox items by delivery status
+type OutboxStats struct {
+	Pending int
+	Sent    int
+	Failed  int
+}
+
+// Outbox wakes the sender worker and keeps sends within Telegram's limits
+type Outbox struct {
+	limiter *SendLimiter
+	wake    chan struct{}
+}
+
+// NewOutbox creates the outbox of the bot
+func NewOutbox() *Outbox {
+	return &Outbox{
+		limiter: NewSendLimiter(),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// notify wakes the worker if it is waiting
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SendLimiter spaces sends globally and per chat, letting a chat get a short burst at once
+type SendLimiter struct {
+	mu     sync.Mutex
+	global time.Time           // Earliest time of the next send to any chat
+	chats  map[int64]time.Time // When each chat's burst allowance is fully used up
+}
+
+// NewSendLimiter creates a limiter with nothing sent yet
+func NewSendLimiter() *SendLimiter {
+	return &SendLimiter{chats: make(map[int64]time.Time)}
+}
+
+// chatInterval returns the spacing of sends to a chat, group chats have negative IDs
+func chatInterval(chatID int64) time.Duration {
+	if chatID < 0 {
+		return groupSendInterval
+	}
+	return chatSendInterval
+}
+
+// Reserve books a send to the chat if it may go out now, otherwise returns how long to wait
+// before asking again. Nothing is booked ahead, so a chat at its limit doesn't hold up others.
+func (l *SendLimiter) Reserve(chatID int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	interval := chatInterval(chatID)
+
+	wait := l.global.Sub(now)
+	if chatWait := l.chatWait(chatID, now); chatWait > wait {
+		wait = chatWait
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	chatAt := l.chats[chatID]
+	if chatAt.Before(now) {
+		chatAt = now
+	}
+	l.global = now.Add(globalSendInterval)
+	l.chats[chatID] = chatAt.Add(interval)
+
+	// Forget chats that have their whole burst back
+	if len(l.chats) > 1000 {
+		for id, t := range l.chats {
+			if t.Before(now) {
+				delete(l.chats, id)
+			}
+		}
+	}
+
+	return 0
+}
+
+// ChatWait returns how long the chat has to wait for its next send, not counting the global limit
+func (l *SendLimiter) ChatWait(chatID int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.chatWait(chatID, time.Now())
+}
+
+// chatWait returns how long until the chat gets a send of its burst back, the caller holds the lock
+func (l *SendLimiter) chatWait(chatID int64, now time.Time) time.Duration {
+	burst := time.Duration(chatSendBurst-1) * chatInterval(chatID)
+	return l.chats[chatID].Add(-burst).Sub(now)
+}
+
+// Wait blocks until a send to the chat is allowed and books it
+func (l *SendLimiter) Wait(chatID int64) {
+	for {
+		wait := l.Reserve(chatID)
+		if wait <= 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Pause holds back sends to the chat and to everyone after Telegram answered with retry_after
+func (l *SendLimiter) Pause(chatID int64, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if l.global.Before(until) {
+		l.global = until
+	}
+	if chatAt := until.Add(time.Duration(chatSendBurst-1) * chatInterval(chatID)); l.chats[chatID].Before(chatAt) {
+		l.chats[chatID] = chatAt
+	}
+}
+
+// retryAfter returns how long Telegram asked to wait before sending again, 0 if it didn't
+func retryAfter(err error) time.Duration {
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return time.Duration(apiErr.RetryAfter) * time.Second
+	}
+	return 0
+}
+
+// isPermanentSendError checks if retrying can't help, e.g. the user blocked the bot or the message is gone
+func isPermanentSendError(err error) bool {
+	var apiErr *tgbotapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusForbidden)
+}
+
+// outboxBackoff returns the delay before the next attempt after a transient error
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Second << attempts
+	if backoff <= 0 || backoff > maxOutboxBackoff {
+		return maxOutboxBackoff
+	}
+	return backoff
+}
+
+// EnqueueOutbox stores an item waiting for delivery
+func EnqueueOutbox(db *sql.DB, item *OutboxItem) error {
+	query := `
+		INSERT INTO outbox (chat_id, kind, text, parse_mode, reply_markup, message_id, photo, target_id, status, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	now := time.Now()
+	result, err := db.Exec(query, item.ChatID, item.Kind, item.Text, item.ParseMode, item.ReplyMarkup, item.MessageID,
+		item.Photo, item.TargetID, OutboxPending, now, now)
+	if err != nil {
+		return err
+	}
+	item.ID, err = result.LastInsertId()
+	item.CreatedAt = now
+	return err
+}
+
+// deferOutbox returns a claimed item to the queue until the chat may be sent to again, without counting an attempt
+func deferOutbox(db *sql.DB, itemID int64, until time.Time) error {
+	_, err := db.Exec("UPDATE outbox SET status = ?, next_attempt_at = ? WHERE id = ?", OutboxPending, until, itemID)
+	return err
+}
+
+// ClaimDueOutbox marks the due items as sending and returns them. Only the oldest
+// undelivered item of each chat is due, so every chat gets its items in order.
+func ClaimDueOutbox(db *sql.DB, now time.Time, limit int) ([]OutboxItem, error) {
+	query := `
+		SELECT id, chat_id, kind, text, parse_mode, reply_markup, message_id, photo, target_id, attempts, created_at
+		FROM outbox
+		WHERE status = ? AND next_attempt_at <= ?
+			AND NOT EXISTS (SELECT 1 FROM outbox earlier WHERE earlier.chat_id = outbox.chat_id AND earlier.id < outbox.id AND earlier.status IN (?, ?))
+		ORDER BY id
+		LIMIT ?
+	`
+
+	rows, err := db.Query(query, OutboxPending, now, OutboxPending, OutboxSending, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []OutboxItem
+	for rows.Next() {
+		var item OutboxItem
+		if err := rows.Scan(&item.ID, &item.ChatID, &item.Kind, &item.Text, &item.ParseMode, &item.ReplyMarkup, &item.MessageID,
+			&item.Photo, &item.TargetID, &item.Attempts, &item.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	claimed := items[:0]
+	for _, item := range items {
+		result, err := db.Exec("UPDATE outbox SET status = ? WHERE id = ? AND status = ?", OutboxSending, item.ID, OutboxPending)
+		if err != nil {
+			return nil, err
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+			claimed = append(claimed, item)
+		}
+	}
+	return claimed, nil
+}
+
+// GetOutboxMessageID returns the ID of the message an item sent, 0 if it was not delivered
+func GetOutboxMessageID(db *sql.DB, itemID int64) (int, error) {
+	var messageID int
+	err := db.QueryRow("SELECT message_id FROM outbox WHERE id = ? AND status = ?", itemID, OutboxSent).Scan(&messageID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return messageID, err
+}
+
+// finishOutbox records the outcome of a delivery attempt. Waiting for retry_after doesn't
+// count as an attempt, other transient errors are retried with backoff.
+func finishOutbox(db *sql.DB, item *OutboxItem, messageID int, sendErr error) error {
+	now := time.Now()
+	if sendErr == nil {
+		_, err := db.Exec("UPDATE outbox SET status = ?, message_id = ?, attempts = attempts + 1, sent_at = ? WHERE id = ?",
+			OutboxSent, messageID, now, item.ID)
+		return err
+	}
+
+	if wait := retryAfter(sendErr); wait > 0 {
+		_, err := db.Exec("UPDATE outbox SET status = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+			OutboxPending, now.Add(wait), sendErr.Error(), item.ID)
+		return err
+	}
+
+	attempts := item.Attempts + 1
+	if isPermanentSendError(sendErr) || attempts >= maxOutboxAttempts {
+		_, err := db.Exec("UPDATE outbox SET status = ?, attempts = ?, last_error = ? WHERE id = ?",
+			OutboxFailed, attempts, sendErr.Error(), item.ID)
+		return err
+	}
+
+	_, err := db.Exec("UPDATE outbox SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+		OutboxPending, attempts, now.Add(outboxBackoff(attempts)), sendErr.Error(), item.ID)
+	return err
+}
+
+// ResetSendingOutbox returns items interrupted by a restart to the queue. Such an item
+// may already have reached Telegram, so it can be delivered twice.
+func ResetSendingOutbox(db *sql.DB) error {
+	_, err := db.Exec("UPDATE outbox SET status = ? WHERE status = ?", OutboxPending, OutboxSending)
+	return err
+}
+
+// PruneOutbox deletes finished items created before the given time
+func PruneOutbox(db *sql.DB, before time.Time) error {
+	_, err := db.Exec("DELETE FROM outbox WHERE status IN (?, ?) AND created_at < ?", OutboxSent, OutboxFailed, before)
+	return err
+}
+
+// GetOutboxStats counts the items waiting now and those finished since the given time
+func GetOutboxStats(db *sql.DB, since time.Time) (OutboxStats, error) {
+	var stats OutboxStats
+	query := `
+		SELECT
+			COUNT(CASE WHEN status IN (?, ?) THEN 1 END),
+			COUNT(CASE WHEN status = ? AND created_at >= ? THEN 1 END),
+			COUNT(CASE WHEN status = ? AND created_at >= ? THEN 1 END)
+		FROM outbox
+	`
+
+	err := db.QueryRow(query, OutboxPending, OutboxSending, OutboxSent, since, OutboxFailed, since).Scan(&stats.Pending, &stats.Sent, &stats.Failed)
+	return stats, err
+}
+
+// GetOutboxFailures returns the latest items that could not be delivered
+func GetOutboxFailures(db *sql.DB, limit int) ([]OutboxItem, error) {
+	rows, err := db.Query("SELECT id, chat_id, kind, COALESCE(last_error, ''), created_at FROM outbox WHERE status = ? ORDER BY id DESC LIMIT ?",
+		OutboxFailed, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []OutboxItem
+	for rows.Next() {
+		var item OutboxItem
+		if err := rows.Scan(&item.ID, &item.ChatID, &item.Kind, &item.LastError, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// queueMessage sends a text message through the outbox. An error means the message
+// could not be stored, delivery failures are retried and recorded in the outbox.
+func (app *App) queueMessage(msg tgbotapi.MessageConfig) error {
+	item := &OutboxItem{
+		ChatID:    msg.ChatID,
+		Kind:      OutboxMessage,
+		Text:      msg.Text,
+		ParseMode: msg.ParseMode,
+	}
+	if msg.ReplyMarkup != nil {
+		markup, err := json.Marshal(msg.ReplyMarkup)
+		if err != nil {
+			return err
+		}
+		item.ReplyMarkup = string(markup)
+	}
+	return app.enqueue(item)
+}
+
+// queuePhoto sends a PNG picture with a caption through the outbox
+func (app *App) queuePhoto(chatID int64, picture []byte, caption string) error {
+	return app.enqueue(&OutboxItem{ChatID: chatID, Kind: OutboxPhoto, Text: caption, Photo: picture})
+}
+
+// deleteMessage deletes a message through the outbox
+func (app *App) deleteMessage(chatID int64, messageID int) {
+	if err := app.enqueue(&OutboxItem{ChatID: chatID, Kind: OutboxDelete, MessageID: messageID}); err != nil {
+		log.Printf("Error queueing deletion of message %d in chat %d: %v", messageID, chatID, err)
+	}
+}
+
+// editMessage replaces the text and keyboard of a sent message through the outbox
+func (app *App) editMessage(chatID int64, messageID int, text, parseMode string, markup tgbotapi.InlineKeyboardMarkup) {
+	item := &OutboxItem{ChatID: chatID, Kind: OutboxEdit, MessageID: messageID, Text: text, ParseMode: parseMode}
+	encoded, err := json.Marshal(markup)
+	if err == nil {
+		item.ReplyMarkup = string(encoded)
+		err = app.enqueue(item)
+	}
+	if err != nil {
+		log.Printf("Error queueing edit of message %d in chat %d: %v", messageID, chatID, err)
+	}
+}
+
+// editKeyboard replaces the keyboard of a sent message through the outbox
+func (app *App) editKeyboard(chatID int64, messageID int, markup tgbotapi.InlineKeyboardMarkup) {
+	app.editMessage(chatID, messageID, "", "", markup)
+}
+
+// removeKeyboard removes the buttons from a sent message through the outbox
+func (app *App) removeKeyboard(chatID int64, messageID int) {
+	app.editKeyboard(chatID, messageID, tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}})
+}
+
+// enqueue stores the item and wakes the worker, which delivers it after the earlier items of the chat
+func (app *App) enqueue(item *OutboxItem) error {
+	if err := EnqueueOutbox(app.db, item); err != nil {
+		return err
+	}
+	app.outbox.notify()
+	return nil
+}
+
+// deliver waits until the send limits allow it and makes one attempt to deliver the item
+func (app *App) deliver(item *OutboxItem) (int, error) {
+	app.outbox.limiter.Wait(item.ChatID)
+	return app.deliverNow(item)
+}
+
+// deliverNow makes one attempt to deliver the item, the send is already booked with the limiter
+func (app *App) deliverNow(item *OutboxItem) (int, error) {
+	// The target was queued earlier in the same chat, so it has been delivered or given up by now
+	if item.MessageID == 0 && item.TargetID != 0 {
+		targetID, err := GetOutboxMessageID(app.db, item.TargetID)
+		if err != nil {
+			return 0, err
+		}
+		if targetID == 0 {
+			return 0, &tgbotapi.Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("outbox item %d was not delivered", item.TargetID)}
+		}
+		item.MessageID = targetID
+	}
+
+	var messageID int
+	var err error
+	switch item.Kind {
+	case OutboxDelete:
+		_, err = app.bot.Request(tgbotapi.NewDeleteMessage(item.ChatID, item.MessageID))
+		messageID = item.MessageID
+	case OutboxEdit:
+		var markup tgbotapi.InlineKeyboardMarkup
+		if err = json.Unmarshal([]byte(item.ReplyMarkup), &markup); err != nil {
+			// A stored item that can never be delivered
+			return 0, &tgbotapi.Error{Code: http.StatusBadRequest, Message: err.Error()}
+		}
+		if item.Text == "" {
+			_, err = app.bot.Request(tgbotapi.NewEditMessageReplyMarkup(item.ChatID, item.MessageID, markup))
+		} else {
+			edit := tgbotapi.NewEditMessageTextAndMarkup(item.ChatID, item.MessageID, item.Text, markup)
+			edit.ParseMode = item.ParseMode
+			_, err = app.bot.Request(edit)
+		}
+		messageID = item.MessageID
+	case OutboxPhoto:
+		photo := tgbotapi.NewPhoto(item.ChatID, tgbotapi.FileBytes{Name: "photo.png", Bytes: item.Photo})
+		photo.Caption = item.Text
+		photo.ParseMode = item.ParseMode
+		var sent tgbotapi.Message
+		sent, err = app.bot.Send(photo)
+		messageID = sent.MessageID
+	default:
+		msg := tgbotapi.NewMessage(item.ChatID, item.Text)
+		msg.ParseMode = item.ParseMode
+		if item.ReplyMarkup != "" {
+			msg.ReplyMarkup = json.RawMessage(item.ReplyMarkup)
+		}
+		var sent tgbotapi.Message
+		sent, err = app.bot.Send(msg)
+		messageID = sent.MessageID
+	}
+
+	if wait := retryAfter(err); wait > 0 {
+		app.outbox.limiter.Pause(item.ChatID, wait)
+	}
+	return messageID, err
+}
+
+// recordDelivery stores the outcome of a delivery attempt
+func (app *App) recordDelivery(item *OutboxItem, messageID int, sendErr error) {
+	if sendErr != nil {
+		log.Printf("Error delivering %s %d to chat %d (attempt %d): %v", item.Kind, item.ID, item.ChatID, item.Attempts+1, sendErr)
+	}
+	if err := finishOutbox(app.db, item, messageID, sendErr); err != nil {
+		log.Printf("Error recording delivery of %s %d: %v", item.Kind, item.ID, err)
+	}
+}
+
+// runOutbox delivers queued items until the process exits, waking up when new ones are queued
+func (app *App) runOutbox() {
+	var pruned time.Time
+	for {
+		if time.Since(pruned) > time.Hour {
+			if err := PruneOutbox(app.db, time.Now().Add(-outboxKeep)); err != nil {
+				log.Printf("Error pruning outbox: %v", err)
+			}
+			pruned = time.Now()
+		}
+
+		app.deliverDueOutbox()
+
+		select {
+		case <-app.outbox.wake:
+		case <-time.After(outboxPoll):
+		}
+	}
+}
+
+// deliverDueOutbox delivers due items until none are left. The claimed items belong to
+// different chats, so they are sent in parallel, each sender waiting for the global limit.
+// A chat at its own limit is tried again later instead of holding up a sender.
+func (app *App) deliverDueOutbox() {
+	senders := make(chan struct{}, outboxSenders)
+	for {
+		items, err := ClaimDueOutbox(app.db, time.Now(), outboxBatch)
+		if err != nil {
+			log.Printf("Error getting due outbox items: %v", err)
+			return
+		}
+		if len(items) == 0 {
+			return
+		}
+
+		var wg sync.WaitGroup
+		for i := range items {
+			item := &items[i]
+			if wait := app.outbox.limiter.ChatWait(item.ChatID); wait > 0 {
+				if err := deferOutbox(app.db, item.ID, time.Now().Add(wait)); err != nil {
+					log.Printf("Error deferring %s %d: %v", item.Kind, item.ID, err)
+				}
+				continue
+			}
+
+			senders <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-senders; wg.Done() }()
+				messageID, sendErr := app.deliver(item)
+				app.recordDelivery(item, messageID, sendErr)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// answerCallback answers a button press. Answers expire within seconds, so they are sent
+// right away rather than through the outbox.
+func (app *App) answerCallback(callbackID, text string, alert bool) {
+	answer := tgbotapi.NewCallback(callbackID, text)
+	answer.ShowAlert = alert
+	if _, err := app.bot.Request(answer); err != nil {
+		log.Printf("Error answering callback: %v", err)
+	}
+}
+
+// Handlers
+
+func handleOutbox(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+
+	if !IsAdmin(app.config, update.Message.From.ID) {
+		return app.sendMessage(chatID, "У вас нет прав администратора")
+	}
+
+	stats, err := GetOutboxStats(app.db, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		log.Printf("Error getting outbox stats: %v", err)
+		return app.sendMessage(chatID, "Ошибка при получении статистики отправки")
+	}
+
+	message := fmt.Sprintf(`📬 Исходящие сообщения
+
+В очереди: %d
+Доставлено за сутки: %d
+Не доставлено за сутки: %d`, stats.Pending, stats.Sent, stats.Failed)
+
+	failures, err := GetOutboxFailures(app.db, 5)
+	if err != nil {
+		log.Printf("Error getting outbox failures: %v", err)
+	}
+	if len(failures) > 0 {
+		message += "\n\nПоследние ошибки:"
+		for _, item := range failures {
+			message += fmt.Sprintf("\n%s, чат %d: %s", item.CreatedAt.Format("02.01 15:04"), item.ChatID, html.EscapeString(item.LastError))
+		}
+	}
+
+	return app.sendMessage(chatID, message)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestClaimDueOutboxKeepsChatOrder(t *testing.T) {
+	db := newTestDB(t)
+
+	const messages = 20
+	var wg sync.WaitGroup
+	for i := 0; i < messages; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := EnqueueOutbox(db, &OutboxItem{ChatID: 1, Kind: OutboxMessage, Text: "x"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	if err := EnqueueOutbox(db, &OutboxItem{ChatID: 2, Kind: OutboxMessage, Text: "y"}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// Each chat gets one item at a time, the oldest first
+	var lastID int64
+	for delivered := 0; delivered < messages; delivered++ {
+		items, err := ClaimDueOutbox(db, time.Now(), outboxBatch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var chat1 []OutboxItem
+		for _, item := range items {
+			if item.ChatID == 1 {
+				chat1 = append(chat1, item)
+			}
+		}
+		if len(chat1) != 1 {
+			t.Fatalf("claimed %d items of chat 1 at once, want 1", len(chat1))
+		}
+		if chat1[0].ID <= lastID {
+			t.Fatalf("item %d claimed after item %d", chat1[0].ID, lastID)
+		}
+		lastID = chat1[0].ID
+
+		for i := range items {
+			if err := finishOutbox(db, &items[i], 1, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestDeferOutboxDoesNotCountAttempt(t *testing.T) {
+	db := newTestDB(t)
+	if err := EnqueueOutbox(db, &OutboxItem{ChatID: 1, Kind: OutboxMessage, Text: "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := ClaimDueOutbox(db, time.Now(), outboxBatch)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("claimed %d items: %v", len(items), err)
+	}
+	if err := deferOutbox(db, items[0].ID, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if items, _ := ClaimDueOutbox(db, time.Now(), outboxBatch); len(items) != 0 {
+		t.Fatalf("deferred item claimed before its time")
+	}
+	items, err = ClaimDueOutbox(db, time.Now().Add(2*time.Minute), outboxBatch)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("claimed %d items after the delay: %v", len(items), err)
+	}
+	if items[0].Attempts != 0 {
+		t.Fatalf("got %d attempts, want 0", items[0].Attempts)
+	}
+
+	if err := finishOutbox(db, &items[0], 0, errors.New("network down")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := GetOutboxStats(db, time.Now().Add(-time.Hour))
+	if err != nil || stats.Pending != 1 {
+		t.Fatalf("got %+v, %v: want the item pending for retry", stats, err)
+	}
+}
+
+func TestDeliverDueOutboxThroughput(t *testing.T) {
+	app := newTestApp(t, newTestConfig())
+
+	// Telegram answers slowly, so only parallel senders keep up with the global limit
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	telegram := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+
+		time.Sleep(100 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"username":"queue_bot","message_id":1}}`))
+	}))
+	t.Cleanup(telegram.Close)
+	bot, err := tgbotapi.NewBotAPIWithClient("test", telegram.URL+"/bot%s/%s", telegram.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.bot = bot
+
+	const chats = 30
+	for chatID := int64(1); chatID <= chats; chatID++ {
+		if err := EnqueueOutbox(app.db, &OutboxItem{ChatID: chatID, Kind: OutboxMessage, Text: "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	app.deliverDueOutbox()
+
+	stats, err := GetOutboxStats(app.db, start.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Sent != chats {
+		t.Fatalf("delivered %d of %d messages in one pass", stats.Sent, chats)
+	}
+	if maxInFlight < 2 || maxInFlight > outboxSenders {
+		t.Fatalf("got at most %d requests in flight, want between 2 and %d senders", maxInFlight, outboxSenders)
+	}
+
+	var deferred int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM outbox WHERE next_attempt_at != created_at").Scan(&deferred); err != nil {
+		t.Fatal(err)
+	}
+	if deferred != 0 {
+		t.Fatalf("%d items were put back for the global limit", deferred)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	for attempts := 1; attempts < 64; attempts++ {
+		backoff := outboxBackoff(attempts)
+		if backoff > maxOutboxBackoff {
+			t.Fatalf("attempt %d: got %v, want at most %v", attempts, backoff, maxOutboxBackoff)
+		}
+		if next := outboxBackoff(attempts + 1); next != min(2*backoff, maxOutboxBackoff) {
+			t.Fatalf("attempt %d: got %v after %v, want it doubled up to %v", attempts+1, next, backoff, maxOutboxBackoff)
+		}
+	}
+	if got := outboxBackoff(1); got != 2*time.Second {
+		t.Fatalf("got %v after the first attempt, want 2s", got)
+	}
+}
+
+func TestFinishOutbox(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     int
+		sendErr      error
+		wantStatus   string
+		wantAttempts int
+		wantDelay    time.Duration // Until the next attempt of a pending item
+	}{
+		{"sent", 0, nil, OutboxSent, 1, 0},
+		{"retry after", 3, &tgbotapi.Error{Code: http.StatusTooManyRequests, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 30}},
+			OutboxPending, 3, 30 * time.Second},
+		{"blocked by the user", 0, &tgbotapi.Error{Code: http.StatusForbidden, Message: "bot was blocked by the user"}, OutboxFailed, 1, 0},
+		{"transient error", 2, errors.New("network down"), OutboxPending, 3, outboxBackoff(3)},
+		{"out of attempts", maxOutboxAttempts - 1, errors.New("network down"), OutboxFailed, maxOutboxAttempts, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			item := &OutboxItem{ChatID: 1, Kind: OutboxMessage, Text: "x"}
+			if err := EnqueueOutbox(db, item); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec("UPDATE outbox SET status = ?, attempts = ? WHERE id = ?", OutboxSending, tt.attempts, item.ID); err != nil {
+				t.Fatal(err)
+			}
+			item.Attempts = tt.attempts
+
+			start := time.Now()
+			if err := finishOutbox(db, item, 1, tt.sendErr); err != nil {
+				t.Fatal(err)
+			}
+
+			var status string
+			var attempts int
+			var nextAttempt time.Time
+			err := db.QueryRow("SELECT status, attempts, next_attempt_at FROM outbox WHERE id = ?", item.ID).Scan(&status, &attempts, &nextAttempt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.wantStatus || attempts != tt.wantAttempts {
+				t.Fatalf("got %s after %d attempts, want %s after %d", status, attempts, tt.wantStatus, tt.wantAttempts)
+			}
+			if tt.wantStatus == OutboxPending {
+				if delay := nextAttempt.Sub(start); delay < tt.wantDelay || delay > tt.wantDelay+time.Second {
+					t.Fatalf("next attempt in %v, want %v", delay, tt.wantDelay)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxEditsQueuedMessage(t *testing.T) {
+	app := newTestApp(t, newTestConfig())
+
+	post := &OutboxItem{ChatID: 1, Kind: OutboxMessage, Text: "card"}
+	if err := app.enqueue(post); err != nil {
+		t.Fatal(err)
+	}
+	edit := &OutboxItem{ChatID: 1, Kind: OutboxEdit, Text: "card v2", ReplyMarkup: `{"inline_keyboard":[]}`, TargetID: post.ID}
+	if err := app.enqueue(edit); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.queuePhoto(1, []byte("png"), "QR"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The items of a chat go out one after another, the edit once the post has its ID
+	app.deliverDueOutbox()
+
+	stats, err := GetOutboxStats(app.db, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Sent != 3 || stats.Failed != 0 {
+		t.Fatalf("got %+v, want the post, its edit and the photo delivered", stats)
+	}
+	if messageID, err := GetOutboxMessageID(app.db, edit.ID); err != nil || messageID != 1 {
+		t.Fatalf("edit applied to message %d (%v), want the posted message 1", messageID, err)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Payment statuses
+const (
+	PaymentStatusPaid          = "paid"
+	PaymentStatusRefunded      = "refunded"
+	PaymentStatusRefundPending = "refund_pending" // Has to be refunded manually in the provider dashboard
+	PaymentStatusForfeited     = "forfeited"      // Kept after a late cancellation
+)
+
+// ErrPaymentRecorded is returned when Telegram delivers an already recorded payment again
+var ErrPaymentRecorded = errors.New("payment is already recorded")
+
+// Payment represents a deposit paid for a booking
+type Payment struct {
+	ID               int64
+	SlotID           int
+	UserID           int64
+	Code             string // Booking the deposit was paid for; slots are reused by later bookings
+	Amount           int    // Minor currency units
+	Currency         string
+	TelegramChargeID string
+	ProviderChargeID string
+	Status           string
+	CreatedAt        time.Time
+}
+
+// Invoice describes a deposit request sent to a user
+type Invoice struct {
+	ChatID      int64
+	Title       string
+	Description string
+	Payload     string
+	Currency    string
+	Amount      int
+}
+
+// PaymentProvider abstracts the payment backend so the flow can run against a local fake
+type PaymentProvider interface {
+	// SendInvoice asks the user to pay
+	SendInvoice(invoice Invoice) error
+	// AnswerPreCheckout accepts or rejects a payment before it is charged
+	AnswerPreCheckout(queryID string, ok bool, errorMessage string) error
+	// Refund returns the deposit and reports the resulting payment status
+	Refund(payment *Payment) (string, error)
+}
+
+// newPaymentProvider creates the provider selected in config
+func (app *App) newPaymentProvider() PaymentProvider {
+	if app.config.PaymentProvider == "fake" {
+		log.Println("Using fake payment provider, deposits are not charged")
+		return NewFakePaymentProvider(app.processUpdate)
+	}
+	return NewTelegramPaymentProvider(app.bot, app.config.PaymentToken)
+}
+
+// TelegramPaymentProvider sends invoices through Telegram Payments
+type TelegramPaymentProvider struct {
+	bot   *tgbotapi.BotAPI
+	token string
+}
+
+// NewTelegramPaymentProvider creates a Telegram Payments provider
+func NewTelegramPaymentProvider(bot *tgbotapi.BotAPI, token string) *TelegramPaymentProvider {
+	return &TelegramPaymentProvider{bot: bot, token: token}
+}
+
+// SendInvoice sends a Telegram invoice
+func (p *TelegramPaymentProvider) SendInvoice(invoice Invoice) error {
+	prices := []tgbotapi.LabeledPrice{{Label: invoice.Title, Amount: invoice.Amount}}
+	config := tgbotapi.NewInvoice(invoice.ChatID, invoice.Title, invoice.Description, invoice.Payload, p.token, "deposit", invoice.Currency, prices)
+	_, err := p.bot.Send(config)
+	return err
+}
+
+// AnswerPreCheckout answers a Telegram pre-checkout query
+func (p *TelegramPaymentProvider) AnswerPreCheckout(queryID string, ok bool, errorMessage string) error {
+	_, err := p.bot.Request(tgbotapi.PreCheckoutConfig{
+		PreCheckoutQueryID: queryID,
+		OK:                 ok,
+		ErrorMessage:       errorMessage,
+	})
+	return err
+}
+
+// Refund can't be done through the Bot API for provider payments,
+// so the payment is left for a manual refund in the provider dashboard
+func (p *TelegramPaymentProvider) Refund(payment *Payment) (string, error) {
+	return PaymentStatusRefundPending, nil
+}
+
+// FakePaymentProvider simulates Telegram Payments locally by feeding
+// pre_checkout_query and successful_payment updates back into the bot
+type FakePaymentProvider struct {
+	mu       sync.Mutex
+	deliver  func(*tgbotapi.Update) error
+	invoices map[string]Invoice
+	seq      int
+}
+
+// NewFakePaymentProvider creates a fake provider delivering updates to the given handler
+func NewFakePaymentProvider(deliver func(*tgbotapi.Update) error) *FakePaymentProvider {
+	return &FakePaymentProvider{
+		deliver:  deliver,
+		invoices: make(map[string]Invoice),
+	}
+}
+
+// SendInvoice immediately starts checkout as if the user pressed "Pay"
+func (p *FakePaymentProvider) SendInvoice(invoice Invoice) error {
+	p.mu.Lock()
+	p.seq++
+	queryID := fmt.Sprintf("fake-%d", p.seq)
+	p.invoices[queryID] = invoice
+	p.mu.Unlock()
+
+	return p.deliver(&tgbotapi.Update{
+		PreCheckoutQuery: &tgbotapi.PreCheckoutQuery{
+			ID:             queryID,
+			From:           &tgbotapi.User{ID: invoice.ChatID},
+			Currency:       invoice.Currency,
+			TotalAmount:    invoice.Amount,
+			InvoicePayload: invoice.Payload,
+		},
+	})
+}
+
+// AnswerPreCheckout completes the payment when checkout was accepted
+func (p *FakePaymentProvider) AnswerPreCheckout(queryID string, ok bool, errorMessage string) error {
+	p.mu.Lock()
+	invoice, exists := p.invoices[queryID]
+	delete(p.invoices, queryID)
+	p.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("unknown pre-checkout query %s", queryID)
+	}
+	if !ok {
+		log.Printf("Fake payment %s rejected: %s", queryID, errorMessage)
+		return nil
+	}
+
+	return p.deliver(&tgbotapi.Update{
+		Message: &tgbotapi.Message{
+			From: &tgbotapi.User{ID: invoice.ChatID},
+			Chat: &tgbotapi.Chat{ID: invoice.ChatID},
+			Date: int(time.Now().Unix()),
+			SuccessfulPayment: &tgbotapi.SuccessfulPayment{
+				Currency:                invoice.Currency,
+				TotalAmount:             invoice.Amount,
+				InvoicePayload:          invoice.Payload,
+				TelegramPaymentChargeID: "fake-tg-" + queryID,
+				ProviderPaymentChargeID: "fake-provider-" + queryID,
+			},
+		},
+	})
+}
+
+// Refund always succeeds
+func (p *FakePaymentProvider) Refund(payment *Payment) (string, error) {
+	return PaymentStatusRefunded, nil
+}
+
+// Database functions
+
+// CheckSlotHold returns the slot if the booking is still held for the user and awaiting payment
+func CheckSlotHold(db *sql.DB, slotID int, code string, userID int64) (*Slot, error) {
+	slot, err := GetSlotByID(db, slotID)
+	if err != nil || slot == nil {
+		return nil, err
+	}
+	if slot.UserID.Int64 != userID || slot.Code != code || slot.Status != SlotStatusAwaitingPayment || !slot.HoldUntil.Time.After(time.Now()) {
+		return nil, nil
+	}
+	return slot, nil
+}
+
+// ConfirmSlotPayment records a payment, confirms the held slot and schedules its reminders.
+// The payment is recorded even if the hold has expired, so it can be refunded.
+func ConfirmSlotPayment(db *sql.DB, payment *Payment, config *Config) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var recordedID int64
+	err = tx.QueryRow("SELECT id FROM payments WHERE telegram_charge_id = ?", payment.TelegramChargeID).Scan(&recordedID)
+	if err == nil {
+		return false, ErrPaymentRecorded
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE slots
+		SET status = ?, hold_until = NULL
+		WHERE id = ? AND user_id = ? AND code = ? AND status = ? AND hold_until > ?
+	`, SlotStatusBooked, payment.SlotID, payment.UserID, payment.Code, SlotStatusAwaitingPayment, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	insertQuery := `
+		INSERT INTO payments (slot_id, user_id, code, amount, currency, telegram_charge_id, provider_charge_id, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	insert, err := tx.Exec(insertQuery, payment.SlotID, payment.UserID, payment.Code, payment.Amount, payment.Currency,
+		payment.TelegramChargeID, payment.ProviderChargeID, PaymentStatusPaid)
+	if err != nil {
+		return false, err
+	}
+
+	payment.ID, err = insert.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+	payment.Status = PaymentStatusPaid
+
+	if affected > 0 {
+		slot := Slot{ID: payment.SlotID, UserID: sql.NullInt64{Int64: payment.UserID, Valid: true}}
+		if err := tx.QueryRow("SELECT start_time FROM slots WHERE id = ?", payment.SlotID).Scan(&slot.StartTime); err != nil {
+			return false, err
+		}
+		if err := scheduleReminders(tx, &slot, config); err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// GetBookingPayment returns the paid, not yet refunded deposit of the slot's current booking
+func GetBookingPayment(db *sql.DB, slot *Slot) (*Payment, error) {
+	query := `
+		SELECT id, slot_id, user_id, code, amount, currency, telegram_charge_id, COALESCE(provider_charge_id, ''), status, created_at
+		FROM payments
+		WHERE slot_id = ? AND user_id = ? AND code = ? AND status = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`
+
+	var p Payment
+	err := db.QueryRow(query, slot.ID, slot.UserID.Int64, slot.Code, PaymentStatusPaid).Scan(
+		&p.ID, &p.SlotID, &p.UserID, &p.Code, &p.Amount, &p.Currency, &p.TelegramChargeID, &p.ProviderChargeID, &p.Status, &p.CreatedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No deposit paid
+		}
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// UpdatePaymentStatus records the result of a refund
+func UpdatePaymentStatus(db *sql.DB, paymentID int64, status string) error {
+	_, err := db.Exec("UPDATE payments SET status = ?, refunded_at = ? WHERE id = ?", status, time.Now(), paymentID)
+	return err
+}
+
+// ForfeitPayment marks a deposit as kept under the cancellation policy
+func ForfeitPayment(db *sql.DB, paymentID int64) error {
+	_, err := db.Exec("UPDATE payments SET status = ? WHERE id = ?", PaymentStatusForfeited, paymentID)
+	return err
+}
+
+// Handlers
+
+// invoicePayload identifies the held slot in an invoice
+func invoicePayload(slot *Slot) string {
+	return fmt.Sprintf("%d:%s", slot.ID, slot.Code)
+}
+
+// parseInvoicePayload extracts the slot ID and booking code from an invoice payload
+func parseInvoicePayload(payload string) (int, string, error) {
+	idStr, code, _ := strings.Cut(payload, ":")
+	slotID, err := strconv.Atoi(idStr)
+	return slotID, code, err
+}
+
+// formatAmount formats minor currency units for display
+func formatAmount(amount int, currency string) string {
+	return fmt.Sprintf("%d.%02d %s", amount/100, amount%100, currency)
+}
+
+// requestDeposit asks the user to pay the deposit for a held slot
+func (app *App) requestDeposit(chatID int64, slot *Slot) error {
+	message := fmt.Sprintf(`⏳ Время %s забронировано за вами до %s.
+
+Чтобы подтвердить запись, оплатите депозит %s.`,
+		slot.StartTime.Format("02.01.2006 15:04"),
+		slot.HoldUntil.Time.Format("15:04"),
+		formatAmount(app.config.DepositAmount, app.config.DepositCurrency))
+	app.sendMessage(chatID, message)
+
+	invoice := Invoice{
+		ChatID:      chatID,
+		Title:       "Депозит за запись",
+		Description: fmt.Sprintf("Запись на %s, код %s", slot.StartTime.Format("02.01.2006 15:04"), slot.Code),
+		Payload:     invoicePayload(slot),
+		Currency:    app.config.DepositCurrency,
+		Amount:      app.config.DepositAmount,
+	}
+
+	if err := app.payments.SendInvoice(invoice); err != nil {
+		log.Printf("Error sending invoice for slot %d: %v", slot.ID, err)
+		CancelSlot(app.db, slot.ID, slot.UserID.Int64)
+		return app.sendMessage(chatID, "❌ Не удалось выставить счёт. Попробуйте записаться позже.")
+	}
+
+	return nil
+}
+
+// handlePreCheckoutQuery confirms the slot is still held before the user is charged
+func (app *App) handlePreCheckoutQuery(query *tgbotapi.PreCheckoutQuery) error {
+	slotID, code, err := parseInvoicePayload(query.InvoicePayload)
+	if err != nil {
+		return app.payments.AnswerPreCheckout(query.ID, false, "Неверный счёт")
+	}
+
+	slot, err := CheckSlotHold(app.db, slotID, code, query.From.ID)
+	if err != nil {
+		log.Printf("Error checking slot hold: %v", err)
+		return app.payments.AnswerPreCheckout(query.ID, false, "Произошла ошибка. Попробуйте позже.")
+	}
+	if slot == nil {
+		return app.payments.AnswerPreCheckout(query.ID, false, "Время удержания слота истекло. Пожалуйста, запишитесь заново.")
+	}
+	if query.TotalAmount != app.config.DepositAmount || query.Currency != app.config.DepositCurrency {
+		return app.payments.AnswerPreCheckout(query.ID, false, "Сумма счёта изменилась. Пожалуйста, запишитесь заново.")
+	}
+
+	return app.payments.AnswerPreCheckout(query.ID, true, "")
+}
+
+// handleSuccessfulPayment confirms the booking once the deposit is paid
+func (app *App) handleSuccessfulPayment(update *tgbotapi.Update) error {
+	paid := update.Message.SuccessfulPayment
+	chatID := update.Message.Chat.ID
+
+	slotID, code, err := parseInvoicePayload(paid.InvoicePayload)
+	if err != nil {
+		log.Printf("Payment with unknown payload %q from user %d", paid.InvoicePayload, update.Message.From.ID)
+		return nil
+	}
+
+	payment := &Payment{
+		SlotID:           slotID,
+		UserID:           update.Message.From.ID,
+		Code:             code,
+		Amount:           paid.TotalAmount,
+		Currency:         paid.Currency,
+		TelegramChargeID: paid.TelegramPaymentChargeID,
+		ProviderChargeID: paid.ProviderPaymentChargeID,
+	}
+
+	confirmed, err := ConfirmSlotPayment(app.db, payment, app.config)
+	if errors.Is(err, ErrPaymentRecorded) {
+		// A redelivered update, the visitor was answered the first time
+		log.Printf("Payment %s for slot %d is already recorded", payment.TelegramChargeID, slotID)
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error recording payment for slot %d: %v", slotID, err)
+		app.notifyAdmins(fmt.Sprintf("⚠️ Не удалось сохранить оплату %s пользователя %d (charge %s)",
+			formatAmount(payment.Amount, payment.Currency), payment.UserID, payment.TelegramChargeID))
+		return app.sendMessage(chatID, "Оплата получена, но произошла ошибка. Администратор свяжется с вами.")
+	}
+
+	if !confirmed {
+		// The hold expired while the user was paying
+		app.sendMessage(chatID, "❌ Время удержания слота истекло до поступления оплаты. Депозит будет возвращён.")
+		return app.refundPayment(payment)
+	}
+
+	slot, err := GetSlotByID(app.db, slotID)
+	if err != nil || slot == nil {
+		return app.sendMessage(chatID, "✅ Оплата получена, запись подтверждена.")
+	}
+	app.syncBookingCard(slot, SlotStatusBooked, "Депозит оплачен")
+
+	message := fmt.Sprintf("✅ Оплата получена, запись подтверждена:\n📅 %s\n🔖 Код записи: <b>%s</b>", slot.StartTime.Format("02.01.2006 15:04"), slot.Code)
+	if err := app.sendMessage(chatID, message); err != nil {
+		return err
+	}
+	app.sendBookingQR(chatID, slot)
+	app.askVisitReason(chatID, slot)
+	return nil
+}
+
+// releaseExpiredHolds frees the slots whose deposit was not paid in time, updates their
+// cards and offers the times to the waitlist. Runs on every scheduler tick.
+func (app *App) releaseExpiredHolds() {
+	slots, err := ReleaseExpiredHolds(app.db)
+	if err != nil {
+		log.Printf("Error releasing expired holds: %v", err)
+		return
+	}
+
+	for i := range slots {
+		slot := &slots[i]
+		log.Printf("Released unpaid slot %d of user %d", slot.ID, slot.UserID.Int64)
+		app.offerReleasedSlot(slot.StartTime)
+		app.syncBookingCard(slot, OpsStateReleased, "")
+	}
+}
+
+// refundOnCancel refunds the deposit of a cancelled slot if the cancellation policy allows it
+func (app *App) refundOnCancel(slot *Slot, byAdmin bool) error {
+	payment, err := GetBookingPayment(app.db, slot)
+	if err != nil || payment == nil {
+		return err
+	}
+
+	cutoff := time.Duration(app.config.RefundCutoff) * time.Hour
+	if !byAdmin && time.Until(slot.StartTime) < cutoff {
+		if err := ForfeitPayment(app.db, payment.ID); err != nil {
+			return err
+		}
+		return app.sendMessage(payment.UserID, fmt.Sprintf("Депозит не возвращается при отмене менее чем за %d ч. до приёма.", app.config.RefundCutoff))
+	}
+
+	return app.refundPayment(payment)
+}
+
+// refundPayment refunds a payment through the provider and records the result
+func (app *App) refundPayment(payment *Payment) error {
+	status, err := app.payments.Refund(payment)
+	if err != nil {
+		log.Printf("Error refunding payment %d: %v", payment.ID, err)
+		status = PaymentStatusRefundPending
+	}
+
+	if err := UpdatePaymentStatus(app.db, payment.ID, status); err != nil {
+		log.Printf("Error updating payment %d: %v", payment.ID, err)
+	}
+
+	amount := formatAmount(payment.Amount, payment.Currency)
+	if status == PaymentStatusRefundPending {
+		app.notifyAdmins(fmt.Sprintf("💸 Требуется возврат депозита %s пользователю %d (charge %s)",
+			amount, payment.UserID, payment.TelegramChargeID))
+		return app.sendMessage(payment.UserID, fmt.Sprintf("💸 Депозит %s будет возвращён в ближайшее время.", amount))
+	}
+
+	return app.sendMessage(payment.UserID, fmt.Sprintf("💸 Депозит %s возвращён.", amount))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// newDepositConfig returns the test schedule taking deposits through the fake provider
+func newDepositConfig() *Config {
+	config := newTestConfig()
+	config.PaymentProvider = "fake"
+	config.DepositAmount = 50000
+	config.DepositCurrency = "RUB"
+	config.PaymentHoldTime = 15
+	config.RefundCutoff = 24
+	return config
+}
+
+// newDepositApp creates an app taking deposits through the fake provider
+func newDepositApp(t *testing.T) *App {
+	app := newTestApp(t, newDepositConfig())
+	app.payments = app.newPaymentProvider()
+	addTestUsers(t, app.db, 1)
+	return app
+}
+
+// paymentStatus returns the status of the latest payment for the slot, empty if none
+func paymentStatus(t *testing.T, db *sql.DB, slotID int) string {
+	t.Helper()
+	var status string
+	err := db.QueryRow("SELECT status FROM payments WHERE slot_id = ? ORDER BY id DESC LIMIT 1", slotID).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// expireHold moves the slot's hold into the past
+func expireHold(t *testing.T, db *sql.DB, slotID int) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE slots SET hold_until = ? WHERE id = ?", time.Now().Add(-time.Minute), slotID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDepositPaidAndRefundedOnCancel(t *testing.T) {
+	app := newDepositApp(t)
+
+	slot, err := BookTimeSlot(app.db, testSlotTime(10, 0), 1, "user", app.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot.Status != SlotStatusAwaitingPayment {
+		t.Fatalf("got status %q, want the slot held for payment", slot.Status)
+	}
+
+	// The fake runs pre_checkout and successful_payment right away
+	if err := app.requestDeposit(1, slot); err != nil {
+		t.Fatal(err)
+	}
+
+	booked, err := GetSlotByID(app.db, slot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if booked.Status != SlotStatusBooked || booked.HoldUntil.Valid {
+		t.Fatalf("got status %q with hold %v, want a confirmed booking", booked.Status, booked.HoldUntil)
+	}
+	if status := paymentStatus(t, app.db, slot.ID); status != PaymentStatusPaid {
+		t.Fatalf("got payment status %q, want %q", status, PaymentStatusPaid)
+	}
+
+	if err := CancelSlot(app.db, slot.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.refundOnCancel(booked, false); err != nil {
+		t.Fatal(err)
+	}
+	if status := paymentStatus(t, app.db, slot.ID); status != PaymentStatusRefunded {
+		t.Fatalf("got payment status %q after cancelling, want %q", status, PaymentStatusRefunded)
+	}
+}
+
+func TestDepositRejectedAfterHoldReleased(t *testing.T) {
+	app := newDepositApp(t)
+	app.config.OpsChatID = -100
+
+	slot, err := BookTimeSlot(app.db, testSlotTime(10, 0), 1, "user", app.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expireHold(t, app.db, slot.ID)
+
+	// Reading the user's bookings leaves the hold to the scheduler
+	if active, err := GetUserActiveSlot(app.db, 1); err != nil || active == nil {
+		t.Fatalf("got %+v, %v: want the expired hold kept until the scheduler releases it", active, err)
+	}
+	app.releaseExpiredHolds()
+
+	card, err := GetOpsCard(app.db, slot.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card == nil || card.State != OpsStateReleased {
+		t.Fatalf("got ops card %+v, want it marked released", card)
+	}
+
+	released, err := GetSlotByID(app.db, slot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released.UserID.Valid {
+		t.Fatalf("expired hold still belongs to user %d", released.UserID.Int64)
+	}
+
+	// Checkout is refused, so nothing is charged
+	if err := app.requestDeposit(1, slot); err != nil {
+		t.Fatal(err)
+	}
+	if status := paymentStatus(t, app.db, slot.ID); status != "" {
+		t.Fatalf("got payment status %q, want no payment", status)
+	}
+}
+
+func TestPaymentAfterHoldExpiredIsRefunded(t *testing.T) {
+	app := newDepositApp(t)
+
+	slot, err := BookTimeSlot(app.db, testSlotTime(10, 0), 1, "user", app.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expireHold(t, app.db, slot.ID)
+
+	// The payment arrives after the hold ran out
+	err = app.processUpdate(&tgbotapi.Update{Message: &tgbotapi.Message{
+		From: &tgbotapi.User{ID: 1},
+		Chat: &tgbotapi.Chat{ID: 1},
+		SuccessfulPayment: &tgbotapi.SuccessfulPayment{
+			Currency:                app.config.DepositCurrency,
+			TotalAmount:             app.config.DepositAmount,
+			InvoicePayload:          invoicePayload(slot),
+			TelegramPaymentChargeID: "tg-1",
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := paymentStatus(t, app.db, slot.ID); status != PaymentStatusRefunded {
+		t.Fatalf("got payment status %q, want the late payment refunded", status)
+	}
+}
+
+func TestRedeliveredPaymentIsRecordedOnce(t *testing.T) {
+	app := newDepositApp(t)
+
+	slot, err := BookTimeSlot(app.db, testSlotTime(10, 0), 1, "user", app.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Telegram delivers the same successful_payment twice
+	update := &tgbotapi.Update{Message: &tgbotapi.Message{
+		From: &tgbotapi.User{ID: 1},
+		Chat: &tgbotapi.Chat{ID: 1},
+		SuccessfulPayment: &tgbotapi.SuccessfulPayment{
+			Currency:                app.config.DepositCurrency,
+			TotalAmount:             app.config.DepositAmount,
+			InvoicePayload:          invoicePayload(slot),
+			TelegramPaymentChargeID: "tg-1",
+		},
+	}}
+	for i := 0; i < 2; i++ {
+		if err := app.processUpdate(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM payments WHERE slot_id = ?", slot.ID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d payments, want the redelivered one recorded once", count)
+	}
+	if status := paymentStatus(t, app.db, slot.ID); status != PaymentStatusPaid {
+		t.Fatalf("got payment status %q, want %q", status, PaymentStatusPaid)
+	}
+	booked, err := GetSlotByID(app.db, slot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if booked.Status != SlotStatusBooked {
+		t.Fatalf("got status %q, want the booking confirmed", booked.Status)
+	}
+}
+
+func TestLateCancelForfeitsOnlyThatBookingsDeposit(t *testing.T) {
+	app := newDepositApp(t)
+	addTestUsers(t, app.db, 2)
+	slotTime := testSlotTime(10, 0)
+	app.config.RefundCutoff = int(time.Until(slotTime).Hours()) + 1
+
+	// The first visitor pays and cancels too late for a refund
+	first, err := BookTimeSlot(app.db, slotTime, 1, "first", app.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.requestDeposit(1, first); err != nil {
+		t.Fatal(err)
+	}
+	paid, err := GetSlotByID(app.db, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CancelSlot(app.db, first.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.refundOnCancel(paid, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another visitor books the same time, pays and is cancelled by an admin
+	second, err := BookTimeSlot(app.db, slotTime, 2, "second", app.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID {
+		t.Fatalf("got slot %d, want the slot %d reused", second.ID, first.ID)
+	}
+	if err := app.requestDeposit(2, second); err != nil {
+		t.Fatal(err)
+	}
+	paid, err = GetSlotByID(app.db, second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReleaseSlot(app.db, second.ID, second.Code); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.refundOnCancel(paid, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for userID, want := range map[int64]string{1: PaymentStatusForfeited, 2: PaymentStatusRefunded} {
+		var status string
+		if err := app.db.QueryRow("SELECT status FROM payments WHERE user_id = ?", userID).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status != want {
+			t.Fatalf("got deposit of user %d %q, want %q", userID, status, want)
+		}
+	}
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Ticket statuses
+const (
+	TicketStatusWaiting   = "waiting"
+	TicketStatusCalled    = "called"
+	TicketStatusServed    = "served"
+	TicketStatusSkipped   = "skipped"
+	TicketStatusCancelled = "cancelled"
+)
+
+// Queue errors
+var (
+	ErrQueueClosed    = errors.New("live queue is closed")
+	ErrAlreadyInQueue = errors.New("user already has a ticket")
+	ErrAlreadyServed  = errors.New("booking was already served")
+	ErrQueueEmpty     = errors.New("no waiting tickets")
+)
+
+// Ticket kinds
+const (
+	TicketKindWalkIn      = "walkin"
+	TicketKindAppointment = "appointment" // Booked visitor who arrived for their slot
+)
+
+// queueDateLayout is the format of tickets.queue_date
+const queueDateLayout = "2006-01-02"
+
+// Ticket represents a live queue ticket
+type Ticket struct {
+	ID         int64
+	QueueDate  string
+	Prefix     string
+	Number     int
+	UserID     sql.NullInt64 // NULL for tickets issued without Telegram
+	Status     string
+	IssuedAt   time.Time
+	CalledAt   sql.NullTime
+	ServedAt   sql.NullTime
+	Counter    sql.NullInt64 // Window the ticket was called to
+	Operator   sql.NullInt64 // Telegram ID of the operator who called it
+	NotifiedAt sql.NullTime  // When the visitor was told their turn is near
+	Kind       string
+	SlotID     sql.NullInt64 // Booked slot of an appointment ticket
+	DueAt      sql.NullTime  // Appointment time of an appointment ticket
+	StartedAt  sql.NullTime  // When the visitor reached the counter
+	Service    sql.NullString
+	Stage      int          // Index of the current route stage
+	StageAt    sql.NullTime // When the ticket moved to its current stage, NULL for the first one
+}
+
+// Label returns the ticket number as shown to visitors, e.g. A-042
+func (t *Ticket) Label() string {
+	return fmt.Sprintf("%s-%03d", t.Prefix, t.Number)
+}
+
+// QueuedAt returns when the ticket joined the queue of its current stage
+func (t *Ticket) QueuedAt() time.Time {
+	if t.StageAt.Valid {
+		return t.StageAt.Time
+	}
+	return t.IssuedAt
+}
+
+// ticketColumns is the column list scanned by scanTicket
+const ticketColumns = "id, queue_date, prefix, number, user_id, status, issued_at, called_at, served_at, counter, operator_id, notified_at, COALESCE(kind, 'walkin'), slot_id, due_at, started_at, service, COALESCE(stage, 0), stage_at"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanTicket scans a row selected with ticketColumns
+func scanTicket(row rowScanner) (*Ticket, error) {
+	var t Ticket
+	err := row.Scan(&t.ID, &t.QueueDate, &t.Prefix, &t.Number, &t.UserID, &t.Status, &t.IssuedAt, &t.CalledAt, &t.ServedAt, &t.Counter, &t.Operator, &t.NotifiedAt, &t.Kind, &t.SlotID, &t.DueAt, &t.StartedAt, &t.Service, &t.Stage, &t.StageAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// IsQueueOpen checks if walk-in tickets can be issued at the given time
+func IsQueueOpen(now time.Time, config *Config) bool {
+	if config.SkipWeekend && IsWeekend(now) {
+		return false
+	}
+
+	workStart, err := time.Parse("15:04", config.WorkStart)
+	if err != nil {
+		return false
+	}
+	workEnd, err := time.Parse("15:04", config.WorkEnd)
+	if err != nil {
+		return false
+	}
+
+	// Compare minutes of the day, so "9:00" and "09:00" mean the same
+	minute := now.Hour()*60 + now.Minute()
+	return minute >= workStart.Hour()*60+workStart.Minute() && minute < workEnd.Hour()*60+workEnd.Minute()
+}
+
+// IssueTicket issues the next walk-in ticket of today's queue.
+// userID is 0 for visitors without Telegram; a Telegram user gets at most one active ticket.
+func IssueTicket(db *sql.DB, userID int64, config *Config) (*Ticket, error) {
+	ticket := &Ticket{
+		Kind:   TicketKindWalkIn,
+		Prefix: config.QueuePrefix,
+	}
+	if userID != 0 {
+		ticket.UserID = sql.NullInt64{Int64: userID, Valid: true}
+	}
+	return issueTicket(db, ticket, config)
+}
+
+// IssueAppointmentTicket puts a booked visitor who arrived for today's slot into the queue
+func IssueAppointmentTicket(db *sql.DB, slot *Slot, config *Config) (*Ticket, error) {
+	ticket := &Ticket{
+		Kind:   TicketKindAppointment,
+		Prefix: config.AppointmentPrefix,
+		UserID: slot.UserID,
+		SlotID: sql.NullInt64{Int64: int64(slot.ID), Valid: true},
+		DueAt:  sql.NullTime{Time: slot.StartTime, Valid: true},
+	}
+	return issueTicket(db, ticket, config)
+}
+
+// issueTicket numbers and stores a ticket of the given kind, prefix, user and appointment
+func issueTicket(db *sql.DB, ticket *Ticket, config *Config) (*Ticket, error) {
+	now := time.Now()
+	if !IsQueueOpen(now, config) {
+		return nil, ErrQueueClosed
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	queueDate := now.Format(queueDateLayout)
+
+	if ticket.UserID.Valid {
+		var exists bool
+		err := tx.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM tickets WHERE queue_date = ? AND user_id = ? AND status IN (?, ?))",
+			queueDate, ticket.UserID.Int64, TicketStatusWaiting, TicketStatusCalled,
+		).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, ErrAlreadyInQueue
+		}
+	}
+
+	// A booking is served once, the visitor can't get its priority again while the slot lasts
+	if ticket.SlotID.Valid {
+		var served bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM tickets WHERE slot_id = ? AND status = ?)", ticket.SlotID.Int64, TicketStatusServed).Scan(&served)
+		if err != nil {
+			return nil, err
+		}
+		if served {
+			return nil, ErrAlreadyServed
+		}
+	}
+
+	err = tx.QueryRow("SELECT COALESCE(MAX(number), 0) + 1 FROM tickets WHERE queue_date = ? AND prefix = ?", queueDate, ticket.Prefix).Scan(&ticket.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket.QueueDate = queueDate
+	ticket.Status = TicketStatusWaiting
+	ticket.IssuedAt = now
+
+	insertQuery := `
+		INSERT INTO tickets (queue_date, prefix, number, user_id, status, issued_at, kind, slot_id, due_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := tx.Exec(insertQuery, ticket.QueueDate, ticket.Prefix, ticket.Number, ticket.UserID, ticket.Status, ticket.IssuedAt,
+		ticket.Kind, ticket.SlotID, ticket.DueAt)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ticket, nil
+}
+
+// Queue order
+//
+// Appointments and walk-ins share one queue. A ticket's priority class depends on the time:
+//   - appointments within the grace window around their slot start are called first, by slot time;
+//   - walk-ins, and appointments that arrived after the window closed, follow in order of arrival;
+//   - appointments that arrived before their window opened fill the gaps once no one else is waiting.
+//
+// Appointment priority applies at the first stage of the route; later stages serve in order of arrival at the stage.
+
+// Ticket priority classes, lower is called first
+const (
+	ticketPriorityDue = iota
+	ticketPriorityArrival
+	ticketPriorityEarly
+)
+
+// ticketPriority returns the priority class of a waiting ticket at the given time
+func ticketPriority(ticket *Ticket, now time.Time, grace time.Duration) int {
+	if ticket.Kind != TicketKindAppointment || !ticket.DueAt.Valid || ticket.Stage > 0 {
+		return ticketPriorityArrival
+	}
+	switch {
+	case now.Before(ticket.DueAt.Time.Add(-grace)):
+		return ticketPriorityEarly
+	case now.After(ticket.DueAt.Time.Add(grace)):
+		return ticketPriorityArrival
+	default:
+		return ticketPriorityDue
+	}
+}
+
+// sortWaitingTickets orders waiting tickets in the order they will be called
+func sortWaitingTickets(tickets []Ticket, now time.Time, config *Config) {
+	grace := time.Duration(config.AppointmentGrace) * time.Minute
+
+	sort.SliceStable(tickets, func(i, j int) bool {
+		pi, pj := ticketPriority(&tickets[i], now, grace), ticketPriority(&tickets[j], now, grace)
+		if pi != pj {
+			return pi < pj
+		}
+		if pi != ticketPriorityArrival && !tickets[i].DueAt.Time.Equal(tickets[j].DueAt.Time) {
+			return tickets[i].DueAt.Time.Before(tickets[j].DueAt.Time)
+		}
+		return tickets[i].QueuedAt().Before(tickets[j].QueuedAt())
+	})
+}
+
+// GetWaitingTickets returns today's waiting tickets of all stages in the order they will be called
+func GetWaitingTickets(db queryer, now time.Time, config *Config) ([]Ticket, error) {
+	query := `
+		SELECT ` + ticketColumns + `
+		FROM tickets
+		WHERE queue_date = ? AND status = ?
+		ORDER BY id
+	`
+
+	rows, err := db.Query(query, now.Format(queueDateLayout), TicketStatusWaiting)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tickets []Ticket
+	for rows.Next() {
+		ticket, err := scanTicket(rows)
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, *ticket)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortWaitingTickets(tickets, now, config)
+	return tickets, nil
+}
+
+// GetUserTicket returns the user's waiting or called ticket for today
+func GetUserTicket(db *sql.DB, userID int64) (*Ticket, error) {
+	query := `
+		SELECT ` + ticketColumns + `
+		FROM tickets
+		WHERE queue_date = ? AND user_id = ? AND status IN (?, ?)
+		ORDER BY id DESC
+		LIMIT 1
+	`
+
+	ticket, err := scanTicket(db.QueryRow(query, time.Now().Format(queueDateLayout), userID, TicketStatusWaiting, TicketStatusCalled))
+	if err == sql.ErrNoRows {
+		return nil, nil // Not in the queue
+	}
+	return ticket, err
+}
+
+// GetTicketByID returns a ticket by its ID
+func GetTicketByID(db *sql.DB, ticketID int64) (*Ticket, error) {
+	ticket, err := scanTicket(db.QueryRow("SELECT "+ticketColumns+" FROM tickets WHERE id = ?", ticketID))
+	if err == sql.ErrNoRows {
+		return nil, nil // Ticket not found
+	}
+	return ticket, err
+}
+
+// CallNextTicket finishes the operator's current ticket and calls the next ticket waiting
+// for the stage served at the counter. Both happen in one immediate transaction, so two
+// operators calling at the same time always get different tickets. The finished ticket is
+// returned too, nil if there was none, so a visitor moved on along the route can be notified.
+func CallNextTicket(db *sql.DB, operatorID int64, counter int, config *Config) (*Ticket, *Ticket, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	queueDate := now.Format(queueDateLayout)
+
+	finished, err := scanTicket(tx.QueryRow(
+		"SELECT "+ticketColumns+" FROM tickets WHERE queue_date = ? AND operator_id = ? AND status = ? ORDER BY called_at DESC LIMIT 1",
+		queueDate, operatorID, TicketStatusCalled,
+	))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	if finished != nil {
+		if err := finishTicket(tx, finished, TicketStatusServed, now, config); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	waiting, err := GetWaitingTickets(tx, now, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ticket *Ticket
+	stage := StageOfCounter(config, counter)
+	for i := range waiting {
+		if waiting[i].Stage == stage {
+			ticket = &waiting[i]
+			break
+		}
+	}
+	if ticket == nil {
+		// Still commit, the current ticket was finished
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+		return nil, finished, ErrQueueEmpty
+	}
+
+	_, err = tx.Exec(
+		"UPDATE tickets SET status = ?, called_at = ?, counter = ?, operator_id = ? WHERE id = ? AND status = ?",
+		TicketStatusCalled, now, counter, operatorID, ticket.ID, TicketStatusWaiting,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	ticket.Status = TicketStatusCalled
+	ticket.CalledAt = sql.NullTime{Time: now, Valid: true}
+	ticket.Counter = sql.NullInt64{Int64: int64(counter), Valid: true}
+	ticket.Operator = sql.NullInt64{Int64: operatorID, Valid: true}
+
+	return ticket, finished, nil
+}
+
+// FinishTicket marks a ticket called by the operator as served or skipped and returns it in its new state
+func FinishTicket(db *sql.DB, ticketID int64, operatorID int64, status string, config *Config) (*Ticket, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ticket, err := scanTicket(tx.QueryRow(
+		"SELECT "+ticketColumns+" FROM tickets WHERE id = ? AND operator_id = ? AND status = ?",
+		ticketID, operatorID, TicketStatusCalled,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("ticket not found or not called by operator")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := finishTicket(tx, ticket, status, time.Now(), config); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ticket, nil
+}
+
+// finishTicket closes a called ticket with the status. A served visitor with stages left
+// on the route goes back to waiting in the next stage's queue instead.
+func finishTicket(tx *sql.Tx, ticket *Ticket, status string, now time.Time, config *Config) error {
+	if status == TicketStatusServed && hasNextStage(config, ticket.Stage) {
+		// The ticket row only keeps the times of its current stage, so finished stages are kept for the ETA and analytics
+		start := ticket.CalledAt
+		if ticket.StartedAt.Valid {
+			start = ticket.StartedAt
+		}
+		if start.Valid {
+			_, err := tx.Exec("INSERT INTO ticket_stages (ticket_id, stage, operator_id, counter, service, started_at, finished_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				ticket.ID, ticket.Stage, ticket.Operator, ticket.Counter, ticket.Service, start.Time, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The visitor is no longer at the counter, so the operator can't finish or tag the ticket again
+		_, err := tx.Exec(
+			"UPDATE tickets SET status = ?, stage = ?, stage_at = ?, called_at = NULL, counter = NULL, operator_id = NULL, started_at = NULL, notified_at = NULL WHERE id = ?",
+			TicketStatusWaiting, ticket.Stage+1, now, ticket.ID,
+		)
+		if err != nil {
+			return err
+		}
+
+		ticket.Status = TicketStatusWaiting
+		ticket.Stage++
+		ticket.StageAt = sql.NullTime{Time: now, Valid: true}
+		ticket.CalledAt = sql.NullTime{}
+		ticket.Counter = sql.NullInt64{}
+		ticket.Operator = sql.NullInt64{}
+		ticket.StartedAt = sql.NullTime{}
+		ticket.NotifiedAt = sql.NullTime{}
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE tickets SET status = ?, served_at = ? WHERE id = ?", status, now, ticket.ID); err != nil {
+		return err
+	}
+
+	ticket.Status = status
+	ticket.ServedAt = sql.NullTime{Time: now, Valid: true}
+	return nil
+}
+
+// StartTicket records when the called visitor reached the operator's counter
+func StartTicket(db *sql.DB, ticketID int64, operatorID int64) error {
+	result, err := db.Exec(
+		"UPDATE tickets SET started_at = ? WHERE id = ? AND operator_id = ? AND status = ? AND started_at IS NULL",
+		time.Now(), ticketID, operatorID, TicketStatusCalled,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("ticket not found, not called by operator or already started")
+	}
+
+	return nil
+}
+
+// SetTicketService records which service the visitor came for
+func SetTicketService(db *sql.DB, ticketID int64, operatorID int64, service string) error {
+	result, err := db.Exec("UPDATE tickets SET service = ? WHERE id = ? AND operator_id = ?", service, ticketID, operatorID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("ticket not found or not called by operator")
+	}
+
+	return nil
+}
+
+// GetOperatorTicket returns the ticket the operator is currently serving
+func GetOperatorTicket(db *sql.DB, operatorID int64) (*Ticket, error) {
+	query := `
+		SELECT ` + ticketColumns + `
+		FROM tickets
+		WHERE queue_date = ? AND operator_id = ? AND status = ?
+		ORDER BY called_at DESC
+		LIMIT 1
+	`
+
+	ticket, err := scanTicket(db.QueryRow(query, time.Now().Format(queueDateLayout), operatorID, TicketStatusCalled))
+	if err == sql.ErrNoRows {
+		return nil, nil // Operator is not serving anyone
+	}
+	return ticket, err
+}
+
+// CancelTicket removes a user's waiting ticket from the queue
+func CancelTicket(db *sql.DB, ticketID int64, userID int64) error {
+	result, err := db.Exec(
+		"UPDATE tickets SET status = ? WHERE id = ? AND user_id = ? AND status = ?",
+		TicketStatusCancelled, ticketID, userID, TicketStatusWaiting,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("ticket not found or already called")
+	}
+
+	return nil
+}
+
+// Handlers
+
+func handleQueue(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+	userID := update.Message.From.ID
+
+	// Check if user is registered
+	registered, err := IsUserRegistered(app.db, userID)
+	if err != nil {
+		log.Printf("Error checking user registration: %v", err)
+		return app.sendMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+	}
+
+	if !registered {
+		return app.sendMessage(chatID, `❌ Чтобы встать в очередь, необходимо зарегистрироваться.
+
+Пожалуйста, используйте команду /start для регистрации.`)
+	}
+
+	// Show the existing ticket instead of issuing a second one
+	ticket, err := GetUserTicket(app.db, userID)
+	if err != nil {
+		log.Printf("Error getting user ticket: %v", err)
+		return app.sendMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+	}
+	if ticket != nil {
+		return app.sendTicketStatus(chatID, ticket)
+	}
+
+	// Visitors booked for today join with priority around their slot time
+	slot, err := GetUserTodaySlot(app.db, userID)
+	if err != nil {
+		log.Printf("Error getting today's booking: %v", err)
+		return app.sendMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+	}
+	if slot != nil {
+		ticket, err = IssueAppointmentTicket(app.db, slot, app.config)
+	}
+	if slot == nil || errors.Is(err, ErrAlreadyServed) {
+		// Visitors served for today's booking come back as walk-ins
+		ticket, err = IssueTicket(app.db, userID, app.config)
+	}
+	if errors.Is(err, ErrQueueClosed) {
+		return app.sendMessage(chatID, fmt.Sprintf("Живая очередь сейчас закрыта. Она работает в рабочие дни с %s до %s.", app.config.WorkStart, app.config.WorkEnd))
+	}
+	if errors.Is(err, ErrAlreadyInQueue) {
+		return app.sendMessage(chatID, "Вы уже стоите в очереди.")
+	}
+	if err != nil {
+		log.Printf("Error issuing ticket: %v", err)
+		return app.sendMessage(chatID, "Не удалось выдать талон. Попробуйте позже.")
+	}
+
+	log.Printf("Issued ticket %s to user %d", ticket.Label(), userID)
+	app.queueChanged(QueueEvent{Type: QueueEventIssued, Ticket: ticket.Label()})
+	return app.sendTicketStatus(chatID, ticket)
+}
+
+// sendTicketStatus shows the ticket number and position in the queue
+func (app *App) sendTicketStatus(chatID int64, ticket *Ticket) error {
+	message := fmt.Sprintf("🎫 Ваш талон: <b>%s</b>\n\n", ticket.Label())
+	if len(app.config.Route) > 1 && ticket.Stage < len(app.config.Route) {
+		stage := app.config.Route[ticket.Stage]
+		message += fmt.Sprintf("📍 Этап %d из %d: %s, окна %s\n\n", ticket.Stage+1, len(app.config.Route), html.EscapeString(stage.Name), formatCounters(stage.Counters))
+	}
+	if ticket.DueAt.Valid && ticket.Stage == 0 {
+		message += fmt.Sprintf("📅 Вы записаны на %s и будете вызваны в первую очередь к этому времени.\n\n", ticket.DueAt.Time.Format("15:04"))
+	}
+
+	if ticket.Status == TicketStatusCalled {
+		message += "🔔 Вас вызвали, пожалуйста, подойдите к окну."
+		return app.sendMessage(chatID, message)
+	}
+
+	estimates, _, err := EstimateQueue(app.db, app.config)
+	if err != nil {
+		log.Printf("Error estimating queue: %v", err)
+		return app.sendMessage(chatID, message)
+	}
+
+	estimate := estimates[ticket.ID]
+	if estimate.Ahead == 0 {
+		message += "Вы следующий в очереди."
+	} else {
+		message += fmt.Sprintf("Перед вами в очереди: %d\nПримерное ожидание: %s", estimate.Ahead, formatWait(estimate.Wait))
+	}
+	message += "\n\nМы напомним, когда подойдёт ваша очередь. Проверить позицию: /position"
+
+	leaveBtn := tgbotapi.NewInlineKeyboardButtonData("❌ Покинуть очередь", app.callbacks.Encode(cbLeaveQueue, strconv.FormatInt(ticket.ID, 10)))
+	msg := tgbotapi.NewMessage(chatID, message)
+	msg.ParseMode = "HTML"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{leaveBtn})
+
+	return app.queueMessage(msg)
+}
+
+// handleLeaveQueueCallback removes the user's ticket from the queue
+func (app *App) handleLeaveQueueCallback(callback *tgbotapi.CallbackQuery, ticketID int64) error {
+	if err := CancelTicket(app.db, ticketID, callback.From.ID); err != nil {
+		return app.sendMessage(callback.Message.Chat.ID, "Не удалось покинуть очередь: талон уже вызван или недействителен.")
+	}
+
+	// Delete the ticket message
+	app.deleteMessage(callback.Message.Chat.ID, callback.Message.MessageID)
+
+	if ticket, _ := GetTicketByID(app.db, ticketID); ticket != nil {
+		app.queueChanged(QueueEvent{Type: QueueEventCancelled, Ticket: ticket.Label()})
+	}
+
+	return app.sendMessage(callback.Message.Chat.ID, "Вы покинули очередь.")
+}
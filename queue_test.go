@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addWaitingTickets puts tickets into today's queue regardless of working hours
+func addWaitingTickets(t *testing.T, db *sql.DB, count int) {
+	t.Helper()
+	now := time.Now()
+	for i := 1; i <= count; i++ {
+		_, err := db.Exec("INSERT INTO tickets (queue_date, prefix, number, status, issued_at) VALUES (?, 'A', ?, ?, ?)",
+			now.Format(queueDateLayout), i, TicketStatusWaiting, now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIsQueueOpen(t *testing.T) {
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2026, 10, 19, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name      string
+		workStart string
+		workEnd   string
+		now       time.Time
+		want      bool
+	}{
+		{"before opening", "09:00", "18:00", monday(8, 59), false},
+		{"at opening", "09:00", "18:00", monday(9, 0), true},
+		{"before closing", "09:00", "18:00", monday(17, 59), true},
+		{"at closing", "09:00", "18:00", monday(18, 0), false},
+		{"hours without a leading zero", "9:00", "18:00", monday(10, 0), true},
+		{"hours without a leading zero before opening", "9:00", "18:00", monday(8, 0), false},
+		{"invalid working hours", "nine", "18:00", monday(10, 0), false},
+		{"weekend", "09:00", "18:00", time.Date(2026, 10, 18, 10, 0, 0, 0, time.Local), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.WorkStart = tt.workStart
+			config.WorkEnd = tt.workEnd
+			config.SkipWeekend = true
+			if got := IsQueueOpen(tt.now, config); got != tt.want {
+				t.Fatalf("IsQueueOpen(%s) = %v, want %v", tt.now.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallNextTicketConcurrently(t *testing.T) {
+	db := newTestDB(t)
+
+	config := newTestConfig()
+
+	const tickets = 10
+	const operators = 20
+	addWaitingTickets(t, db, tickets)
+
+	var wg sync.WaitGroup
+	type result struct {
+		ticket *Ticket
+		err    error
+	}
+	results := make(chan result, operators)
+	start := make(chan struct{})
+	for i := 1; i <= operators; i++ {
+		wg.Add(1)
+		go func(operatorID int64, counter int) {
+			defer wg.Done()
+			<-start
+			ticket, _, err := CallNextTicket(db, operatorID, counter, config)
+			results <- result{ticket, err}
+		}(int64(i), i)
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	called := make(map[int64]bool)
+	for r := range results {
+		switch {
+		case r.err == nil:
+			if called[r.ticket.ID] {
+				t.Fatalf("ticket %d called twice", r.ticket.ID)
+			}
+			called[r.ticket.ID] = true
+		case errors.Is(r.err, ErrQueueEmpty):
+		default:
+			t.Errorf("unexpected error: %v", r.err)
+		}
+	}
+	if len(called) != tickets {
+		t.Fatalf("called %d tickets, want all %d", len(called), tickets)
+	}
+
+	var counters int
+	if err := db.QueryRow("SELECT COUNT(DISTINCT counter) FROM tickets WHERE status = ?", TicketStatusCalled).Scan(&counters); err != nil {
+		t.Fatal(err)
+	}
+	if counters != tickets {
+		t.Fatalf("called tickets are at %d counters, want %d", counters, tickets)
+	}
+}
+
+// testTicket returns a waiting ticket; a zero due time makes it a walk-in
+func testTicket(id int64, issuedAt, dueAt time.Time) Ticket {
+	ticket := Ticket{ID: id, Status: TicketStatusWaiting, Kind: TicketKindWalkIn, IssuedAt: issuedAt}
+	if !dueAt.IsZero() {
+		ticket.Kind = TicketKindAppointment
+		ticket.DueAt = sql.NullTime{Time: dueAt, Valid: true}
+	}
+	return ticket
+}
+
+func TestTicketPriority(t *testing.T) {
+	due := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)
+	grace := 10 * time.Minute
+	issued := due.Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		ticket Ticket
+		now    time.Time
+		want   int
+	}{
+		{"walk-in", testTicket(1, issued, time.Time{}), due, ticketPriorityArrival},
+		{"appointment without a due time", Ticket{ID: 2, Kind: TicketKindAppointment, IssuedAt: issued}, due, ticketPriorityArrival},
+		{"early appointment", testTicket(3, issued, due), due.Add(-grace - time.Minute), ticketPriorityEarly},
+		{"at the start of the grace window", testTicket(4, issued, due), due.Add(-grace), ticketPriorityDue},
+		{"due appointment", testTicket(5, issued, due), due, ticketPriorityDue},
+		{"at the end of the grace window", testTicket(6, issued, due), due.Add(grace), ticketPriorityDue},
+		{"late appointment", testTicket(7, issued, due), due.Add(grace + time.Minute), ticketPriorityArrival},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ticketPriority(&tt.ticket, tt.now, grace); got != tt.want {
+				t.Fatalf("ticketPriority = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortWaitingTickets(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)
+	config := newTestConfig()
+	config.AppointmentGrace = 10
+	minute := func(m int) time.Time { return now.Add(time.Duration(m) * time.Minute) }
+
+	tests := []struct {
+		name    string
+		tickets []Ticket
+		want    []int64
+	}{
+		{
+			"walk-ins in issue order",
+			[]Ticket{testTicket(1, minute(-5), time.Time{}), testTicket(2, minute(-20), time.Time{}), testTicket(3, minute(-10), time.Time{})},
+			[]int64{2, 3, 1},
+		},
+		{
+			"due appointments before walk-ins, early ones last",
+			[]Ticket{
+				testTicket(1, minute(-30), time.Time{}),
+				testTicket(2, minute(-1), minute(60)),
+				testTicket(3, minute(-2), minute(5)),
+				testTicket(4, minute(-20), time.Time{}),
+			},
+			[]int64{3, 1, 4, 2},
+		},
+		{
+			"late appointment waits with walk-ins by arrival",
+			[]Ticket{
+				testTicket(1, minute(-40), time.Time{}),
+				testTicket(2, minute(-35), minute(-30)),
+				testTicket(3, minute(-10), time.Time{}),
+			},
+			[]int64{1, 2, 3},
+		},
+		{
+			"due appointments by appointment time",
+			[]Ticket{testTicket(1, minute(-15), minute(5)), testTicket(2, minute(-5), minute(-5))},
+			[]int64{2, 1},
+		},
+		{
+			"ties fall back to issue order",
+			[]Ticket{
+				testTicket(1, minute(-3), minute(0)),
+				testTicket(2, minute(-8), minute(0)),
+				testTicket(3, minute(-1), minute(30)),
+				testTicket(4, minute(-9), minute(30)),
+			},
+			[]int64{2, 1, 4, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sortWaitingTickets(tt.tickets, now, config)
+
+			var got []int64
+			for _, ticket := range tt.tickets {
+				got = append(got, ticket.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got order %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIssueAppointmentTicketOnceServed(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	config.WorkStart, config.WorkEnd = "00:00", "23:59"
+	config.AppointmentPrefix = "B"
+	addTestUsers(t, db, 1)
+
+	slotTime := time.Now().Add(time.Hour)
+	result, err := db.Exec("INSERT INTO slots (start_time, end_time, user_id, code) VALUES (?, ?, 1, 'K7PX2M')", slotTime, slotTime.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slotID, _ := result.LastInsertId()
+	slot := &Slot{ID: int(slotID), StartTime: slotTime, UserID: sql.NullInt64{Int64: 1, Valid: true}}
+
+	ticket, err := IssueAppointmentTicket(db, slot, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueAppointmentTicket(db, slot, config); !errors.Is(err, ErrAlreadyInQueue) {
+		t.Fatalf("second ticket while waiting: got %v, want %v", err, ErrAlreadyInQueue)
+	}
+
+	if _, err := db.Exec("UPDATE tickets SET status = ?, served_at = ? WHERE id = ?", TicketStatusServed, time.Now(), ticket.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueAppointmentTicket(db, slot, config); !errors.Is(err, ErrAlreadyServed) {
+		t.Fatalf("ticket after being served: got %v, want %v", err, ErrAlreadyServed)
+	}
+
+	// A walk-in ticket is still possible
+	if _, err := IssueTicket(db, 1, config); err != nil {
+		t.Fatalf("walk-in ticket after the appointment: %v", err)
+	}
+}
+
+func TestFinishTicketLeavesTheCounterForTheNextStage(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	route, err := ParseRoute("Регистрация:1;Специалист:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Route = route
+	addWaitingTickets(t, db, 1)
+
+	called, _, err := CallNextTicket(db, 7, 1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := FinishTicket(db, called.ID, 7, TicketStatusServed, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := GetTicketByID(db, called.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ticket := range []*Ticket{moved, stored} {
+		if ticket.Stage != 1 || ticket.Status != TicketStatusWaiting {
+			t.Fatalf("got stage %d, status %s, want waiting for the second stage", ticket.Stage, ticket.Status)
+		}
+		if ticket.Counter.Valid || ticket.Operator.Valid || ticket.CalledAt.Valid {
+			t.Fatalf("moved ticket still at counter %v, operator %v, called at %v", ticket.Counter, ticket.Operator, ticket.CalledAt)
+		}
+	}
+
+	// The registration operator no longer holds the visitor
+	if ticket, err := GetOperatorTicket(db, 7); err != nil || ticket != nil {
+		t.Fatalf("got operator ticket %v, %v, want none", ticket, err)
+	}
+	if _, err := FinishTicket(db, called.ID, 7, TicketStatusSkipped, config); err == nil {
+		t.Fatal("registration operator skipped a ticket waiting for the specialist")
+	}
+
+	// The registration counter still counts as active for the estimates
+	counters, err := ActiveCounters(db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters[0] != 1 {
+		t.Fatalf("got %d active registration counters, want 1", counters[0])
+	}
+}
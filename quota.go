@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota periods
+const (
+	QuotaPeriodDay   = "day"
+	QuotaPeriodWeek  = "week"
+	QuotaPeriodMonth = "month"
+)
+
+// ErrQuotaExceeded is matched by QuotaError
+var ErrQuotaExceeded = errors.New("booking quota exceeded")
+
+// QuotaError reports an exceeded booking quota and when it resets
+type QuotaError struct {
+	Limit   int
+	Period  string
+	ResetAt time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("booking quota of %d per %s exceeded until %s", e.Limit, e.Period, e.ResetAt.Format("2006-01-02"))
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// ParseQuota parses quotas like "2/month", an empty value disables the quota
+func ParseQuota(value string) (int, string, error) {
+	if value == "" {
+		return 0, "", nil
+	}
+
+	limitStr, period, ok := strings.Cut(value, "/")
+	limit, err := strconv.Atoi(strings.TrimSpace(limitStr))
+	if !ok || err != nil || limit <= 0 {
+		return 0, "", fmt.Errorf("expected <visits>/<period>, got %q", value)
+	}
+
+	period = strings.TrimSpace(period)
+	switch period {
+	case QuotaPeriodDay, QuotaPeriodWeek, QuotaPeriodMonth:
+		return limit, period, nil
+	default:
+		return 0, "", fmt.Errorf("unknown quota period %q", period)
+	}
+}
+
+// QuotaPeriodBounds returns the calendar period containing t as [start, end)
+func QuotaPeriodBounds(t time.Time, period string) (time.Time, time.Time) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case QuotaPeriodWeek:
+		// Weeks start on Monday
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	case QuotaPeriodMonth:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 1, 0)
+	default:
+		return day, day.AddDate(0, 0, 1)
+	}
+}
+
+// NormalizePhone reduces a phone number to digits so differently formatted
+// numbers compare equal, e.g. "+7 (912) 345-67-89" and "89123456789"
+func NormalizePhone(phone string) string {
+	var digits strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+
+	normalized := digits.String()
+	// Russian numbers are often written with the trunk prefix 8 or without the country code
+	if len(normalized) == 11 && normalized[0] == '8' {
+		normalized = "7" + normalized[1:]
+	} else if len(normalized) == 10 && normalized[0] == '9' {
+		normalized = "7" + normalized
+	}
+
+	return normalized
+}
+
+// checkBookingQuota counts bookings in the slot's period made by the user or by
+// any account registered with the same phone number
+func checkBookingQuota(tx *sql.Tx, slotTime time.Time, userID int64, config *Config) error {
+	if config.QuotaLimit == 0 {
+		return nil
+	}
+
+	start, end := QuotaPeriodBounds(slotTime, config.QuotaPeriod)
+
+	query := `
+		SELECT COUNT(*)
+		FROM slots
+		WHERE start_time >= ? AND start_time < ?
+		AND (
+			user_id = ?
+			OR user_id IN (
+				SELECT telegram_id FROM users
+				WHERE phone_normalized != '' AND phone_normalized = (SELECT phone_normalized FROM users WHERE telegram_id = ?)
+			)
+		)
+	`
+
+	var count int
+	if err := tx.QueryRow(query, start, end, userID, userID).Scan(&count); err != nil {
+		return err
+	}
+
+	if count >= config.QuotaLimit {
+		return &QuotaError{Limit: config.QuotaLimit, Period: config.QuotaPeriod, ResetAt: end}
+	}
+
+	return nil
+}
+
+// backfillNormalizedPhones fills phone_normalized for users registered before it existed
+func backfillNormalizedPhones(db *sql.DB) error {
+	rows, err := db.Query("SELECT telegram_id, phone_number FROM users WHERE phone_number IS NOT NULL AND phone_normalized IS NULL")
+	if err != nil {
+		return err
+	}
+
+	phones := make(map[int64]string)
+	for rows.Next() {
+		var telegramID int64
+		var phone string
+		if err := rows.Scan(&telegramID, &phone); err != nil {
+			rows.Close()
+			return err
+		}
+		phones[telegramID] = phone
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for telegramID, phone := range phones {
+		if _, err := db.Exec("UPDATE users SET phone_normalized = ? WHERE telegram_id = ?", NormalizePhone(phone), telegramID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// quotaPeriodName returns the Russian name of a quota period for messages
+func quotaPeriodName(period string) string {
+	switch period {
+	case QuotaPeriodWeek:
+		return "неделю"
+	case QuotaPeriodMonth:
+		return "месяц"
+	default:
+		return "день"
+	}
+}
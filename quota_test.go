@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone string
+		want  string
+	}{
+		{"+7 (912) 345-67-89", "79123456789"},
+		{"89123456789", "79123456789"},
+		{"9123456789", "79123456789"},
+		{"7 912 345 67 89", "79123456789"},
+		{"+44 20 7946 0958", "442079460958"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizePhone(tt.phone); got != tt.want {
+			t.Errorf("NormalizePhone(%q) = %q, want %q", tt.phone, got, tt.want)
+		}
+	}
+}
+
+func TestParseQuota(t *testing.T) {
+	if limit, period, err := ParseQuota(" 2 / month"); err != nil || limit != 2 || period != QuotaPeriodMonth {
+		t.Fatalf("got %d/%s, %v, want 2/month", limit, period, err)
+	}
+	if limit, _, err := ParseQuota(""); err != nil || limit != 0 {
+		t.Fatalf("got limit %d, %v for an empty quota, want it disabled", limit, err)
+	}
+	for _, value := range []string{"2", "0/day", "-1/day", "two/week", "2/year"} {
+		if _, _, err := ParseQuota(value); err == nil {
+			t.Errorf("ParseQuota(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestQuotaPeriodBounds(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name      string
+		t         time.Time
+		period    string
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"day", time.Date(2026, 10, 21, 15, 30, 0, 0, time.Local), QuotaPeriodDay, date(2026, 10, 21), date(2026, 10, 22)},
+		{"week from Wednesday", time.Date(2026, 10, 21, 15, 30, 0, 0, time.Local), QuotaPeriodWeek, date(2026, 10, 19), date(2026, 10, 26)},
+		{"week from Monday", date(2026, 10, 19), QuotaPeriodWeek, date(2026, 10, 19), date(2026, 10, 26)},
+		{"week from Sunday", time.Date(2026, 10, 25, 23, 0, 0, 0, time.Local), QuotaPeriodWeek, date(2026, 10, 19), date(2026, 10, 26)},
+		{"month", time.Date(2026, 10, 31, 12, 0, 0, 0, time.Local), QuotaPeriodMonth, date(2026, 10, 1), date(2026, 11, 1)},
+		{"month at the end of the year", date(2026, 12, 15), QuotaPeriodMonth, date(2026, 12, 1), date(2027, 1, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := QuotaPeriodBounds(tt.t, tt.period)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Fatalf("got [%s, %s), want [%s, %s)", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestBookingQuotaSharedByPhone(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	config.QuotaLimit = 1
+	config.QuotaPeriod = QuotaPeriodDay
+	addTestUsers(t, db, 1, 2, 3)
+
+	// Two accounts of the same person, written differently
+	phones := map[int64]string{1: "+7 (912) 345-67-89", 2: "89123456789", 3: "+79990000003"}
+	for id, phone := range phones {
+		if err := UpdateUserPhone(db, id, phone); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := BookTimeSlot(db, testSlotTime(10, 0), 1, "first", config); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := BookTimeSlot(db, testSlotTime(11, 0), 2, "second", config)
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) {
+		t.Fatalf("got %v, want the quota shared by the phone number exceeded", err)
+	}
+	if nextDay := testSlotTime(0, 0).AddDate(0, 0, 1); !quotaErr.ResetAt.Equal(nextDay) {
+		t.Fatalf("quota resets at %s, want %s", quotaErr.ResetAt, nextDay)
+	}
+
+	// Another phone number has its own quota, and the next period starts afresh
+	if _, err := BookTimeSlot(db, testSlotTime(11, 0), 3, "other", config); err != nil {
+		t.Fatalf("user with another phone: %v", err)
+	}
+	if _, err := BookTimeSlot(db, testSlotTime(11, 0).AddDate(0, 0, 1), 2, "second", config); err != nil {
+		t.Fatalf("next day: %v", err)
+	}
+}
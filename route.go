@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// RouteStage is one station of the visit route with the counters serving it
+type RouteStage struct {
+	Name     string
+	Counters []int
+}
+
+// ParseRoute parses ordered stages like "Регистрация:1-2;Специалист:3,4,5;Касса:6"
+func ParseRoute(value string) ([]RouteStage, error) {
+	var route []RouteStage
+	seen := make(map[int]string)
+
+	for _, stageStr := range strings.Split(value, ";") {
+		stageStr = strings.TrimSpace(stageStr)
+		if stageStr == "" {
+			continue
+		}
+
+		name, counters, _ := strings.Cut(stageStr, ":")
+		stage := RouteStage{Name: strings.TrimSpace(name)}
+		if stage.Name == "" {
+			return nil, fmt.Errorf("stage %q has no name", stageStr)
+		}
+
+		for _, part := range strings.Split(counters, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			fromStr, toStr, isRange := strings.Cut(part, "-")
+			if !isRange {
+				toStr = fromStr
+			}
+			from, errFrom := strconv.Atoi(strings.TrimSpace(fromStr))
+			to, errTo := strconv.Atoi(strings.TrimSpace(toStr))
+			if errFrom != nil || errTo != nil || from <= 0 || to < from {
+				return nil, fmt.Errorf("stage %q: invalid counters %s", stage.Name, part)
+			}
+			for counter := from; counter <= to; counter++ {
+				if other, ok := seen[counter]; ok {
+					return nil, fmt.Errorf("counter %d belongs to both %q and %q", counter, other, stage.Name)
+				}
+				seen[counter] = stage.Name
+				stage.Counters = append(stage.Counters, counter)
+			}
+		}
+
+		if len(stage.Counters) == 0 {
+			return nil, fmt.Errorf("stage %q has no counters", stage.Name)
+		}
+		route = append(route, stage)
+	}
+
+	return route, nil
+}
+
+// StageOfCounter returns the route stage served at the counter, -1 if the counter is not on the route.
+// Without a route every counter serves the single stage 0.
+func StageOfCounter(config *Config, counter int) int {
+	if len(config.Route) == 0 {
+		return 0
+	}
+	for i, stage := range config.Route {
+		for _, c := range stage.Counters {
+			if c == counter {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// hasNextStage checks if a visitor finishing the stage continues along the route
+func hasNextStage(config *Config, stage int) bool {
+	return stage+1 < len(config.Route)
+}
+
+// stageName returns the name of a route stage, empty without a route
+func stageName(config *Config, stage int) string {
+	if stage < 0 || stage >= len(config.Route) {
+		return ""
+	}
+	return config.Route[stage].Name
+}
+
+// formatCounters lists the counters of a stage for messages, e.g. "3, 4, 5"
+func formatCounters(counters []int) string {
+	parts := make([]string, len(counters))
+	for i, counter := range counters {
+		parts[i] = strconv.Itoa(counter)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// routeDescription lists the stages and their counters for operators
+func routeDescription(config *Config) string {
+	var b strings.Builder
+	b.WriteString("Маршрут посетителя:")
+	for i, stage := range config.Route {
+		fmt.Fprintf(&b, "\n%d. %s: окна %s", i+1, html.EscapeString(stage.Name), formatCounters(stage.Counters))
+	}
+	return b.String()
+}
+
+// notifyNextStage tells a visitor who finished a stage where to go next
+func (app *App) notifyNextStage(ticket *Ticket) {
+	if !ticket.UserID.Valid || ticket.Stage >= len(app.config.Route) {
+		return
+	}
+
+	stage := app.config.Route[ticket.Stage]
+	message := fmt.Sprintf(`✅ Этап «%s» пройден.
+
+Следующий этап: <b>%s</b>, окна %s.
+Ваш талон <b>%s</b> остаётся прежним, дождитесь вызова. Проверить позицию: /position`,
+		html.EscapeString(stageName(app.config, ticket.Stage-1)), html.EscapeString(stage.Name), formatCounters(stage.Counters), ticket.Label())
+
+	if err := app.sendMessage(ticket.UserID.Int64, message); err != nil {
+		log.Printf("Error notifying ticket %s about the next stage: %v", ticket.Label(), err)
+	}
+}
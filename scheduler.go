@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Job kinds
+const (
+	JobReminder        = "reminder"         // Payload is the reminder offset in minutes
+	JobConfirmDeadline = "confirm_deadline" // Releases the booking unless the visitor confirmed it
+	JobAgenda          = "agenda"           // Daily agenda digest to staff, schedules the next one
+)
+
+// Job statuses
+const (
+	JobStatusPending   = "pending"
+	JobStatusDone      = "done"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+// Scheduler settings
+const (
+	schedulerInterval = 30 * time.Second
+	schedulerBatch    = 50 // Jobs run per tick
+	maxJobAttempts    = 5  // Failed jobs are retried with a growing delay, then given up
+)
+
+// Job is a task stored in the database to run at a given time, surviving restarts
+type Job struct {
+	ID       int64
+	Kind     string
+	SlotID   sql.NullInt64
+	UserID   sql.NullInt64 // Owner of the slot when the job was scheduled
+	RunAt    time.Time
+	Payload  string
+	Attempts int
+}
+
+// ParseReminders parses reminder offsets before a booking like "24h,2h", "off" disables reminders
+func ParseReminders(value string) ([]time.Duration, error) {
+	var reminders []time.Duration
+	if strings.TrimSpace(value) == "off" {
+		return reminders, nil
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		offset, err := time.ParseDuration(part)
+		if err != nil || offset <= 0 {
+			return nil, fmt.Errorf("invalid reminder offset %q", part)
+		}
+		reminders = append(reminders, offset)
+	}
+	return reminders, nil
+}
+
+// remindsBefore checks that at least one reminder comes earlier than the offset before a booking
+func remindsBefore(reminders []time.Duration, offset time.Duration) bool {
+	for _, reminder := range reminders {
+		if reminder > offset {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleJob stores a pending job
+func ScheduleJob(ex execer, job *Job) error {
+	query := `
+		INSERT INTO jobs (kind, slot_id, user_id, run_at, payload, status)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := ex.Exec(query, job.Kind, job.SlotID, job.UserID, job.RunAt, job.Payload, JobStatusPending)
+	if err != nil {
+		return err
+	}
+	job.ID, err = result.LastInsertId()
+	return err
+}
+
+// scheduleReminders schedules the reminders of a confirmed booking as the visitor set them up,
+// skipping those whose time has already passed, and the confirmation deadline they ask about
+func scheduleReminders(ex execQueryer, slot *Slot, config *Config) error {
+	runAts, err := scheduleReminderJobs(ex, slot, config)
+	if err != nil {
+		return err
+	}
+	return scheduleConfirmDeadline(ex, slot, config, runAts)
+}
+
+// scheduleReminderJobs schedules only the reminders of a booking and returns their times
+func scheduleReminderJobs(ex execQueryer, slot *Slot, config *Config) ([]time.Time, error) {
+	settings, err := GetUserSettings(ex, slot.UserID.Int64)
+	if err != nil {
+		return nil, err
+	}
+
+	runAts := reminderTimes(slot.StartTime, settings, config, time.Now())
+	for _, runAt := range runAts {
+		job := &Job{
+			Kind:    JobReminder,
+			SlotID:  sql.NullInt64{Int64: int64(slot.ID), Valid: true},
+			UserID:  slot.UserID,
+			RunAt:   runAt,
+			Payload: strconv.Itoa(int(slot.StartTime.Sub(runAt).Minutes())),
+		}
+		if err := ScheduleJob(ex, job); err != nil {
+			return nil, err
+		}
+	}
+	return runAts, nil
+}
+
+// cancelSlotJobs cancels the pending jobs of a booking that was cancelled or moved
+func cancelSlotJobs(ex execer, slotID int) error {
+	_, err := ex.Exec("UPDATE jobs SET status = ?, finished_at = ? WHERE slot_id = ? AND status = ?",
+		JobStatusCancelled, time.Now(), slotID, JobStatusPending)
+	return err
+}
+
+// cancelSlotReminders cancels the pending reminders of a booking, keeping its other jobs
+func cancelSlotReminders(ex execer, slotID int) error {
+	_, err := ex.Exec("UPDATE jobs SET status = ?, finished_at = ? WHERE slot_id = ? AND kind = ? AND status = ?",
+		JobStatusCancelled, time.Now(), slotID, JobReminder, JobStatusPending)
+	return err
+}
+
+// BackfillReminders schedules reminders for confirmed future bookings without any scheduled or sent ones,
+// such as bookings made before reminders were enabled
+func BackfillReminders(db *sql.DB, config *Config) (int, error) {
+	query := `
+		SELECT id, start_time, user_id
+		FROM slots
+		WHERE user_id IS NOT NULL AND COALESCE(status, 'booked') = ? AND start_time > ?
+			AND NOT EXISTS (SELECT 1 FROM jobs WHERE jobs.slot_id = slots.id AND jobs.user_id = slots.user_id AND jobs.status != ?)
+	`
+
+	rows, err := db.Query(query, SlotStatusBooked, time.Now(), JobStatusCancelled)
+	if err != nil {
+		return 0, err
+	}
+
+	var slots []Slot
+	for rows.Next() {
+		var slot Slot
+		if err := rows.Scan(&slot.ID, &slot.StartTime, &slot.UserID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		slots = append(slots, slot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i := range slots {
+		if err := scheduleReminders(db, &slots[i], config); err != nil {
+			return 0, err
+		}
+	}
+	return len(slots), nil
+}
+
+// GetDueJobs returns pending jobs whose time has come, oldest first
+func GetDueJobs(db *sql.DB, now time.Time, limit int) ([]Job, error) {
+	query := `
+		SELECT id, kind, slot_id, user_id, run_at, payload, attempts
+		FROM jobs
+		WHERE status = ? AND run_at <= ?
+		ORDER BY run_at
+		LIMIT ?
+	`
+
+	rows, err := db.Query(query, JobStatusPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		var job Job
+		if err := rows.Scan(&job.ID, &job.Kind, &job.SlotID, &job.UserID, &job.RunAt, &job.Payload, &job.Attempts); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// finishJob records the outcome of a run. A failed job is retried later until it runs out of attempts.
+func finishJob(db *sql.DB, job *Job, runErr error) error {
+	now := time.Now()
+	if runErr == nil {
+		_, err := db.Exec("UPDATE jobs SET status = ?, attempts = attempts + 1, finished_at = ? WHERE id = ?", JobStatusDone, now, job.ID)
+		return err
+	}
+
+	attempts := job.Attempts + 1
+	if attempts >= maxJobAttempts {
+		_, err := db.Exec("UPDATE jobs SET status = ?, attempts = ?, last_error = ?, finished_at = ? WHERE id = ?",
+			JobStatusFailed, attempts, runErr.Error(), now, job.ID)
+		return err
+	}
+
+	retryAt := now.Add(time.Duration(attempts) * time.Minute)
+	_, err := db.Exec("UPDATE jobs SET attempts = ?, last_error = ?, run_at = ? WHERE id = ?", attempts, runErr.Error(), retryAt, job.ID)
+	return err
+}
+
+// runScheduler runs due jobs until the process exits. Jobs are marked done after
+// they run, so a job interrupted by a crash runs again after the restart.
+func (app *App) runScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		app.releaseExpiredHolds()
+		app.runDueJobs()
+		<-ticker.C
+	}
+}
+
+// runDueJobs runs one batch of due jobs
+func (app *App) runDueJobs() {
+	jobs, err := GetDueJobs(app.db, time.Now(), schedulerBatch)
+	if err != nil {
+		log.Printf("Error getting due jobs: %v", err)
+		return
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+		runErr := app.runJob(job)
+		if runErr != nil {
+			log.Printf("Error running %s job %d (attempt %d): %v", job.Kind, job.ID, job.Attempts+1, runErr)
+		}
+		if err := finishJob(app.db, job, runErr); err != nil {
+			log.Printf("Error finishing job %d: %v", job.ID, err)
+		}
+	}
+}
+
+// runJob dispatches a job by kind
+func (app *App) runJob(job *Job) error {
+	switch job.Kind {
+	case JobReminder:
+		return app.sendReminder(job)
+	case JobConfirmDeadline:
+		return app.releaseUnconfirmed(job)
+	case JobAgenda:
+		return app.sendAgendaDigest(job)
+	default:
+		return fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+}
+
+// sendReminder reminds the visitor of their upcoming booking.
+// A booking that changed owner or already started is skipped silently.
+func (app *App) sendReminder(job *Job) error {
+	slot, err := GetSlotByID(app.db, int(job.SlotID.Int64))
+	if err != nil {
+		return err
+	}
+	if slot == nil || slot.UserID != job.UserID || slot.Status != SlotStatusBooked || !slot.StartTime.After(time.Now()) {
+		return nil
+	}
+
+	settings, err := GetUserSettings(app.db, slot.UserID.Int64)
+	if err != nil {
+		return err
+	}
+	texts := reminderTextsFor(settings.Language)
+
+	message := fmt.Sprintf(texts.Reminder, slot.StartTime.Format("02.01.2006 15:04"), slot.Code)
+
+	deadline := slot.StartTime.Add(-app.config.ConfirmDeadline)
+	if !slot.ConfirmedAt.Valid && app.config.ConfirmDeadline > 0 && deadline.After(time.Now()) {
+		message += fmt.Sprintf(texts.ConfirmBy, deadline.Format("02.01.2006 15:04"))
+	} else {
+		message += texts.CancelIfChanged
+	}
+
+	msg := tgbotapi.NewMessage(slot.UserID.Int64, message)
+	msg.ParseMode = "HTML"
+	msg.ReplyMarkup = app.reminderKeyboard(slot, settings.Language)
+
+	return app.queueMessage(msg)
+}
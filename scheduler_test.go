@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// slotJobs returns the statuses of a slot's reminder jobs by payload
+func slotJobs(t *testing.T, db *sql.DB, slotID int) map[string]string {
+	t.Helper()
+	rows, err := db.Query("SELECT payload, status FROM jobs WHERE slot_id = ? AND kind = ?", slotID, JobReminder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	jobs := make(map[string]string)
+	for rows.Next() {
+		var payload, status string
+		if err := rows.Scan(&payload, &status); err != nil {
+			t.Fatal(err)
+		}
+		jobs[payload] = status
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func TestRemindersFollowBooking(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	config.Reminders = []time.Duration{24 * time.Hour, 2 * time.Hour}
+	addTestUsers(t, db, 1, 2, 3)
+	pending := map[string]string{"1440": JobStatusPending, "120": JobStatusPending}
+	cancelled := map[string]string{"1440": JobStatusCancelled, "120": JobStatusCancelled}
+
+	tests := []struct {
+		name   string
+		userID int64
+		change func(slot *Slot) error
+	}{
+		{"cancel", 1, func(slot *Slot) error {
+			return CancelSlot(db, slot.ID, 1)
+		}},
+		{"reschedule", 2, func(slot *Slot) error {
+			moved, err := RescheduleSlot(db, slot.ID, slot.StartTime.Add(time.Hour), 2, config)
+			if err != nil {
+				return err
+			}
+			if got := slotJobs(t, db, moved.ID); !reflect.DeepEqual(got, pending) {
+				t.Errorf("got jobs %v at the new time, want %v", got, pending)
+			}
+			return nil
+		}},
+		{"release", 3, func(slot *Slot) error {
+			_, err := ReleaseSlot(db, slot.ID, slot.Code)
+			return err
+		}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slot, err := BookTimeSlot(db, testSlotTime(10+2*i, 0), tt.userID, "user", config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := slotJobs(t, db, slot.ID); !reflect.DeepEqual(got, pending) {
+				t.Fatalf("got jobs %v after booking, want %v", got, pending)
+			}
+
+			if err := tt.change(slot); err != nil {
+				t.Fatal(err)
+			}
+			if got := slotJobs(t, db, slot.ID); !reflect.DeepEqual(got, cancelled) {
+				t.Fatalf("got jobs %v, want %v", got, cancelled)
+			}
+		})
+	}
+}
+
+func TestFinishJobRetriesThenGivesUp(t *testing.T) {
+	db := newTestDB(t)
+	job := &Job{Kind: JobReminder, RunAt: time.Now(), Payload: "120"}
+	if err := ScheduleJob(db, job); err != nil {
+		t.Fatal(err)
+	}
+
+	runErr := errors.New("telegram is down")
+	for attempt := 1; attempt <= maxJobAttempts; attempt++ {
+		start := time.Now()
+		if err := finishJob(db, job, runErr); err != nil {
+			t.Fatal(err)
+		}
+
+		var status, lastError string
+		var attempts int
+		var runAt time.Time
+		err := db.QueryRow("SELECT status, attempts, last_error, run_at FROM jobs WHERE id = ?", job.ID).
+			Scan(&status, &attempts, &lastError, &runAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != attempt || lastError != runErr.Error() {
+			t.Fatalf("attempt %d: got %d attempts with error %q", attempt, attempts, lastError)
+		}
+
+		if attempt < maxJobAttempts {
+			// Retried later, each time after a longer delay
+			if status != JobStatusPending || runAt.Before(start.Add(time.Duration(attempt)*time.Minute)) {
+				t.Fatalf("attempt %d: got %s at %s, want pending in %d min", attempt, status, runAt, attempt)
+			}
+		} else if status != JobStatusFailed {
+			t.Fatalf("got %s after %d attempts, want %s", status, attempt, JobStatusFailed)
+		}
+		job.Attempts = attempts
+	}
+
+	if jobs, err := GetDueJobs(db, time.Now().Add(time.Hour), schedulerBatch); err != nil || len(jobs) != 0 {
+		t.Fatalf("got %d due jobs, %v, want the failed job never run again", len(jobs), err)
+	}
+}
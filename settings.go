@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Reminder preferences besides offsets like "2h"
+const (
+	ReminderDefault = ""        // The configured REMINDERS
+	ReminderMorning = "morning" // Once, on the morning of the visit
+	ReminderOff     = "off"
+)
+
+// Languages of the reminders
+const (
+	LangRussian = "ru"
+	LangEnglish = "en"
+)
+
+// reminderTexts are the reminder message and buttons in one language
+type reminderTexts struct {
+	Reminder        string // Args: visit time, booking code
+	ConfirmBy       string // Arg: confirmation deadline
+	CancelIfChanged string
+	Confirm         string
+	Cancel          string
+}
+
+var reminderLanguages = map[string]reminderTexts{
+	LangRussian: {
+		Reminder:        "⏰ Напоминание о записи\n\n📅 %s\nКод записи: <b>%s</b>",
+		ConfirmBy:       "\n\nПожалуйста, подтвердите визит до %s, иначе запись будет отменена.",
+		CancelIfChanged: "\n\nЕсли планы изменились, пожалуйста, отмените запись.",
+		Confirm:         "✅ Приду",
+		Cancel:          "❌ Отменить запись",
+	},
+	LangEnglish: {
+		Reminder:        "⏰ Booking reminder\n\n📅 %s\nBooking code: <b>%s</b>",
+		ConfirmBy:       "\n\nPlease confirm your visit by %s, otherwise the booking will be cancelled.",
+		CancelIfChanged: "\n\nIf your plans have changed, please cancel the booking.",
+		Confirm:         "✅ I'll come",
+		Cancel:          "❌ Cancel booking",
+	},
+}
+
+// reminderTextsFor returns the reminder texts in the language, Russian if unknown
+func reminderTextsFor(language string) reminderTexts {
+	if texts, ok := reminderLanguages[language]; ok {
+		return texts
+	}
+	return reminderLanguages[LangRussian]
+}
+
+// morningReminderHour is when the "morning of the visit" reminder is sent
+const morningReminderHour = 8
+
+// Settings fields changed by the /settings buttons
+const (
+	settingReminders = "r"
+	settingQuiet     = "q"
+	settingLanguage  = "l"
+	settingMarketing = "m"
+)
+
+// reminderChoices are the reminder options /settings cycles through
+var reminderChoices = []string{ReminderDefault, ReminderMorning, "2h", ReminderOff}
+
+// quietChoices are the quiet hours /settings cycles through, as minutes from midnight
+var quietChoices = [][2]int64{{22 * 60, 8 * 60}, {23 * 60, 7 * 60}, {21 * 60, 9 * 60}}
+
+// UserSettings are a user's notification preferences
+type UserSettings struct {
+	UserID     int64
+	Reminders  string        // ReminderDefault, ReminderMorning, ReminderOff or offsets like "2h"
+	QuietStart sql.NullInt64 // Minutes from midnight, no quiet hours when not set
+	QuietEnd   sql.NullInt64
+	Language   string
+	Marketing  bool // Agreed to get news and promotions
+}
+
+// GetUserSettings returns the user's settings, the defaults if never changed
+func GetUserSettings(db rowQueryer, userID int64) (*UserSettings, error) {
+	settings := &UserSettings{UserID: userID, Language: LangRussian}
+	err := db.QueryRow("SELECT reminders, quiet_start, quiet_end, language, marketing FROM user_settings WHERE telegram_id = ?", userID).
+		Scan(&settings.Reminders, &settings.QuietStart, &settings.QuietEnd, &settings.Language, &settings.Marketing)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// SaveUserSettings stores the user's settings
+func SaveUserSettings(db *sql.DB, settings *UserSettings) error {
+	query := `
+		INSERT INTO user_settings (telegram_id, reminders, quiet_start, quiet_end, language, marketing, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (telegram_id) DO UPDATE SET reminders = excluded.reminders, quiet_start = excluded.quiet_start,
+			quiet_end = excluded.quiet_end, language = excluded.language, marketing = excluded.marketing, updated_at = excluded.updated_at
+	`
+
+	_, err := db.Exec(query, settings.UserID, settings.Reminders, settings.QuietStart, settings.QuietEnd, settings.Language, settings.Marketing, time.Now())
+	return err
+}
+
+// minuteOfDay returns the minutes since midnight
+func minuteOfDay(t time.Time) int64 {
+	return int64(t.Hour()*60 + t.Minute())
+}
+
+// InQuietHours checks if the time falls into the user's quiet hours, which may span midnight
+func (s *UserSettings) InQuietHours(t time.Time) bool {
+	if !s.QuietStart.Valid || !s.QuietEnd.Valid {
+		return false
+	}
+	minute, start, end := minuteOfDay(t), s.QuietStart.Int64, s.QuietEnd.Int64
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// quietBounds returns the start and the end of the quiet hours the time falls into
+func (s *UserSettings) quietBounds(t time.Time) (time.Time, time.Time) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	start := day.Add(time.Duration(s.QuietStart.Int64) * time.Minute)
+	end := day.Add(time.Duration(s.QuietEnd.Int64) * time.Minute)
+	if start.After(t) {
+		start = start.AddDate(0, 0, -1)
+	}
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end
+}
+
+// reminderOffsets returns how long before a booking the user wants reminders, nil for none
+func reminderOffsets(settings *UserSettings, config *Config) []time.Duration {
+	switch settings.Reminders {
+	case ReminderDefault:
+		return config.Reminders
+	case ReminderOff, ReminderMorning:
+		return nil
+	}
+
+	offsets, err := ParseReminders(settings.Reminders)
+	if err != nil {
+		log.Printf("Invalid reminder settings %q of user %d: %v", settings.Reminders, settings.UserID, err)
+		return config.Reminders
+	}
+	return offsets
+}
+
+// reminderTimes returns when to remind the user about the booking. Reminders due in
+// quiet hours are moved to their end, or to their start if the visit begins earlier.
+func reminderTimes(start time.Time, settings *UserSettings, config *Config, now time.Time) []time.Time {
+	var times []time.Time
+	for _, offset := range reminderOffsets(settings, config) {
+		times = append(times, start.Add(-offset))
+	}
+	if settings.Reminders == ReminderMorning {
+		morning := time.Date(start.Year(), start.Month(), start.Day(), morningReminderHour, 0, 0, 0, start.Location())
+		if !morning.Before(start) {
+			morning = start.Add(-time.Hour)
+		}
+		times = append(times, morning)
+	}
+
+	var result []time.Time
+	for _, runAt := range times {
+		if settings.InQuietHours(runAt) {
+			quietStart, quietEnd := settings.quietBounds(runAt)
+			runAt = quietEnd
+			if !runAt.Before(start) {
+				runAt = quietStart.Add(-time.Minute)
+			}
+		}
+		if runAt.After(now) && runAt.Before(start) {
+			result = append(result, runAt)
+		}
+	}
+	return result
+}
+
+// RescheduleUserReminders schedules the reminders of the user's upcoming bookings again after the settings changed.
+// Other jobs of the bookings stay, the confirmation deadline only goes if no reminder asks before it anymore.
+func RescheduleUserReminders(db *sql.DB, userID int64, config *Config) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, start_time FROM slots WHERE user_id = ? AND COALESCE(status, 'booked') = ? AND start_time > ?",
+		userID, SlotStatusBooked, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var slots []Slot
+	for rows.Next() {
+		slot := Slot{UserID: sql.NullInt64{Int64: userID, Valid: true}}
+		if err := rows.Scan(&slot.ID, &slot.StartTime); err != nil {
+			rows.Close()
+			return err
+		}
+		slots = append(slots, slot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range slots {
+		if err := cancelSlotReminders(tx, slots[i].ID); err != nil {
+			return err
+		}
+		if _, err := scheduleReminderJobs(tx, &slots[i], config); err != nil {
+			return err
+		}
+		if err := dropUnremindedDeadline(tx, slots[i].ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// formatOffset formats a reminder offset like "24 ч" or "30 мин"
+func formatOffset(offset time.Duration) string {
+	if offset%time.Hour == 0 {
+		return fmt.Sprintf("%d ч", int(offset.Hours()))
+	}
+	return fmt.Sprintf("%d мин", int(offset.Minutes()))
+}
+
+// describeReminders describes the user's reminder choice
+func describeReminders(settings *UserSettings, config *Config) string {
+	switch settings.Reminders {
+	case ReminderOff:
+		return "не присылать"
+	case ReminderMorning:
+		return fmt.Sprintf("утром в день визита (в %02d:00)", morningReminderHour)
+	}
+
+	offsets := reminderOffsets(settings, config)
+	if len(offsets) == 0 {
+		return "не присылать"
+	}
+	parts := make([]string, len(offsets))
+	for i, offset := range offsets {
+		parts[i] = formatOffset(offset)
+	}
+	text := "за " + strings.Join(parts, " и за ")
+	if settings.Reminders == ReminderDefault {
+		text += " (по умолчанию)"
+	}
+	return text
+}
+
+// describeQuietHours describes the user's quiet hours
+func describeQuietHours(settings *UserSettings) string {
+	if !settings.QuietStart.Valid || !settings.QuietEnd.Valid {
+		return "выключены"
+	}
+	return fmt.Sprintf("%02d:%02d–%02d:%02d", settings.QuietStart.Int64/60, settings.QuietStart.Int64%60, settings.QuietEnd.Int64/60, settings.QuietEnd.Int64%60)
+}
+
+// nextSetting changes the field to its next option
+func nextSetting(settings *UserSettings, field string) {
+	switch field {
+	case settingReminders:
+		next := 0
+		for i, choice := range reminderChoices {
+			if choice == settings.Reminders {
+				next = (i + 1) % len(reminderChoices)
+			}
+		}
+		settings.Reminders = reminderChoices[next]
+	case settingQuiet:
+		// Off, then each preset in turn
+		next := 0
+		for i, choice := range quietChoices {
+			if settings.QuietStart.Valid && settings.QuietStart.Int64 == choice[0] && settings.QuietEnd.Int64 == choice[1] {
+				next = i + 1
+			}
+		}
+		if settings.QuietStart.Valid && next == len(quietChoices) {
+			settings.QuietStart, settings.QuietEnd = sql.NullInt64{}, sql.NullInt64{}
+		} else {
+			settings.QuietStart = sql.NullInt64{Int64: quietChoices[next][0], Valid: true}
+			settings.QuietEnd = sql.NullInt64{Int64: quietChoices[next][1], Valid: true}
+		}
+	case settingLanguage:
+		if settings.Language == LangEnglish {
+			settings.Language = LangRussian
+		} else {
+			settings.Language = LangEnglish
+		}
+	case settingMarketing:
+		settings.Marketing = !settings.Marketing
+	}
+}
+
+// settingsText shows the user's current settings
+func settingsText(settings *UserSettings, config *Config) string {
+	language := "русский"
+	if settings.Language == LangEnglish {
+		language = "English"
+	}
+	marketing := "не получать"
+	if settings.Marketing {
+		marketing = "получать"
+	}
+
+	return fmt.Sprintf(`🔔 Настройки уведомлений
+
+⏰ Напоминания о записи: %s
+🌙 Тихие часы: %s
+🌐 Язык напоминаний / Reminder language: %s
+📣 Новости и акции: %s
+
+В тихие часы бот не присылает напоминания и рассылки. Нажмите на кнопку, чтобы изменить настройку.`,
+		describeReminders(settings, config), describeQuietHours(settings), language, marketing)
+}
+
+// settingsKeyboard offers to change each setting
+func (app *App) settingsKeyboard() tgbotapi.InlineKeyboardMarkup {
+	button := func(text, field string) []tgbotapi.InlineKeyboardButton {
+		return tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(text, app.callbacks.Encode(cbSettings, field)))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		button("⏰ Напоминания", settingReminders),
+		button("🌙 Тихие часы", settingQuiet),
+		button("🌐 Язык / Language", settingLanguage),
+		button("📣 Новости и акции", settingMarketing),
+	)
+}
+
+// Handlers
+
+func handleSettings(app *App, update *tgbotapi.Update) error {
+	chatID := update.Message.Chat.ID
+
+	settings, err := GetUserSettings(app.db, update.Message.From.ID)
+	if err != nil {
+		log.Printf("Error getting user settings: %v", err)
+		return app.sendMessage(chatID, "Ошибка при получении настроек. Попробуйте позже.")
+	}
+
+	msg := tgbotapi.NewMessage(chatID, settingsText(settings, app.config))
+	msg.ReplyMarkup = app.settingsKeyboard()
+	return app.queueMessage(msg)
+}
+
+// handleSettingsCallback switches a setting to its next option
+func (app *App) handleSettingsCallback(callback *tgbotapi.CallbackQuery, field string) error {
+	chatID := callback.Message.Chat.ID
+	userID := callback.From.ID
+
+	settings, err := GetUserSettings(app.db, userID)
+	if err != nil {
+		log.Printf("Error getting user settings: %v", err)
+		return app.sendMessage(chatID, "Ошибка при получении настроек. Попробуйте позже.")
+	}
+
+	nextSetting(settings, field)
+	if err := SaveUserSettings(app.db, settings); err != nil {
+		log.Printf("Error saving user settings: %v", err)
+		return app.sendMessage(chatID, "Не удалось сохранить настройки. Попробуйте позже.")
+	}
+
+	if field == settingReminders || field == settingQuiet {
+		if err := RescheduleUserReminders(app.db, userID, app.config); err != nil {
+			log.Printf("Error rescheduling reminders of user %d: %v", userID, err)
+		}
+	}
+
+	app.editMessage(chatID, callback.Message.MessageID, settingsText(settings, app.config), "", app.settingsKeyboard())
+	return nil
+}
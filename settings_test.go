@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// quietSettings returns settings with quiet hours between the given hours
+func quietSettings(start, end int) *UserSettings {
+	return &UserSettings{
+		QuietStart: sql.NullInt64{Int64: int64(start * 60), Valid: true},
+		QuietEnd:   sql.NullInt64{Int64: int64(end * 60), Valid: true},
+	}
+}
+
+// octoberAt returns the time on the day of October 2026
+func octoberAt(day, hour, minute int) time.Time {
+	return time.Date(2026, 10, day, hour, minute, 0, 0, time.Local)
+}
+
+func TestInQuietHours(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings *UserSettings
+		t        time.Time
+		want     bool
+	}{
+		{"no quiet hours", &UserSettings{}, octoberAt(20, 3, 0), false},
+		{"before quiet hours over midnight", quietSettings(22, 8), octoberAt(20, 21, 59), false},
+		{"start of quiet hours over midnight", quietSettings(22, 8), octoberAt(20, 22, 0), true},
+		{"midnight", quietSettings(22, 8), octoberAt(21, 0, 0), true},
+		{"last minute of quiet hours over midnight", quietSettings(22, 8), octoberAt(21, 7, 59), true},
+		{"end of quiet hours over midnight", quietSettings(22, 8), octoberAt(21, 8, 0), false},
+		{"before daytime quiet hours", quietSettings(13, 15), octoberAt(20, 12, 59), false},
+		{"inside daytime quiet hours", quietSettings(13, 15), octoberAt(20, 14, 59), true},
+		{"end of daytime quiet hours", quietSettings(13, 15), octoberAt(20, 15, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.InQuietHours(tt.t); got != tt.want {
+				t.Fatalf("InQuietHours(%s) = %v, want %v", tt.t.Format("15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuietBounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		settings  *UserSettings
+		t         time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"evening before midnight", quietSettings(22, 8), octoberAt(20, 23, 0), octoberAt(20, 22, 0), octoberAt(21, 8, 0)},
+		{"at the start", quietSettings(22, 8), octoberAt(20, 22, 0), octoberAt(20, 22, 0), octoberAt(21, 8, 0)},
+		{"night after midnight", quietSettings(22, 8), octoberAt(21, 3, 0), octoberAt(20, 22, 0), octoberAt(21, 8, 0)},
+		{"daytime", quietSettings(13, 15), octoberAt(20, 14, 0), octoberAt(20, 13, 0), octoberAt(20, 15, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.settings.quietBounds(tt.t)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Fatalf("got %s–%s, want %s–%s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestReminderTimes(t *testing.T) {
+	config := newTestConfig()
+	config.Reminders = []time.Duration{24 * time.Hour, 2 * time.Hour}
+	now := octoberAt(19, 12, 0)
+
+	morning := func(settings *UserSettings) *UserSettings {
+		settings.Reminders = ReminderMorning
+		return settings
+	}
+
+	tests := []struct {
+		name     string
+		start    time.Time
+		settings *UserSettings
+		want     []time.Time
+	}{
+		{"default reminders", octoberAt(21, 10, 0), &UserSettings{}, []time.Time{octoberAt(20, 10, 0), octoberAt(21, 8, 0)}},
+		{"reminder moved to the end of quiet hours", octoberAt(21, 9, 0), quietSettings(22, 8), []time.Time{octoberAt(20, 9, 0), octoberAt(21, 8, 0)}},
+		{"reminder at the end of quiet hours stays", octoberAt(21, 10, 0), quietSettings(22, 8), []time.Time{octoberAt(20, 10, 0), octoberAt(21, 8, 0)}},
+		{"visit before the end of quiet hours", octoberAt(21, 7, 30), quietSettings(22, 8), []time.Time{octoberAt(20, 8, 0), octoberAt(20, 21, 59)}},
+		{"daytime quiet hours", octoberAt(21, 16, 0), quietSettings(13, 15), []time.Time{octoberAt(20, 16, 0), octoberAt(21, 15, 0)}},
+		{"reminders already past are dropped", octoberAt(20, 10, 0), &UserSettings{}, []time.Time{octoberAt(20, 8, 0)}},
+		{"custom offset", octoberAt(21, 10, 0), &UserSettings{Reminders: "30m"}, []time.Time{octoberAt(21, 9, 30)}},
+		{"morning of the visit", octoberAt(21, 10, 0), morning(&UserSettings{}), []time.Time{octoberAt(21, 8, 0)}},
+		{"morning option with a visit before 08:00", octoberAt(21, 7, 30), morning(&UserSettings{}), []time.Time{octoberAt(21, 6, 30)}},
+		{"morning option with a visit before 08:00 and quiet hours", octoberAt(21, 7, 30), morning(quietSettings(22, 8)), []time.Time{octoberAt(20, 21, 59)}},
+		{"reminders off", octoberAt(21, 10, 0), &UserSettings{Reminders: ReminderOff}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reminderTimes(tt.start, tt.settings, config, now); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextSetting(t *testing.T) {
+	settings := &UserSettings{}
+
+	// Reminders cycle through the choices back to the default
+	for _, want := range []string{ReminderMorning, "2h", ReminderOff, ReminderDefault} {
+		nextSetting(settings, settingReminders)
+		if settings.Reminders != want {
+			t.Fatalf("got reminders %q, want %q", settings.Reminders, want)
+		}
+	}
+	settings.Reminders = "45m"
+	if nextSetting(settings, settingReminders); settings.Reminders != ReminderDefault {
+		t.Fatalf("got reminders %q after an offset not among the choices, want the default", settings.Reminders)
+	}
+
+	// Quiet hours go through the presets, then off
+	for _, want := range []string{"22:00–08:00", "23:00–07:00", "21:00–09:00", "выключены", "22:00–08:00"} {
+		nextSetting(settings, settingQuiet)
+		if got := describeQuietHours(settings); got != want {
+			t.Fatalf("got quiet hours %s, want %s", got, want)
+		}
+	}
+
+	if nextSetting(settings, settingLanguage); settings.Language != LangEnglish {
+		t.Fatalf("got language %q, want %q", settings.Language, LangEnglish)
+	}
+	if nextSetting(settings, settingLanguage); settings.Language != LangRussian {
+		t.Fatalf("got language %q, want %q", settings.Language, LangRussian)
+	}
+	if nextSetting(settings, settingMarketing); !settings.Marketing {
+		t.Fatal("marketing consent not switched on")
+	}
+}
+
+func TestRescheduleUserRemindersKeepsTheDeadline(t *testing.T) {
+	db := newTestDB(t)
+	config := newTestConfig()
+	config.Reminders = []time.Duration{24 * time.Hour, 2 * time.Hour}
+	config.ConfirmDeadline = 3 * time.Hour
+	addTestUsers(t, db, 1)
+
+	slot, err := BookTimeSlot(db, testSlotTime(10, 0), 1, "user", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := func() string {
+		t.Helper()
+		var status string
+		if err := db.QueryRow("SELECT status FROM jobs WHERE slot_id = ? AND kind = ?", slot.ID, JobConfirmDeadline).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	steps := []struct {
+		reminders string
+		jobs      map[string]string
+		deadline  string
+	}{
+		// A reminder still asks before the deadline
+		{"12h", map[string]string{"1440": JobStatusCancelled, "120": JobStatusCancelled, "720": JobStatusPending}, JobStatusPending},
+		// Nothing asks before the deadline anymore, so the booking is kept
+		{ReminderOff, map[string]string{"1440": JobStatusCancelled, "120": JobStatusCancelled, "720": JobStatusCancelled}, JobStatusCancelled},
+	}
+	for _, step := range steps {
+		if err := SaveUserSettings(db, &UserSettings{UserID: 1, Reminders: step.reminders, Language: LangRussian}); err != nil {
+			t.Fatal(err)
+		}
+		if err := RescheduleUserReminders(db, 1, config); err != nil {
+			t.Fatal(err)
+		}
+		if got := slotJobs(t, db, slot.ID); !reflect.DeepEqual(got, step.jobs) {
+			t.Fatalf("reminders %s: got jobs %v, want %v", step.reminders, got, step.jobs)
+		}
+		if got := deadline(); got != step.deadline {
+			t.Fatalf("reminders %s: got deadline %s, want %s", step.reminders, got, step.deadline)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// JoinWaitlist asks to be told when a time frees up on the date
+func JoinWaitlist(db *sql.DB, userID int64, date time.Time) error {
+	query := `
+		INSERT INTO waitlist (user_id, date, created_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (user_id, date) DO NOTHING
+	`
+
+	_, err := db.Exec(query, userID, date.Format(queueDateLayout), time.Now())
+	return err
+}
+
+// GetWaitlist returns the users waiting for the date, in the order they joined
+func GetWaitlist(db *sql.DB, date time.Time) ([]int64, error) {
+	rows, err := db.Query("SELECT user_id FROM waitlist WHERE date = ? ORDER BY created_at", date.Format(queueDateLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+
+	return users, rows.Err()
+}
+
+// leaveWaitlist removes a user who booked from every waitlist, along with dates already past
+func leaveWaitlist(ex execer, userID int64) error {
+	_, err := ex.Exec("DELETE FROM waitlist WHERE user_id = ? OR date < ?", userID, time.Now().Format(queueDateLayout))
+	return err
+}
+
+// offerReleasedSlot tells everyone waiting for the date that a time freed up; the first to tap books it.
+// Users the time is not open to, such as a slot reserved for another group, are not told.
+func (app *App) offerReleasedSlot(slotTime time.Time) {
+	if !slotTime.After(time.Now()) {
+		return
+	}
+
+	users, err := GetWaitlist(app.db, slotTime)
+	if err != nil {
+		log.Printf("Error getting waitlist: %v", err)
+		return
+	}
+
+	message := fmt.Sprintf("🔔 Освободилось время для записи: <b>%s</b>\n\nУспейте записаться, время достанется первому.", slotTime.Format("02.01.2006 15:04"))
+	button := tgbotapi.NewInlineKeyboardButtonData("📅 Записаться на "+slotTime.Format("15:04"), app.callbacks.Encode(cbSlot, slotTime.Format(callbackSlotLayout)))
+
+	for _, userID := range users {
+		if err := checkSlotOpen(app.db, slotTime, userID, app.config); err != nil {
+			continue
+		}
+
+		msg := tgbotapi.NewMessage(userID, message)
+		msg.ParseMode = "HTML"
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(button))
+		if err := app.queueMessage(msg); err != nil {
+			log.Printf("Error offering slot to user %d: %v", userID, err)
+		}
+	}
+}
+
+// Handlers
+
+// handleWaitlistCallback puts the user on the waitlist of a fully booked date
+func (app *App) handleWaitlistCallback(callback *tgbotapi.CallbackQuery, dateStr string) error {
+	chatID := callback.Message.Chat.ID
+
+	date, err := time.ParseInLocation(callbackDateLayout, dateStr, time.Local)
+	if err != nil {
+		return app.sendMessage(chatID, "Неверный формат даты")
+	}
+
+	if err := JoinWaitlist(app.db, callback.From.ID, date); err != nil {
+		log.Printf("Error joining waitlist: %v", err)
+		return app.sendMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+	}
+
+	app.removeKeyboard(chatID, callback.Message.MessageID)
+	return app.sendMessage(chatID, fmt.Sprintf("🔔 Мы сообщим, если на %s освободится время.", date.Format("02.01.2006")))
+}
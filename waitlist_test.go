@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOfferReleasedSlotRespectsGroupReservations(t *testing.T) {
+	config := newTestConfig()
+	config.GroupRules = []GroupRule{{Name: "pensioner", ReservePercent: 100}}
+	app := newTestApp(t, config)
+	addTestUsers(t, app.db, 1, 2)
+	if err := AddUserGroup(app.db, 1, "pensioner"); err != nil {
+		t.Fatal(err)
+	}
+
+	slotTime := testSlotTime(10, 0)
+	for _, userID := range []int64{1, 2} {
+		if err := JoinWaitlist(app.db, userID, slotTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app.offerReleasedSlot(slotTime)
+
+	if texts := outboxTexts(t, app, 1); len(texts) != 1 {
+		t.Fatalf("group member got %d offers, want 1", len(texts))
+	}
+	if texts := outboxTexts(t, app, 2); len(texts) != 0 {
+		t.Fatalf("user outside the group got %d offers of a reserved slot, want 0", len(texts))
+	}
+}